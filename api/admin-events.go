@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/auth"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/history"
+	"github.com/swaggest/usecase"
+	"github.com/swaggest/usecase/status"
+)
+
+const eventsTag = "Events"
+
+var errEventNotFound = errors.New("event not found")
+
+// ListEventsInput filters the event history.
+type ListEventsInput struct {
+	Source      string    `query:"source" description:"Receiver, e.g. github or microsoftgraph"`
+	Type        string    `query:"type" description:"Event type, * matches any characters except /"`
+	Tag         string    `query:"tag" description:"Tag added by a routing rule"`
+	Status      string    `query:"status" enum:"received,unrouted,delivered,partial,failed,quarantined"`
+	Correlation string    `query:"correlation" description:"Correlation ID of events received together"`
+	From        time.Time `query:"from" description:"Received at or after (RFC 3339)"`
+	To          time.Time `query:"to" description:"Received before (RFC 3339)"`
+	Limit       int       `query:"limit" default:"50" minimum:"1" maximum:"500"`
+}
+
+// EventSummary is an event without payload.
+type EventSummary struct {
+	ID            string    `json:"id"`
+	Source        string    `json:"source"`
+	Type          string    `json:"type"`
+	Subject       string    `json:"subject,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	Tags          []string  `json:"tags,omitempty"`
+	Time          time.Time `json:"time"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+}
+
+// ListEventsOutput is a page of the event history, newest first.
+type ListEventsOutput struct {
+	Events []EventSummary `json:"events"`
+}
+
+// EventInput identifies an event of the history.
+type EventInput struct {
+	ID string `path:"id"`
+}
+
+// AttemptsOutput lists the delivery attempts of an event.
+type AttemptsOutput struct {
+	Attempts []history.Attempt `json:"attempts"`
+}
+
+// adminListEvents lists the recently received events.
+func adminListEvents(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input ListEventsInput, output *ListEventsOutput) error {
+		records := app.History.List(history.Filter{
+			Source:        input.Source,
+			Type:          input.Type,
+			Tag:           input.Tag,
+			Status:        input.Status,
+			CorrelationID: input.Correlation,
+			From:          input.From,
+			To:            input.To,
+			Limit:         input.Limit,
+		})
+
+		output.Events = make([]EventSummary, 0, len(records))
+		for _, rec := range records {
+			output.Events = append(output.Events, EventSummary{
+				ID:            rec.Event.ID,
+				Source:        rec.Event.Source,
+				Type:          rec.Event.Type,
+				Subject:       rec.Event.Subject,
+				Tenant:        rec.Event.Tenant,
+				CorrelationID: rec.Event.CorrelationID,
+				Tags:          rec.Event.Tags,
+				Time:          rec.Event.Time,
+				Status:        rec.Status,
+				Attempts:      len(rec.Attempts),
+			})
+		}
+		return nil
+	})
+
+	u.SetTitle("List events")
+	u.SetDescription("Lists recently received events, newest first.")
+	u.SetTags(eventsTag)
+	return u
+}
+
+// adminGetEvent returns one event with its raw payload, headers and attempts.
+func adminGetEvent(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input EventInput, output *history.Record) error {
+		rec, ok := app.History.Get(input.ID)
+		if !ok {
+			return status.Wrap(errEventNotFound, status.NotFound)
+		}
+		*output = rec
+		return nil
+	})
+
+	u.SetTitle("Get event")
+	u.SetDescription("Returns the event as received, including payload and headers, and its delivery attempts.")
+	u.SetExpectedErrors(status.NotFound)
+	u.SetTags(eventsTag)
+	return u
+}
+
+// adminEventAttempts returns the delivery attempts of an event.
+func adminEventAttempts(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input EventInput, output *AttemptsOutput) error {
+		rec, ok := app.History.Get(input.ID)
+		if !ok {
+			return status.Wrap(errEventNotFound, status.NotFound)
+		}
+		output.Attempts = rec.Attempts
+		if output.Attempts == nil {
+			output.Attempts = []history.Attempt{}
+		}
+		return nil
+	})
+
+	u.SetTitle("Get delivery attempts")
+	u.SetDescription("Lists the per destination delivery attempts of an event.")
+	u.SetExpectedErrors(status.NotFound)
+	u.SetTags(eventsTag)
+	return u
+}
+
+// RedeliverInput selects the event and how to redeliver it.
+type RedeliverInput struct {
+	ID           string   `path:"id"`
+	Destinations []string `query:"destination" description:"Limit the redelivery to these destinations, defaults to all routed destinations"`
+	DryRun       bool     `query:"dryRun" description:"Only report which destinations would receive the event"`
+}
+
+// RedeliverOutput reports the destinations the event was sent to.
+type RedeliverOutput struct {
+	ID           string   `json:"id"`
+	DryRun       bool     `json:"dryRun"`
+	Destinations []string `json:"destinations"`
+	Status       string   `json:"status"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// adminRedeliverEvent pushes a stored event through routing again.
+func adminRedeliverEvent(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input RedeliverInput, output *RedeliverOutput) error {
+		actor := "unknown"
+		if id, ok := auth.IdentityFrom(ctx); ok {
+			actor = id.Subject
+		}
+
+		names, err := app.Redeliver(ctx, input.ID, input.Destinations, input.DryRun, actor)
+		if errors.Is(err, emitter.ErrEventNotFound) {
+			return status.Wrap(err, status.NotFound)
+		}
+		if names == nil && err != nil {
+			return status.Wrap(err, status.InvalidArgument)
+		}
+
+		*output = RedeliverOutput{
+			ID:           input.ID,
+			DryRun:       input.DryRun,
+			Destinations: names,
+			Status:       "delivered",
+		}
+		switch {
+		case input.DryRun:
+			output.Status = "dry-run"
+		case err != nil:
+			output.Status = "failed"
+			output.Error = err.Error()
+		}
+		return nil
+	})
+
+	u.SetTitle("Redeliver event")
+	u.SetDescription("Pushes a stored event through routing again. The attempts are recorded as manual replays by the caller.")
+	u.SetExpectedErrors(status.NotFound, status.InvalidArgument)
+	u.SetTags(eventsTag)
+	return u
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/aggregate"
+	"github.com/nexi-intra/koksmat-emit/internal/delay"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/graph"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"github.com/nexi-intra/koksmat-emit/internal/scheduler"
+	"github.com/swaggest/usecase"
+	"github.com/swaggest/usecase/status"
+)
+
+const adminTag = "Admin"
+
+// ReloadOutput describes the routing configuration active after a reload.
+type ReloadOutput struct {
+	Path         string    `json:"path"`
+	Rules        int       `json:"rules"`
+	Destinations int       `json:"destinations"`
+	LoadedAt     time.Time `json:"loadedAt"`
+}
+
+// adminReload re-reads the routing configuration file. An invalid file is
+// rejected with 412 and the active configuration stays in place.
+func adminReload(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input struct{}, output *ReloadOutput) error {
+		if err := app.Router.Reload(); err != nil {
+			return status.Wrap(err, status.FailedPrecondition)
+		}
+
+		rs := app.Router.Current()
+		*output = ReloadOutput{
+			Path:         app.Router.Path(),
+			Rules:        len(rs.Rules),
+			Destinations: len(rs.Destinations),
+			LoadedAt:     rs.LoadedAt,
+		}
+		return nil
+	})
+
+	u.SetTitle("Reload routing configuration")
+	u.SetDescription("Reads the routing rules and destinations again without restarting the service.")
+	u.SetExpectedErrors(status.FailedPrecondition)
+	u.SetTags(adminTag)
+	return u
+}
+
+// RoutingOutput is the active routing configuration.
+type RoutingOutput struct {
+	Path     string          `json:"path"`
+	LoadedAt time.Time       `json:"loadedAt"`
+	Config   *routing.Config `json:"config"`
+}
+
+// adminRouting shows the rules and destinations currently in use.
+func adminRouting(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input struct{}, output *RoutingOutput) error {
+		rs := app.Router.Current()
+		*output = RoutingOutput{
+			Path:     app.Router.Path(),
+			LoadedAt: rs.LoadedAt,
+			Config:   rs.Config,
+		}
+		return nil
+	})
+
+	u.SetTitle("Active routing configuration")
+	u.SetDescription("Shows the rules and destinations currently in use.")
+	u.SetTags(adminTag)
+	return u
+}
+
+// GraphDeltaInput selects the resource to sync.
+type GraphDeltaInput struct {
+	Resource string `query:"resource" description:"Resource path, e.g. users; all tracked resources when empty"`
+}
+
+// GraphDeltaOutput lists the outcome per resource.
+type GraphDeltaOutput struct {
+	Results []graph.SyncResult `json:"results"`
+}
+
+// adminGraphDelta runs the Graph delta sync now instead of waiting for the
+// schedule.
+func adminGraphDelta(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input GraphDeltaInput, output *GraphDeltaOutput) error {
+		if app.GraphDelta == nil {
+			return status.Wrap(errors.New("GRAPH_DELTA_RESOURCES is not set"), status.FailedPrecondition)
+		}
+		if input.Resource != "" {
+			output.Results = []graph.SyncResult{app.GraphDelta.Sync(ctx, input.Resource)}
+		} else {
+			output.Results = app.GraphDelta.SyncAll(ctx)
+		}
+		return nil
+	})
+
+	u.SetTitle("Run Graph delta sync")
+	u.SetDescription("Emits the changes of tracked Graph resources since the last sync, skipping changes received through the webhook.")
+	u.SetExpectedErrors(status.FailedPrecondition)
+	u.SetTags(adminTag)
+	return u
+}
+
+// DestinationsOutput lists the destinations with their circuit and limits.
+type DestinationsOutput struct {
+	Destinations []emitter.DestinationStatus `json:"destinations"`
+}
+
+// adminDestinations shows the circuit breaker state, pause and in-flight
+// deliveries of every destination.
+func adminDestinations(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input struct{}, output *DestinationsOutput) error {
+		output.Destinations = app.Destinations()
+		return nil
+	})
+
+	u.SetTitle("Destination health")
+	u.SetDescription("Shows the circuit breaker state, upstream pause and in-flight deliveries per destination.")
+	u.SetTags(adminTag)
+	return u
+}
+
+// ResetCircuitInput names the destination.
+type ResetCircuitInput struct {
+	Name string `path:"name"`
+}
+
+// adminResetCircuit closes the circuit of a destination, e.g. after the
+// upstream was fixed, without waiting for the cool-down.
+func adminResetCircuit(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input ResetCircuitInput, output *emitter.DestinationStatus) error {
+		if err := app.ResetCircuit(input.Name); err != nil {
+			return status.Wrap(err, status.NotFound)
+		}
+		for _, st := range app.Destinations() {
+			if st.Name == input.Name {
+				*output = st
+			}
+		}
+		return nil
+	})
+
+	u.SetTitle("Reset destination circuit")
+	u.SetDescription("Closes the circuit breaker of a destination.")
+	u.SetExpectedErrors(status.NotFound)
+	u.SetTags(adminTag)
+	return u
+}
+
+// AggregatesOutput lists the open aggregation windows.
+type AggregatesOutput struct {
+	Windows []aggregate.Window `json:"windows"`
+}
+
+// adminAggregates shows the windows of the aggregating rules which have not
+// been emitted yet.
+func adminAggregates(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input struct{}, output *AggregatesOutput) error {
+		var err error
+		output.Windows, err = app.Aggregator.Open()
+		return err
+	})
+
+	u.SetTitle("Open aggregation windows")
+	u.SetDescription("Shows the counts of the aggregating rules in the windows not closed yet.")
+	u.SetTags(adminTag)
+	return u
+}
+
+// DelayedOutput lists the pending delayed deliveries.
+type DelayedOutput struct {
+	Deliveries []delay.Delivery `json:"deliveries"`
+}
+
+// adminDelayed shows the deliveries of the delaying rules which are not due
+// yet.
+func adminDelayed(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input struct{}, output *DelayedOutput) error {
+		var err error
+		output.Deliveries, err = app.Delays.Pending()
+		return err
+	})
+
+	u.SetTitle("Delayed deliveries")
+	u.SetDescription("Shows the events held back by delaying rules with their due time.")
+	u.SetTags(adminTag)
+	return u
+}
+
+// CancelDelayedInput names the delivery.
+type CancelDelayedInput struct {
+	ID string `path:"id"`
+}
+
+// adminCancelDelayed drops a pending delayed delivery.
+func adminCancelDelayed(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input CancelDelayedInput, output *delay.Delivery) error {
+		d, err := app.Delays.Remove(input.ID)
+		if errors.Is(err, delay.ErrNotFound) {
+			return status.Wrap(err, status.NotFound)
+		}
+		*output = d
+		return err
+	})
+
+	u.SetTitle("Cancel delayed delivery")
+	u.SetDescription("Drops a delivery held back by a delaying rule.")
+	u.SetExpectedErrors(status.NotFound)
+	u.SetTags(adminTag)
+	return u
+}
+
+// SchedulesOutput lists the schedules.
+type SchedulesOutput struct {
+	Schedules []scheduler.Status `json:"schedules"`
+}
+
+// adminSchedules shows the schedules with their next and last run.
+func adminSchedules(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input struct{}, output *SchedulesOutput) error {
+		output.Schedules = app.Scheduler.Statuses()
+		return nil
+	})
+
+	u.SetTitle("Schedules")
+	u.SetDescription("Shows the schedules of the routing configuration with their next and last run.")
+	u.SetTags(adminTag)
+	return u
+}
+
+// RunScheduleInput names the schedule.
+type RunScheduleInput struct {
+	Name string `path:"name"`
+}
+
+// adminRunSchedule fires a schedule right away, e.g. to test its routing.
+func adminRunSchedule(app *emitter.App) usecase.Interactor {
+	u := usecase.NewInteractor(func(ctx context.Context, input RunScheduleInput, output *scheduler.Run) error {
+		run, err := app.Scheduler.Trigger(ctx, input.Name)
+		if errors.Is(err, scheduler.ErrUnknownSchedule) {
+			return status.Wrap(err, status.NotFound)
+		}
+		*output = run
+		return err
+	})
+
+	u.SetTitle("Run schedule")
+	u.SetDescription("Fires the event of a schedule now. The run is recorded as manual.")
+	u.SetExpectedErrors(status.NotFound)
+	u.SetTags(adminTag)
+	return u
+}
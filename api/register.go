@@ -3,10 +3,34 @@
 //
 // The API includes the following endpoints:
 // - POST /api/v1/github: Handles GitHub webhooks.
+// - POST /api/v1/gitlab: Handles GitLab webhooks.
+// - POST /api/v1/azuredevops: Handles Azure DevOps service hooks.
 // - POST /api/v1/officegraph/notify: Handles Microsoft Graph notifications.
+// - POST /api/v1/events: Accepts CloudEvents (structured, binary, batch).
+// - OPTIONS /api/v1/events: CloudEvents webhook abuse protection handshake.
+// - POST /api/v1/sharepoint: SharePoint list webhooks, fetching the changed items.
+// - POST /api/v1/eventgrid: Azure Event Grid deliveries and subscription validation.
+// - OPTIONS /api/v1/eventgrid: Event Grid CloudEvents schema handshake.
+// - POST /api/v1/hooks/{source}: Webhooks of sources declared in the routing configuration.
 //
-// The service also includes a profiler available at /debug/core and
-// documentation available at /docs.
+// The /admin group requires a bearer token, see package auth:
+// - GET /admin/routing: Shows the active routing configuration (read).
+// - GET /admin/events: Lists recently received events (read).
+// - GET /admin/events/{id}: Returns an event with payload and headers (read).
+// - GET /admin/events/{id}/attempts: Lists the delivery attempts (read).
+// - GET /admin/destinations: Shows circuit breakers, pauses and in-flight deliveries (read).
+// - GET /admin/aggregates: Lists the open aggregation windows (read).
+// - GET /admin/delayed: Lists the pending delayed deliveries (read).
+// - GET /admin/schedules: Lists the schedules with their next and last run (read).
+// - POST /admin/reload: Reloads the routing configuration (operate).
+// - POST /admin/events/{id}/redeliver: Redelivers a stored event (operate).
+// - POST /admin/graph/delta: Runs the Graph delta sync (operate).
+// - POST /admin/destinations/{name}/reset: Closes the circuit of a destination (operate).
+// - POST /admin/schedules/{name}/run: Fires a schedule now (operate).
+// - DELETE /admin/delayed/{id}: Cancels a delayed delivery (operate).
+// - /admin/debug/pprof/: Profiler (admin).
+//
+// Documentation is available at /docs.
 //
 // The service is built using the swaggest/rest and go-chi/chi packages.
 //
@@ -24,7 +48,9 @@ package api
 import (
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/nexi-intra/koksmat-emit/internal/auth"
 	"github.com/nexi-intra/koksmat-emit/internal/emitter"
 	"github.com/swaggest/openapi-go/openapi3"
 	"github.com/swaggest/rest/nethttp"
@@ -35,9 +61,44 @@ import (
 func addCoreEndpoints(s *web.Service, app *emitter.App) {
 
 	s.Method(http.MethodPost, "/api/v1/github", nethttp.NewHandler(webhook_GitHub(app)))
+	s.MethodFunc(http.MethodPost, "/api/v1/gitlab", webhook_GitLab(app))
+	s.MethodFunc(http.MethodPost, "/api/v1/azuredevops", webhook_AzureDevOps(app))
 	s.MethodFunc(http.MethodPost, "/api/v1/officegraph/notify", webhook_MicrosoftGraph(app))
+	s.MethodFunc(http.MethodPost, "/api/v1/events", webhook_CloudEvents(app))
+	s.MethodFunc(http.MethodOptions, "/api/v1/events", webhook_CloudEventsHandshake(app))
+	s.MethodFunc(http.MethodPost, "/api/v1/sharepoint", webhook_SharePoint(app))
+	s.MethodFunc(http.MethodPost, "/api/v1/eventgrid", webhook_EventGrid(app))
+	s.MethodFunc(http.MethodOptions, "/api/v1/eventgrid", webhook_EventGridHandshake(app))
+	s.MethodFunc(http.MethodPost, "/api/v1/hooks/{source}", webhook_Hooks(app))
+}
+
+func addAdminEndpoints(s *web.Service, app *emitter.App, authenticator *auth.Authenticator) {
+	bearer := nethttp.HTTPBearerSecurityMiddleware(s.OpenAPICollector, "bearerAuth",
+		"Static admin token or JWT issued by the configured OIDC provider", "JWT")
 
-	s.Mount("/debug/core", middleware.Profiler())
+	s.Route("/admin", func(r chi.Router) {
+		r.Group(func(r chi.Router) {
+			r.Use(bearer, authenticator.Require(auth.RoleRead))
+			r.Method(http.MethodGet, "/routing", nethttp.NewHandler(adminRouting(app)))
+			r.Method(http.MethodGet, "/events", nethttp.NewHandler(adminListEvents(app)))
+			r.Method(http.MethodGet, "/events/{id}", nethttp.NewHandler(adminGetEvent(app)))
+			r.Method(http.MethodGet, "/events/{id}/attempts", nethttp.NewHandler(adminEventAttempts(app)))
+			r.Method(http.MethodGet, "/destinations", nethttp.NewHandler(adminDestinations(app)))
+			r.Method(http.MethodGet, "/aggregates", nethttp.NewHandler(adminAggregates(app)))
+			r.Method(http.MethodGet, "/delayed", nethttp.NewHandler(adminDelayed(app)))
+			r.Method(http.MethodGet, "/schedules", nethttp.NewHandler(adminSchedules(app)))
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(bearer, authenticator.Require(auth.RoleOperate))
+			r.Method(http.MethodPost, "/reload", nethttp.NewHandler(adminReload(app)))
+			r.Method(http.MethodPost, "/events/{id}/redeliver", nethttp.NewHandler(adminRedeliverEvent(app)))
+			r.Method(http.MethodPost, "/graph/delta", nethttp.NewHandler(adminGraphDelta(app)))
+			r.Method(http.MethodPost, "/destinations/{name}/reset", nethttp.NewHandler(adminResetCircuit(app)))
+			r.Method(http.MethodPost, "/schedules/{name}/run", nethttp.NewHandler(adminRunSchedule(app)))
+			r.Method(http.MethodDelete, "/delayed/{id}", nethttp.NewHandler(adminCancelDelayed(app)))
+		})
+		r.With(authenticator.Require(auth.RoleAdmin)).Mount("/debug", middleware.Profiler())
+	})
 }
 
 func Start(port string, app *emitter.App) {
@@ -49,6 +110,7 @@ func Start(port string, app *emitter.App) {
 	service.OpenAPISchema().SetVersion("V1.0.0")
 
 	addCoreEndpoints(service, app)
+	addAdminEndpoints(service, app, app.Auth)
 	service.Docs("/docs", swgui.New)
 	app.Obs.Info("Server starting, view documentation at http://localhost" + port + "/docs")
 	go http.ListenAndServe(port, service)
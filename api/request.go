@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/swaggest/usecase/status"
+)
+
+// keptHeaders are kept with the received events. Other headers, which may
+// carry credentials like X-Gitlab-Token or aeg-sas-key, are left out of the
+// history, the admin API, the bus and the destinations.
+var keptHeaders = map[string]bool{
+	"Accept":            true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"User-Agent":        true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Proto": true,
+	"X-Request-Id":      true,
+	"Traceparent":       true,
+	"Tracestate":        true,
+
+	// GitHub, the signature is checked against the secrets of tenants
+	"X-Github-Delivery":                      true,
+	"X-Github-Event":                         true,
+	"X-Github-Hook-Id":                       true,
+	"X-Github-Hook-Installation-Target-Id":   true,
+	"X-Github-Hook-Installation-Target-Type": true,
+	"X-Hub-Signature-256":                    true,
+
+	// GitLab
+	"X-Gitlab-Event":        true,
+	"X-Gitlab-Event-Uuid":   true,
+	"X-Gitlab-Instance":     true,
+	"X-Gitlab-Webhook-Uuid": true,
+
+	// Event Grid
+	"Aeg-Data-Version":      true,
+	"Aeg-Delivery-Count":    true,
+	"Aeg-Event-Type":        true,
+	"Aeg-Metadata-Version":  true,
+	"Aeg-Subscription-Name": true,
+
+	// Microsoft Graph
+	"Client-Request-Id": true,
+	"Request-Id":        true,
+}
+
+// requestHeaders flattens the request headers for storing with the event.
+// Only keptHeaders, CloudEvents attributes and the extra headers, e.g. those
+// a hook source reads its type from, are kept.
+func requestHeaders(r *http.Request, extra ...string) map[string]string {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		if !keptHeaders[name] && !strings.HasPrefix(name, "Ce-") && !containsHeader(extra, name) {
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+func containsHeader(names []string, name string) bool {
+	for _, n := range names {
+		if n != "" && http.CanonicalHeaderKey(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads a request body of at most limit bytes. Larger bodies are
+// answered with 413 and false is returned.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// emitErrorStatus is the HTTP status of an error returned by Emit.
+func emitErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, emitter.ErrUnknownTenant):
+		return http.StatusForbidden
+	case errors.Is(err, emitter.ErrTenantSecret):
+		return http.StatusUnauthorized
+	case errors.Is(err, emitter.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, emitter.ErrReservedSource):
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+// emitErrorCode is emitErrorStatus for interactors.
+func emitErrorCode(err error) status.Code {
+	switch emitErrorStatus(err) {
+	case http.StatusForbidden:
+		return status.PermissionDenied
+	case http.StatusUnauthorized:
+		return status.Unauthenticated
+	case http.StatusTooManyRequests:
+		return status.ResourceExhausted
+	case http.StatusBadRequest:
+		return status.InvalidArgument
+	}
+	return status.Unavailable
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nexi-intra/koksmat-emit/internal/cloudevents"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// CloudEventResult reports what happened to one event of a request.
+type CloudEventResult struct {
+	ID     string `json:"id"`              // CloudEvents ID as sent
+	Event  string `json:"event,omitempty"` // ID of the normalized event
+	Status string `json:"status"`          // "accepted" or "failed"
+	Error  string `json:"error,omitempty"`
+}
+
+// webhook_CloudEvents accepts CloudEvents in structured, binary and batch
+// mode and hands them to the routing pipeline. Every event of a batch is
+// validated before any is accepted.
+//
+// When CLOUDEVENTS_TOKEN is set, requests must carry it as bearer token.
+//
+// Responses:
+//   - 202 Accepted: All events were accepted.
+//   - 400 Bad Request: The request is not a valid CloudEvent or batch.
+//   - 401 Unauthorized: The token is missing or wrong.
+//   - 503 Service Unavailable: Some events failed, see the results.
+func webhook_CloudEvents(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cloudEventsAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="koksmat-emit"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		batch, err := cloudevents.FromHTTPRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var invalid []error
+		for i, ce := range batch {
+			if err := ce.Validate(); err != nil {
+				invalid = append(invalid, indexedError(i, len(batch), err))
+			} else if events.Reserved(ce.Source) {
+				invalid = append(invalid, indexedError(i, len(batch), fmt.Errorf("source %s is reserved for the events of the emitter", ce.Source)))
+			}
+		}
+		if len(invalid) > 0 {
+			http.Error(w, errors.Join(invalid...).Error(), http.StatusBadRequest)
+			return
+		}
+
+		headers := requestHeaders(r)
+		results := make([]CloudEventResult, 0, len(batch))
+		code := http.StatusAccepted
+		for _, ce := range batch {
+			ev := ce.ToEvent()
+			ev.Headers = headers
+			result := CloudEventResult{ID: ce.ID, Event: ev.ID, Status: "accepted"}
+			if err := app.Emit(r.Context(), ev); err != nil {
+				app.Obs.Warning("CloudEvent not accepted", zap.String("id", ce.ID), zap.String("source", ce.Source), zap.Error(err))
+				result.Status = "failed"
+				result.Error = err.Error()
+				code = http.StatusServiceUnavailable
+			}
+			results = append(results, result)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+// webhook_CloudEventsHandshake answers the abuse protection handshake of the
+// CloudEvents HTTP webhook spec. Origins listed in CLOUDEVENTS_ALLOWED_ORIGINS
+// (comma separated, "*" for any, the default) are allowed to deliver.
+func webhook_CloudEventsHandshake(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("WebHook-Request-Origin")
+		if origin == "" {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !originAllowed(origin) {
+			app.Obs.Warning("CloudEvents handshake from unknown origin", zap.String("origin", origin))
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.Header().Set("WebHook-Allowed-Origin", origin)
+		if rate := viper.GetString("CLOUDEVENTS_ALLOWED_RATE"); rate != "" {
+			w.Header().Set("WebHook-Allowed-Rate", rate)
+		} else if r.Header.Get("WebHook-Request-Rate") != "" {
+			w.Header().Set("WebHook-Allowed-Rate", "*")
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func cloudEventsAuthorized(r *http.Request) bool {
+	token := viper.GetString("CLOUDEVENTS_TOKEN")
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func originAllowed(origin string) bool {
+	viper.SetDefault("CLOUDEVENTS_ALLOWED_ORIGINS", "*")
+	for _, allowed := range strings.Split(viper.GetString("CLOUDEVENTS_ALLOWED_ORIGINS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedError prefixes err with the position of the event in a batch.
+func indexedError(i, n int, err error) error {
+	if n == 1 {
+		return err
+	}
+	return fmt.Errorf("event %d: %w", i, err)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/nexi-intra/koksmat-emit/internal/codehost"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// webhook_GitLab receives GitLab webhooks. When GITLAB_WEBHOOK_TOKEN is set
+// the X-Gitlab-Token header must match it.
+//
+// Responses:
+//   - 200 OK: The event was accepted.
+//   - 400 Bad Request: The payload is not JSON.
+//   - 401 Unauthorized: The token is missing or wrong.
+//   - 403 Forbidden: The tenant is unknown and rejected.
+//   - 413 Request Entity Too Large: The payload exceeds the size limit.
+//   - 429 Too Many Requests: The tenant exceeded its rate limit.
+//   - 503 Service Unavailable: The event could not be processed.
+func webhook_GitLab(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := viper.GetString("GITLAB_WEBHOOK_TOKEN"); token != "" &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(token)) != 1 {
+			app.Obs.Warning("GitLab webhook with invalid token rejected")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, ok := readBody(w, r, maxHookBody)
+		if !ok {
+			return
+		}
+		ev, err := codehost.GitLab(r.Header.Get("X-Gitlab-Event"), r.Header.Get("X-Gitlab-Event-UUID"), body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		emitCodeHostEvent(app, w, r, ev)
+	}
+}
+
+// webhook_AzureDevOps receives Azure DevOps service hooks. When
+// AZUREDEVOPS_WEBHOOK_PASSWORD is set, requests must use basic
+// authentication with AZUREDEVOPS_WEBHOOK_USERNAME and that password.
+//
+// Responses:
+//   - 200 OK: The event was accepted.
+//   - 400 Bad Request: The payload is not a service hook event.
+//   - 401 Unauthorized: The credentials are missing or wrong.
+//   - 403 Forbidden: The tenant is unknown and rejected.
+//   - 413 Request Entity Too Large: The payload exceeds the size limit.
+//   - 429 Too Many Requests: The tenant exceeded its rate limit.
+//   - 503 Service Unavailable: The event could not be processed.
+func webhook_AzureDevOps(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if password := viper.GetString("AZUREDEVOPS_WEBHOOK_PASSWORD"); password != "" {
+			username, got, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(username), []byte(viper.GetString("AZUREDEVOPS_WEBHOOK_USERNAME"))) != 1 ||
+				subtle.ConstantTimeCompare([]byte(got), []byte(password)) != 1 {
+				app.Obs.Warning("Azure DevOps webhook with invalid credentials rejected")
+				w.Header().Set("WWW-Authenticate", `Basic realm="koksmat-emit"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		body, ok := readBody(w, r, maxHookBody)
+		if !ok {
+			return
+		}
+		ev, err := codehost.AzureDevOps(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		emitCodeHostEvent(app, w, r, ev)
+	}
+}
+
+func emitCodeHostEvent(app *emitter.App, w http.ResponseWriter, r *http.Request, ev events.Event) {
+	app.Obs.Info("Hook", zap.String("source", ev.Source), zap.String("type", ev.Type), zap.String("subject", ev.Subject))
+	ev.Headers = requestHeaders(r)
+	if err := app.Emit(r.Context(), ev); err != nil {
+		http.Error(w, err.Error(), emitErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HookOutput{ID: ev.ID, Status: "accepted"})
+}
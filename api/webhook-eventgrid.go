@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/cloudevents"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/eventgrid"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// webhook_EventGrid receives Azure Event Grid deliveries in the Event Grid
+// or the CloudEvents schema and emits one event per delivered event.
+//
+// When EVENTGRID_KEY is set, requests must carry it in the aeg-sas-key
+// header or the key query parameter. Subscription validation is answered
+// with the validation code; with EVENTGRID_VALIDATION=url the validation URL
+// is visited instead.
+//
+// Responses:
+//   - 200 OK: The events were accepted or the subscription validated.
+//   - 400 Bad Request: The body is not an Event Grid batch.
+//   - 401 Unauthorized: The key is missing or wrong.
+//   - 503 Service Unavailable: Some events failed, Event Grid retries.
+func webhook_EventGrid(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !eventGridAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var batch []events.Event
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == cloudevents.ContentTypeStructured || mediaType == cloudevents.ContentTypeBatch {
+			ces, err := cloudevents.FromHTTPRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, ce := range ces {
+				if err := ce.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				ev, err := eventgrid.FromCloudEvent(ce)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				batch = append(batch, ev)
+			}
+		} else {
+			body, err := io.ReadAll(io.LimitReader(r.Body, cloudevents.MaxBodySize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			grid, err := eventgrid.Parse(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if v, ok := eventgrid.Validate(grid); ok {
+				confirmEventGrid(app, w, v)
+				return
+			}
+			for _, e := range grid {
+				batch = append(batch, e.ToEvent())
+			}
+		}
+
+		headers := requestHeaders(r)
+		failed := 0
+		for _, ev := range batch {
+			ev.Headers = headers
+			if err := app.Emit(r.Context(), ev); err != nil {
+				app.Obs.Warning("Event Grid event not accepted", zap.String("type", ev.Type), zap.String("subject", ev.Subject), zap.Error(err))
+				failed++
+			}
+		}
+		if failed > 0 {
+			http.Error(w, "some events could not be processed", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// confirmEventGrid answers a subscription validation.
+func confirmEventGrid(app *emitter.App, w http.ResponseWriter, v *eventgrid.Validation) {
+	if viper.GetString("EVENTGRID_VALIDATION") == "url" && v.ValidationURL != "" {
+		app.Obs.Info("Confirming Event Grid subscription through the validation URL")
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := eventgrid.Confirm(ctx, http.DefaultClient, v); err != nil {
+				app.Obs.Error("Event Grid subscription validation failed", zap.Error(err))
+			}
+		}()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	app.Obs.Info("Confirming Event Grid subscription")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"validationResponse": v.ValidationCode})
+}
+
+// webhook_EventGridHandshake answers the CloudEvents abuse protection
+// handshake of Event Grid subscriptions using the CloudEvents schema.
+func webhook_EventGridHandshake(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !eventGridAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Allow", "OPTIONS, POST")
+		if origin := r.Header.Get("WebHook-Request-Origin"); origin != "" {
+			if origin != eventgrid.Origin {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			app.Obs.Info("Confirming Event Grid CloudEvents subscription")
+			w.Header().Set("WebHook-Allowed-Origin", origin)
+			w.Header().Set("WebHook-Allowed-Rate", "*")
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// eventGridAuthorized checks the key of a delivery. The key header is not
+// kept with the events and the query string is neither stored nor logged.
+func eventGridAuthorized(r *http.Request) bool {
+	key := viper.GetString("EVENTGRID_KEY")
+	if key == "" {
+		return true
+	}
+	got := r.Header.Get("aeg-sas-key")
+	if got == "" {
+		got = r.URL.Query().Get("key")
+	}
+	return subtle.ConstantTimeCompare(bytes.TrimSpace([]byte(got)), []byte(key)) == 1
+}
@@ -2,9 +2,16 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
 
 	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/swaggest/rest"
 	"github.com/swaggest/usecase"
+	"github.com/swaggest/usecase/status"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +27,45 @@ type GitHubWebhookInput struct {
 	Sender struct {
 		Login string `json:"login"`
 	} `json:"sender"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+
+	Event    string `header:"X-GitHub-Event" json:"-"`
+	Delivery string `header:"X-GitHub-Delivery" json:"-"`
+
+	raw     []byte
+	headers map[string]string
+}
+
+// LoadFromHTTPRequest decodes the payload while keeping the raw body, so the
+// event is forwarded exactly as GitHub sent it.
+func (i *GitHubWebhookInput) LoadFromHTTPRequest(r *http.Request) error {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxHookBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return rest.HTTPCodeAsError(http.StatusRequestEntityTooLarge)
+	}
+	if err != nil {
+		return status.Wrap(err, status.InvalidArgument)
+	}
+	if err := json.Unmarshal(body, i); err != nil {
+		return status.Wrap(err, status.InvalidArgument)
+	}
+	i.Event = r.Header.Get("X-GitHub-Event")
+	i.Delivery = r.Header.Get("X-GitHub-Delivery")
+	i.raw = body
+	i.headers = requestHeaders(r)
+	return nil
+}
+
+// eventType combines the GitHub event name and the action, e.g.
+// "pull_request.closed". Events without an action only use the event name.
+func (i *GitHubWebhookInput) eventType() string {
+	if i.Action == "" {
+		return i.Event
+	}
+	return i.Event + "." + i.Action
 }
 
 // GitHubWebhookOutput defines the response for the webhook handler.
@@ -44,6 +90,22 @@ func webhook_GitHub(app *emitter.App) usecase.Interactor {
 	u := usecase.NewInteractor(func(ctx context.Context, input GitHubWebhookInput, output *GitHubWebhookOutput) error {
 		app.Obs.Info("Hook", zap.String("action", input.Action))
 
+		ev := events.New("github", input.eventType(), input.raw)
+		if input.Repository.Name != "" {
+			ev.Subject = input.Repository.Owner.Login + "/" + input.Repository.Name
+		}
+		ev.Tenant = input.Organization.Login
+		if ev.Tenant == "" {
+			ev.Tenant = input.Repository.Owner.Login
+		}
+		ev.Headers = input.headers
+		if input.Delivery != "" {
+			ev.IdempotencyKey = "github:" + input.Delivery
+		}
+		if err := app.Emit(ctx, ev); err != nil {
+			return status.Wrap(err, emitErrorCode(err))
+		}
+
 		// Example logic: respond based on the action.
 		switch input.Action {
 		case "created":
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/hooks"
+	"go.uber.org/zap"
+)
+
+// maxHookBody limits the payload of webhooks.
+const maxHookBody = 4 << 20
+
+// HookOutput is the response to an accepted webhook.
+type HookOutput struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// webhook_Hooks receives the webhooks of the sources declared in the routing
+// configuration. The request is verified with the scheme of the source
+// before its payload is looked at.
+//
+// Responses:
+//   - 200 OK: The event was accepted.
+//   - 400 Bad Request: The payload is not JSON.
+//   - 401 Unauthorized: The request failed verification.
+//   - 403 Forbidden: The tenant is unknown and rejected.
+//   - 404 Not Found: No source with the name is declared.
+//   - 413 Request Entity Too Large: The payload exceeds the size limit.
+//   - 429 Too Many Requests: The tenant exceeded its rate limit.
+//   - 503 Service Unavailable: The event could not be processed.
+func webhook_Hooks(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "source")
+		source, ok := app.Router.Current().Sources[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown source %q", name), http.StatusNotFound)
+			return
+		}
+
+		body, ok := readBody(w, r, maxHookBody)
+		if !ok {
+			return
+		}
+
+		if err := source.Verify(r.Header, body); err != nil {
+			app.Obs.Warning("Webhook rejected", zap.String("source", name), zap.Error(err))
+			if errors.Is(err, hooks.ErrUnauthorized) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		ev, err := source.Event(r.Header, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ev.Headers = requestHeaders(r, source.Config.TypeHeader, source.Config.KeyHeader)
+		if err := app.Emit(r.Context(), ev); err != nil {
+			http.Error(w, err.Error(), emitErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(HookOutput{ID: ev.ID, Status: "accepted"})
+	}
+}
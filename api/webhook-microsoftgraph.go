@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/graph"
+	"go.uber.org/zap"
 	//"github.com/koksmat-com/koksmat/model"
 	//"github.com/magicbutton/magic-mix/model"
 )
@@ -18,6 +22,7 @@ type WebhookEventStruct struct {
 	SubscriptionID                 string    `json:"subscriptionId"`
 	SubscriptionExpirationDateTime time.Time `json:"subscriptionExpirationDateTime"`
 	ChangeType                     string    `json:"changeType"`
+	LifecycleEvent                 string    `json:"lifecycleEvent"`
 	Resource                       string    `json:"resource"`
 	ResourceData                   struct {
 		OdataType string `json:"@odata.type"`
@@ -29,22 +34,72 @@ type WebhookEventStruct struct {
 	TenantID    string `json:"tenantId"`
 }
 type Callback struct {
-	Value []WebhookEventStruct `json:"value"`
+	Value []json.RawMessage `json:"value"`
 }
 
+// idempotencyKey identifies a notification by subscription, resource, change
+// type and etag. Graph resends a notification with the same values, while a
+// new change of the resource has a new etag. Empty without an etag, the
+// payload hash is used then.
+func (n WebhookEventStruct) idempotencyKey() string {
+	if n.ResourceData.OdataEtag == "" {
+		return ""
+	}
+	return graph.Source + ":" + n.SubscriptionID + "|" + n.Resource + "|" + n.ChangeType + "|" + n.ResourceData.OdataEtag
+}
+
+// eventType is the change type, or the lifecycle event for lifecycle
+// notifications.
+func (n WebhookEventStruct) eventType() string {
+	switch {
+	case n.ChangeType != "":
+		return n.ChangeType
+	case n.LifecycleEvent != "":
+		return n.LifecycleEvent
+	}
+	return "notification"
+}
+
+// GraphNotificationResult reports what happened to one notification of a
+// callback.
+type GraphNotificationResult struct {
+	Resource string `json:"resource"`
+	Event    string `json:"event,omitempty"` // ID of the normalized event
+	Status   string `json:"status"`          // "accepted" or "failed"
+	Error    string `json:"error,omitempty"`
+}
+
+// GraphCallbackOutput is the response to a callback.
+type GraphCallbackOutput struct {
+	CorrelationID string                    `json:"correlationId"`
+	Results       []GraphNotificationResult `json:"results"`
+}
+
+// graphConcurrency bounds the notifications of a callback processed at the
+// same time. Graph expects an answer within a few seconds.
+const graphConcurrency = 8
+
 // webhook_MicrosoftGraph handles incoming HTTP requests for Microsoft Graph webhooks.
 // It performs validation of the subscription by checking for a "validationToken" query parameter.
 // If the token is present, it confirms the subscription by echoing the token back to the client.
-// If the token is not present, it decodes the request body into a Callback struct and processes the values.
-// It responds with a 200 status code and a "received" message upon successful processing.
+//
+// Otherwise every notification of the callback becomes an event of its own,
+// with the change type as type, the resource as subject and the callback's
+// correlation ID, and the events are processed independently. Notifications
+// which fail are reported in the response and stay in the event history for
+// redelivery, and the delta sync picks them up; the callback is only refused,
+// so Graph sends it again, when all of them failed.
 //
 // Parameters:
 //   - w: http.ResponseWriter to write the HTTP response.
 //   - r: *http.Request containing the HTTP request.
 //
 // Responses:
-//   - 200 OK: If the validation token is confirmed or the request body is successfully processed.
+//   - 200 OK: If the validation token is confirmed.
+//   - 202 Accepted: At least one notification was processed, see the results.
 //   - 400 Bad Request: If there is an error decoding the request body.
+//   - 413 Payload Too Large: If the body exceeds 4 MiB.
+//   - 503 Service Unavailable: All notifications failed.
 func webhook_MicrosoftGraph(app *emitter.App) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -59,29 +114,78 @@ func webhook_MicrosoftGraph(app *emitter.App) http.HandlerFunc {
 			return
 		}
 
+		data, ok := readBody(w, r, maxHookBody)
+		if !ok {
+			return
+		}
 		p := &Callback{}
-		err := json.NewDecoder(r.Body).Decode(&p)
+		err := json.Unmarshal(data, &p)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			log.Println(err)
 			return
 
 		}
+		notifications := make([]WebhookEventStruct, len(p.Value))
+		for i, raw := range p.Value {
+			if err := json.Unmarshal(raw, &notifications[i]); err != nil {
+				http.Error(w, fmt.Sprintf("notification %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
 
-		for _, v := range p.Value {
-			fmt.Println(v)
-
+		output := GraphCallbackOutput{
+			CorrelationID: events.NewID(),
+			Results:       make([]GraphNotificationResult, len(notifications)),
 		}
+		headers := requestHeaders(r)
+		var wg sync.WaitGroup
+		limit := make(chan struct{}, graphConcurrency)
+		for i, n := range notifications {
+			ev := events.New(graph.Source, n.eventType(), p.Value[i])
+			ev.Subject = n.Resource
+			ev.Tenant = n.TenantID
+			ev.CorrelationID = output.CorrelationID
+			ev.Headers = headers
+			ev.IdempotencyKey = n.idempotencyKey()
+
+			wg.Add(1)
+			limit <- struct{}{}
+			go func(i int, n WebhookEventStruct, ev events.Event) {
+				defer func() {
+					<-limit
+					wg.Done()
+				}()
+				result := GraphNotificationResult{Resource: n.Resource, Event: ev.ID, Status: "accepted"}
+				if err := app.Emit(r.Context(), ev); err != nil {
+					result.Status = "failed"
+					result.Error = err.Error()
+				} else if app.GraphDelta != nil {
+					// The delta sync skips changes the webhook delivered
+					app.GraphDelta.Notified(n.Resource)
+				}
+				output.Results[i] = result
+			}(i, n, ev)
+		}
+		wg.Wait()
 
-		data, err := json.Marshal(p)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Println(err)
-			return
+		failed := 0
+		for _, result := range output.Results {
+			if result.Status == "failed" {
+				failed++
+			}
+		}
+		code := http.StatusAccepted
+		if failed > 0 {
+			app.Obs.Warning("Graph notifications failed",
+				zap.String("correlationId", output.CorrelationID), zap.Int("failed", failed), zap.Int("notifications", len(notifications)))
+			if failed == len(notifications) {
+				code = http.StatusServiceUnavailable
+			}
 		}
-		app.SaveWebhook("microsoftgraph", string(data))
-		w.WriteHeader(200)
-		fmt.Fprint(w, "received")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(output)
 
 	}
 }
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/sharepoint"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// webhook_SharePoint receives SharePoint list webhook notifications.
+//
+// A request with a validationtoken query parameter is the subscription
+// handshake and the token is echoed. Otherwise the changes of the notified
+// lists are fetched in the background, as SharePoint expects an answer
+// within five seconds. Notifications without the SHAREPOINT_CLIENT_STATE of
+// the subscriptions are ignored.
+//
+// Responses:
+//   - 200 OK: The token is confirmed or the notifications are accepted.
+//   - 400 Bad Request: The body is not a notification.
+//   - 413 Payload Too Large: The body exceeds 4 MiB.
+//   - 503 Service Unavailable: Fetching changes is not configured.
+func webhook_SharePoint(app *emitter.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("validationtoken"); token != "" {
+			app.Obs.Info("Confirming SharePoint subscription")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, token)
+			return
+		}
+		if app.SharePoint == nil {
+			app.Obs.Error("SharePoint notification received, but SHAREPOINT_BASE_URL is not set")
+			http.Error(w, "SharePoint change fetching is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, ok := readBody(w, r, maxHookBody)
+		if !ok {
+			return
+		}
+		var notifications sharepoint.Notifications
+		if err := json.Unmarshal(body, &notifications); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		clientState := viper.GetString("SHAREPOINT_CLIENT_STATE")
+		seen := map[string]bool{}
+		for _, n := range notifications.Value {
+			if clientState == "" || subtle.ConstantTimeCompare([]byte(n.ClientState), []byte(clientState)) != 1 {
+				app.Obs.Warning("SharePoint notification with unknown client state ignored", zap.String("subscription", n.SubscriptionID))
+				continue
+			}
+			// Several notifications of a list are covered by one fetch
+			if key := n.SiteURL + "|" + n.Resource; !seen[key] {
+				seen[key] = true
+				if !app.SharePoint.Notify(n) {
+					app.Obs.Warning("Too many SharePoint lists fetched, changes are fetched on the next notification",
+						zap.String("site", n.SiteURL), zap.String("list", n.Resource))
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
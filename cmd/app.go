@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+)
+
+// startApp initializes the application, starts its background tasks and
+// reloads the routing configuration on SIGHUP.
+func startApp(ctx context.Context, obs *observability.Observability) *emitter.App {
+	app := emitter.NewApp(obs)
+	if app == nil {
+		obs.Error("Failed to initialize application")
+		os.Exit(1)
+	}
+
+	app.Start(ctx)
+
+	// Reload the routing configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			obs.Info("SIGHUP received, reloading routing configuration")
+			app.Router.Reload()
+		}
+	}()
+
+	return app
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM is received.
+func waitForShutdown() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 
 	"github.com/nexi-intra/koksmat-emit/api"
-	"github.com/nexi-intra/koksmat-emit/internal/emitter"
 	"github.com/nexi-intra/koksmat-emit/internal/observability"
 	"github.com/spf13/cobra"
 
@@ -15,8 +14,6 @@ import (
 
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
 
 	"go.uber.org/zap"
 )
@@ -40,15 +37,16 @@ var serveCmd = &cobra.Command{
 			}
 		}()
 
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
 		// Initialize Application
-		app := emitter.NewApp(obs)
+		app := startApp(ctx, obs)
+		app.StartScheduler(ctx)
 
 		// Setup HTTP handlers
 		mux := app.Routes()
 
-		// Setup /metrics endpoint
-		mux.(*http.ServeMux).Handle("/metrics", obs.MetricsHandler)
-
 		// Start the server
 		server := &http.Server{
 			Addr:    ":8080",
@@ -66,9 +64,7 @@ var serveCmd = &cobra.Command{
 		}()
 
 		// Wait for interrupt signal to gracefully shutdown the server
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		<-quit
+		waitForShutdown()
 		obs.Info("Shutting down server...")
 
 		if err := server.Shutdown(context.Background()); err != nil {
@@ -0,0 +1,85 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/worker"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// workerCmd represents the worker command
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Process events from NATS subjects.",
+	Long: `Subscribes to NATS subjects as member of a queue group and runs each message
+through the same routing and destinations as the webhooks. Start more replicas
+with the same queue group to scale out.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Initialize Observability
+		obs, err := observability.NewObservability()
+		if err != nil {
+			fmt.Printf("Failed to initialize observability: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := obs.Shutdown(); err != nil {
+				obs.Error("Error during shutdown", zap.Error(err))
+			}
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Initialize Application
+		app := startApp(ctx, obs)
+
+		w := worker.New(app, app.Mix.NATS(), worker.ConfigFromViper())
+		if err := w.Start(); err != nil {
+			obs.Error("Failed to start worker", zap.Error(err))
+			os.Exit(1)
+		}
+
+		// Health and metrics
+		mux := app.Routes()
+		server := &http.Server{
+			Addr:    ":8080",
+			Handler: mux,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				obs.Error("Server failed", zap.Error(err))
+			}
+		}()
+
+		waitForShutdown()
+		obs.Info("Shutting down worker...")
+
+		w.Stop()
+		if err := server.Shutdown(context.Background()); err != nil {
+			obs.Error("Server shutdown failed", zap.Error(err))
+		}
+
+		obs.Info("Worker exited gracefully")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+
+	workerCmd.Flags().String("subjects", "", "Comma separated subjects to subscribe to (WORKER_SUBJECTS)")
+	workerCmd.Flags().String("queue", "", "Queue group (WORKER_QUEUE)")
+	workerCmd.Flags().Int("concurrency", 0, "Subscriptions per subject (WORKER_CONCURRENCY)")
+	viper.BindPFlag("WORKER_SUBJECTS", workerCmd.Flags().Lookup("subjects"))
+	viper.BindPFlag("WORKER_QUEUE", workerCmd.Flags().Lookup("queue"))
+	viper.BindPFlag("WORKER_CONCURRENCY", workerCmd.Flags().Lookup("concurrency"))
+}
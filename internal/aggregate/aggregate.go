@@ -0,0 +1,167 @@
+// Package aggregate counts events in tumbling windows.
+//
+// Events are counted per rule, key and window, optionally listing an entry
+// per event. When a window has closed its aggregate event is emitted. The
+// open windows are kept in a hold.State, so a restart does not lose the
+// counts, and replicas sharing the state count in the same windows and emit
+// each once.
+package aggregate
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
+)
+
+// Source is the source of the aggregate events.
+const Source = events.SourceAggregate
+
+// MaxSeen bounds the event IDs a window keeps to recognize events
+// redelivered by the event stream. A redelivered event older than the last
+// MaxSeen events of its window is counted again.
+const MaxSeen = 256
+
+// Window is the aggregate of the events of a rule and key in a window.
+type Window struct {
+	ID           string    `json:"id"` // ID of the aggregate event
+	Rule         string    `json:"rule"`
+	Key          string    `json:"key"`
+	Start        time.Time `json:"windowStart"`
+	End          time.Time `json:"windowEnd"`
+	Count        int       `json:"count"`
+	Items        []string  `json:"items,omitempty"`
+	ItemsDropped int       `json:"itemsDropped,omitempty"` // Entries beyond the maximum
+	First        time.Time `json:"first"`                  // Time of the first event
+	Last         time.Time `json:"last"`
+	Tenant       string    `json:"tenant,omitempty"` // Set when all events have the same tenant
+}
+
+// window is the state of a Window.
+type window struct {
+	Window
+	Mixed bool     `json:"mixed,omitempty"` // Events of several tenants
+	Seen  []string `json:"seen,omitempty"`  // IDs of the last MaxSeen events
+}
+
+func (w *window) seen(id string) bool {
+	for _, seen := range w.Seen {
+		if seen == id {
+			return true
+		}
+	}
+	return false
+}
+
+// see records an event ID, dropping the oldest beyond MaxSeen.
+func (w *window) see(id string) {
+	w.Seen = append(w.Seen, id)
+	if len(w.Seen) > MaxSeen {
+		w.Seen = append([]string(nil), w.Seen[len(w.Seen)-MaxSeen:]...)
+	}
+}
+
+func storeKey(rule, key string, start time.Time) string {
+	return rule + "|" + key + "|" + start.UTC().Format(time.RFC3339)
+}
+
+// Event returns the aggregate event of the window: source "aggregate", the
+// rule as type, the key as subject and the window as payload.
+func (w Window) Event() events.Event {
+	payload, _ := json.Marshal(w)
+	ev := events.New(Source, w.Rule, payload)
+	ev.ID = w.ID
+	ev.Subject = w.Key
+	ev.Tenant = w.Tenant
+	ev.Internal = true
+	ev.Aggregated = &events.Aggregated{Rule: w.Rule, Key: w.Key}
+	ev.IdempotencyKey = "aggregate:" + w.ID
+	return ev
+}
+
+// Emitter emits the aggregate of a closed window.
+type Emitter func(ctx context.Context, w Window) error
+
+// Aggregator is safe for concurrent use, also by replicas sharing the state.
+type Aggregator struct {
+	queue *hold.Queue[window]
+	emit  Emitter
+	now   func() time.Time
+}
+
+// New returns an Aggregator keeping its windows in state.
+func New(state hold.State, emit Emitter) *Aggregator {
+	return &Aggregator{queue: hold.New(state, late), emit: emit, now: time.Now}
+}
+
+// Add counts the event in the window of rule and key from start to end. The
+// item is listed unless it is empty or maxItems entries are listed already.
+func (a *Aggregator) Add(rule, key string, start, end time.Time, item string, maxItems int, ev events.Event) (Window, error) {
+	it, err := a.queue.Update(storeKey(rule, key, start), func(it *hold.Item[window], exists bool) (bool, error) {
+		w := &it.Value
+		if !exists {
+			*w = window{Window: Window{
+				ID: events.NewID(), Rule: rule, Key: key, Start: start, End: end, First: ev.Time, Tenant: ev.Tenant,
+			}}
+		} else if w.seen(ev.ID) {
+			// Redelivered by the event stream
+			return false, nil
+		}
+		w.see(ev.ID)
+		w.Count++
+		w.Last = ev.Time
+		if w.Mixed || w.Tenant != ev.Tenant {
+			w.Tenant, w.Mixed = "", true
+		}
+		if item != "" {
+			if len(w.Items) < maxItems {
+				w.Items = append(w.Items, item)
+			} else {
+				w.ItemsDropped++
+			}
+		}
+		it.Due = end
+		return true, nil
+	})
+	return it.Value.Window, err
+}
+
+// late returns the window of the events added while a window was emitted,
+// which is emitted again under a new ID.
+func late(emitted, current window) (window, bool) {
+	if current.Count <= emitted.Count {
+		return current, false
+	}
+	current.ID = events.NewID()
+	current.Count -= emitted.Count
+	current.Items = current.Items[len(emitted.Items):]
+	current.ItemsDropped -= emitted.ItemsDropped
+	current.First = emitted.Last
+	return current, true
+}
+
+// Open returns the windows not emitted yet, the next to close first.
+func (a *Aggregator) Open() ([]Window, error) {
+	items, err := a.queue.List()
+	windows := make([]Window, 0, len(items))
+	for _, it := range items {
+		windows = append(windows, it.Value.Window)
+	}
+	return windows, err
+}
+
+// Flush emits the closed windows. A window whose emission fails is retried
+// after hold.RetryDelay. The number of emitted windows is returned.
+func (a *Aggregator) Flush(ctx context.Context) (int, error) {
+	return a.queue.Flush(ctx, a.now(), func(ctx context.Context, it hold.Item[window]) error {
+		return a.emit(ctx, it.Value.Window)
+	})
+}
+
+// Run emits the closed windows every interval until ctx is done. Errors are
+// passed to onError.
+func (a *Aggregator) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	hold.Run(ctx, interval, a.Flush, onError)
+}
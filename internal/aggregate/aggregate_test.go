@@ -0,0 +1,120 @@
+package aggregate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
+	"github.com/nexi-intra/koksmat-emit/internal/hold/holdtest"
+)
+
+func TestAggregator_Flush(t *testing.T) {
+	state, reopen := holdtest.State(t)
+	var emitted holdtest.Recorder[Window]
+	a := New(state, emitted.Flush)
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	clock := &holdtest.Clock{T: start.Add(time.Hour)}
+	a.now = clock.Now
+	ctx := context.Background()
+
+	add := func(key, item, tenant string) events.Event {
+		ev := events.New("github", "pull_request.closed", []byte(`{}`))
+		ev.Time, ev.Tenant = clock.Now(), tenant
+		if _, err := a.Add("merged", key, start, end, item, 2, ev); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		return ev
+	}
+	first := add("org/a", "#1", "contoso")
+	second := add("org/a", "#2", "contoso")
+	add("org/a", "#3", "contoso")
+	add("org/b", "#4", "contoso")
+	add("org/b", "#5", "fabrikam")
+
+	// Redelivered events are counted once, also when others came between
+	for _, ev := range []events.Event{first, second} {
+		if _, err := a.Add("merged", "org/a", start, end, "#", 2, ev); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if n, _ := a.Flush(ctx); n != 0 {
+		t.Fatalf("Flush() emitted %d windows before they closed", n)
+	}
+	if open, err := a.Open(); len(open) != 2 || err != nil {
+		t.Fatalf("Open() = %d windows, %v, want 2", len(open), err)
+	}
+
+	// The windows are emitted once closed, also after a restart
+	a = New(reopen(), emitted.Flush)
+	clock.T = end
+	a.now = clock.Now
+	if n, err := a.Flush(ctx); n != 2 || err != nil {
+		t.Fatalf("Flush() = %d, %v, want 2 windows", n, err)
+	}
+	byKey := map[string]Window{}
+	for _, w := range emitted.Values {
+		ev := w.Event()
+		if ev.Source != Source || ev.Type != "merged" || !ev.Internal || ev.Aggregated == nil || ev.Aggregated.Rule != "merged" {
+			t.Errorf("Flush() event %s/%s", ev.Source, ev.Type)
+		}
+		var w Window
+		if err := json.Unmarshal(ev.Payload, &w); err != nil {
+			t.Fatal(err)
+		}
+		byKey[ev.Subject] = w
+	}
+	if w := byKey["org/a"]; w.Count != 3 || len(w.Items) != 2 || w.ItemsDropped != 1 || w.Tenant != "contoso" {
+		t.Errorf("Flush() org/a = %+v", w)
+	}
+	if w := byKey["org/b"]; w.Count != 2 || w.Tenant != "" {
+		t.Errorf("Flush() org/b = %+v", w)
+	}
+
+	// A failed emission is retried
+	add("org/c", "", "")
+	emitted.Err = errors.New("stream unavailable")
+	if _, err := a.Flush(ctx); err == nil {
+		t.Fatalf("Flush() error = nil")
+	}
+	emitted.Err = nil
+	if n, _ := a.Flush(ctx); n != 0 {
+		t.Fatalf("Flush() retried before the delay")
+	}
+	clock.Add(hold.RetryDelay)
+	if n, err := a.Flush(ctx); n != 1 || err != nil {
+		t.Fatalf("Flush() retry = %d, %v", n, err)
+	}
+}
+
+func TestAggregator_Replicas(t *testing.T) {
+	state, _ := holdtest.State(t)
+	clock := holdtest.NewClock()
+	var emitted holdtest.Recorder[Window]
+	replicas := []*Aggregator{New(state, emitted.Flush), New(state, emitted.Flush)}
+	start := clock.Now().Truncate(time.Hour)
+	end := start.Add(time.Hour)
+	ctx := context.Background()
+
+	// The events of a window reach both replicas
+	for _, a := range replicas {
+		a.now = clock.Now
+		ev := events.New("github", "pull_request.closed", []byte(`{}`))
+		if _, err := a.Add("merged", "org/a", start, end, "", 0, ev); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	clock.T = end
+	for _, a := range replicas {
+		if _, err := a.Flush(ctx); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+	}
+	if len(emitted.Values) != 1 || emitted.Values[0].Count != 2 {
+		t.Fatalf("Flush() by the replicas = %+v, want one window of 2", emitted.Values)
+	}
+}
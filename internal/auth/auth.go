@@ -0,0 +1,266 @@
+// Package auth protects the admin API.
+//
+// Callers present a bearer token which is either one of the configured static
+// tokens or a JWT issued by an OIDC provider and verified against its JWKS.
+// Every caller ends up with a Role; roles are ordered so that admin includes
+// operate, which includes read.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/viper"
+)
+
+// Role grants access to a group of admin endpoints.
+type Role int
+
+const (
+	RoleNone    Role = iota
+	RoleRead         // Inspect configuration, events and state
+	RoleOperate      // Reload configuration, redeliver events
+	RoleAdmin        // Everything, including the profiler
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleOperate:
+		return "operate"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// MarshalText writes the role name.
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// ParseRole converts a role name into a Role.
+func ParseRole(name string) (Role, error) {
+	switch strings.ToLower(name) {
+	case "read":
+		return RoleRead, nil
+	case "operate":
+		return RoleOperate, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role %q", name)
+	}
+}
+
+// Identity is the authenticated caller.
+type Identity struct {
+	Subject string `json:"subject"`
+	Role    Role   `json:"role"`
+	Method  string `json:"method"` // "token" or "jwt"
+}
+
+type identityKey struct{}
+
+// WithIdentity stores the identity in the context.
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity stored by the middleware.
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+var (
+	errNoCredentials = errors.New("missing bearer token")
+	errInvalidToken  = errors.New("invalid bearer token")
+)
+
+type staticToken struct {
+	name string
+	role Role
+	hash [sha256.Size]byte
+}
+
+// Authenticator validates bearer tokens.
+type Authenticator struct {
+	tokens     []staticToken
+	keys       *KeySet
+	issuer     string
+	audience   string
+	rolesClaim string
+}
+
+// NewAuthenticatorFromConfig builds an Authenticator from the ADMIN_* settings.
+//
+//   - ADMIN_TOKENS: comma separated name:role:token static tokens
+//   - ADMIN_JWKS_URL or ADMIN_JWKS_FILE: key set used to verify JWTs
+//   - ADMIN_JWT_ISSUER, ADMIN_JWT_AUDIENCE: required iss and aud claims,
+//     both must be set with a key set
+//   - ADMIN_ROLES_CLAIM: claim holding the role names (default roles)
+//
+// Without any of these the admin API rejects every request.
+func NewAuthenticatorFromConfig() (*Authenticator, error) {
+	viper.SetDefault("ADMIN_ROLES_CLAIM", "roles")
+
+	a := &Authenticator{
+		issuer:     viper.GetString("ADMIN_JWT_ISSUER"),
+		audience:   viper.GetString("ADMIN_JWT_AUDIENCE"),
+		rolesClaim: viper.GetString("ADMIN_ROLES_CLAIM"),
+	}
+
+	if tokens := viper.GetString("ADMIN_TOKENS"); tokens != "" {
+		for _, spec := range strings.Split(tokens, ",") {
+			parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+			if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+				return nil, fmt.Errorf("invalid admin token %q, expected name:role:token", parts[0])
+			}
+			role, err := ParseRole(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("admin token %s: %w", parts[0], err)
+			}
+			a.AddToken(parts[0], role, parts[2])
+		}
+	}
+
+	if (viper.GetString("ADMIN_JWKS_URL") != "" || viper.GetString("ADMIN_JWKS_FILE") != "") &&
+		(a.issuer == "" || a.audience == "") {
+		// Shared key sets, like those of Entra ID, sign the tokens of every
+		// tenant and app
+		return nil, errors.New("ADMIN_JWT_ISSUER and ADMIN_JWT_AUDIENCE are required with a JWT key set")
+	}
+
+	switch {
+	case viper.GetString("ADMIN_JWKS_URL") != "":
+		a.keys = NewRemoteKeySet(viper.GetString("ADMIN_JWKS_URL"))
+	case viper.GetString("ADMIN_JWKS_FILE") != "":
+		keys, err := NewFileKeySet(viper.GetString("ADMIN_JWKS_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	return a, nil
+}
+
+// AddToken registers a static token.
+func (a *Authenticator) AddToken(name string, role Role, token string) {
+	a.tokens = append(a.tokens, staticToken{name: name, role: role, hash: sha256.Sum256([]byte(token))})
+}
+
+// SetKeySet configures the keys used to verify JWTs and the issuer and
+// audience they must have.
+func (a *Authenticator) SetKeySet(keys *KeySet, issuer string, audience string) {
+	a.keys = keys
+	a.issuer = issuer
+	a.audience = audience
+}
+
+// Authenticate resolves the bearer token of the request into an Identity.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return Identity{}, errNoCredentials
+	}
+	token := strings.TrimSpace(header[7:])
+
+	hash := sha256.Sum256([]byte(token))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			return Identity{Subject: t.name, Role: t.role, Method: "token"}, nil
+		}
+	}
+
+	if a.keys != nil && strings.Count(token, ".") == 2 {
+		return a.verifyJWT(r.Context(), token)
+	}
+	return Identity{}, errInvalidToken
+}
+
+func (a *Authenticator) verifyJWT(ctx context.Context, token string) (Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return Identity{}, fmt.Errorf("%w: token has no valid expiry", errInvalidToken)
+	}
+	if a.issuer == "" || !claims.VerifyIssuer(a.issuer, true) {
+		return Identity{}, fmt.Errorf("%w: unexpected issuer", errInvalidToken)
+	}
+	if a.audience == "" || !claims.VerifyAudience(a.audience, true) {
+		return Identity{}, fmt.Errorf("%w: unexpected audience", errInvalidToken)
+	}
+
+	id := Identity{Method: "jwt"}
+	id.Subject, _ = claims["sub"].(string)
+	if name, ok := claims["preferred_username"].(string); ok && name != "" {
+		id.Subject = name
+	}
+	for _, name := range claimValues(claims[a.rolesClaim]) {
+		if role, err := ParseRole(name); err == nil && role > id.Role {
+			id.Role = role
+		}
+	}
+	return id, nil
+}
+
+// claimValues accepts a claim holding a list or a space separated string.
+func claimValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// Require returns a middleware letting through callers with at least the
+// given role. The identity is available to handlers through IdentityFrom.
+func (a *Authenticator) Require(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := a.Authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="koksmat-emit"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if id.Role < role {
+				http.Error(w, fmt.Sprintf("role %s required", role), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/viper"
+)
+
+func writeKeySet(t *testing.T, kid string, key *ecdsa.PublicKey) string {
+	t.Helper()
+	set := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": kid,
+			"kty": "EC",
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticator_Require(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewFileKeySet(writeKeySet(t, "k1", &key.PublicKey))
+	if err != nil {
+		t.Fatalf("NewFileKeySet() error = %v", err)
+	}
+
+	a := &Authenticator{rolesClaim: "roles"}
+	a.AddToken("ci", RoleRead, "read-token")
+	a.AddToken("ops", RoleAdmin, "admin-token")
+	a.SetKeySet(keys, "https://login.example.com", "koksmat-emit")
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "k1"
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "No token", want: http.StatusUnauthorized},
+		{name: "Unknown token", authorization: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "Static token with too little access", authorization: "Bearer read-token", want: http.StatusForbidden},
+		{name: "Static admin token", authorization: "Bearer admin-token", want: http.StatusOK},
+		{
+			name: "JWT with operate role",
+			authorization: "Bearer " + sign(jwt.MapClaims{
+				"iss": "https://login.example.com", "aud": "koksmat-emit", "exp": exp, "sub": "alice", "roles": []string{"operate"},
+			}),
+			want: http.StatusOK,
+		},
+		{
+			name: "JWT for another audience",
+			authorization: "Bearer " + sign(jwt.MapClaims{
+				"iss": "https://login.example.com", "aud": "other", "exp": exp, "roles": []string{"admin"},
+			}),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "JWT of another issuer",
+			authorization: "Bearer " + sign(jwt.MapClaims{
+				"iss": "https://login.example.com/other-tenant", "aud": "koksmat-emit", "exp": exp, "roles": []string{"admin"},
+			}),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "JWT without issuer and audience",
+			authorization: "Bearer " + sign(jwt.MapClaims{
+				"exp": exp, "roles": []string{"admin"},
+			}),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "Expired JWT",
+			authorization: "Bearer " + sign(jwt.MapClaims{
+				"iss": "https://login.example.com", "aud": "koksmat-emit", "exp": time.Now().Add(-time.Minute).Unix(), "roles": "admin",
+			}),
+			want: http.StatusUnauthorized,
+		},
+	}
+
+	handler := a.Require(RoleOperate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := IdentityFrom(r.Context()); !ok {
+			t.Errorf("identity missing from context")
+		}
+	}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorFromConfig(t *testing.T) {
+	defer viper.Reset()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("ADMIN_JWKS_FILE", writeKeySet(t, "k1", &key.PublicKey))
+
+	viper.Set("ADMIN_JWT_ISSUER", "https://login.example.com")
+	if _, err := NewAuthenticatorFromConfig(); err == nil {
+		t.Errorf("NewAuthenticatorFromConfig() without audience error = nil")
+	}
+	viper.Set("ADMIN_JWT_AUDIENCE", "koksmat-emit")
+	if _, err := NewAuthenticatorFromConfig(); err != nil {
+		t.Errorf("NewAuthenticatorFromConfig() error = %v", err)
+	}
+}
+
+func TestKeySet_BacksOffAfterFailure(t *testing.T) {
+	var mu sync.Mutex
+	downloads := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		downloads++
+		mu.Unlock()
+		<-release
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ks := NewRemoteKeySet(server.URL)
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ks.Key(context.Background(), "key-1")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err == nil {
+			t.Errorf("Key() expected an error")
+		}
+	}
+
+	if _, err := ks.Key(context.Background(), "key-1"); err == nil {
+		t.Errorf("Key() expected an error")
+	}
+	if downloads != 1 {
+		t.Errorf("Key() downloaded the key set %d times, want 1", downloads)
+	}
+}
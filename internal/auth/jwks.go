@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval is how long a downloaded key set is trusted, and
+// jwksMinRefresh limits how often an unknown kid or a failed download
+// triggers a download.
+const (
+	jwksRefreshInterval = 10 * time.Minute
+	jwksMinRefresh      = 30 * time.Second
+)
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// KeySet holds the public keys of a JSON Web Key Set read from a URL or a
+// file. Keys from a URL are refreshed periodically and when a token refers
+// to an unknown kid.
+type KeySet struct {
+	url    string
+	file   string
+	client *http.Client
+
+	mu         sync.Mutex
+	keys       map[string]interface{}
+	fetched    time.Time
+	failed     time.Time     // Last failed download, downloads back off after it
+	err        error         // Error of the last download
+	refreshing chan struct{} // Closed when the running download is done
+}
+
+// NewRemoteKeySet returns a KeySet downloaded from url.
+func NewRemoteKeySet(url string) *KeySet {
+	return &KeySet{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// NewFileKeySet reads a KeySet from a file, for offline use.
+func NewFileKeySet(path string) (*KeySet, error) {
+	ks := &KeySet{file: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ks.keys, err = parseKeySet(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ks, nil
+}
+
+// Key returns the public key with the given kid.
+func (ks *KeySet) Key(ctx context.Context, kid string) (interface{}, error) {
+	if ks.url != "" {
+		if err := ks.refresh(ctx, kid); err != nil {
+			return nil, err
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	key, ok := ks.keys[kid]
+	switch {
+	case ok:
+		return key, nil
+	case ks.keys == nil && ks.err != nil:
+		return nil, ks.err
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// refresh downloads the key set when it is due. Only one download runs at a
+// time, outside the lock; callers whose key is known do not wait for it.
+// After a failed download the next one waits for jwksMinRefresh.
+func (ks *KeySet) refresh(ctx context.Context, kid string) error {
+	ks.mu.Lock()
+	_, known := ks.keys[kid]
+	age := time.Since(ks.fetched)
+	due := age > jwksRefreshInterval || (!known && age > jwksMinRefresh)
+	if !due || time.Since(ks.failed) < jwksMinRefresh {
+		ks.mu.Unlock()
+		return nil
+	}
+	if done := ks.refreshing; done != nil {
+		ks.mu.Unlock()
+		if known {
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	ks.refreshing = done
+	ks.mu.Unlock()
+
+	// The download serves every waiting request, not just this one
+	keys, err := ks.fetch(context.WithoutCancel(ctx))
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.err = err
+	if err != nil {
+		ks.failed = time.Now()
+	} else {
+		ks.keys, ks.fetched, ks.failed = keys, time.Now(), time.Time{}
+	}
+	ks.refreshing = nil
+	close(done)
+	return nil
+}
+
+func (ks *KeySet) fetch(ctx context.Context) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeySet(data)
+}
+
+func parseKeySet(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes RSA and EC keys. Other key types are ignored.
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,119 @@
+package azuread
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const assertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Certificate is the certificate credential of an app. The token request
+// carries a client assertion signed with its private key. SharePoint REST
+// only accepts app-only tokens acquired this way.
+type Certificate struct {
+	Leaf *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+// LoadCertificate reads a PEM encoded certificate and its RSA private key,
+// in PKCS #1 or PKCS #8 form. Both may be in the same file.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	var c Certificate
+	for _, file := range []string{certFile, keyFile} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.parse(data, file == certFile); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if c.Leaf == nil {
+		return nil, fmt.Errorf("%s holds no certificate", certFile)
+	}
+	if c.Key == nil {
+		return nil, fmt.Errorf("%s holds no private key", keyFile)
+	}
+	if !c.Key.PublicKey.Equal(c.Leaf.PublicKey) {
+		return nil, errors.New("the private key does not belong to the certificate")
+	}
+	return &c, nil
+}
+
+// parse takes the first certificate, when leaf is set, and the private key
+// of the PEM blocks.
+func (c *Certificate) parse(data []byte, leaf bool) error {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if !leaf || c.Leaf != nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			c.Leaf = cert
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			c.Key = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return errors.New("the private key is not an RSA key")
+			}
+			c.Key = rsaKey
+		}
+	}
+}
+
+// assertion returns a client assertion for the token endpoint, valid for
+// ten minutes.
+func (c *Certificate) assertion(clientID, endpoint string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{
+		Audience:  endpoint,
+		Issuer:    clientID,
+		Subject:   clientID,
+		Id:        hex.EncodeToString(id),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(10 * time.Minute).Unix(),
+	})
+	sha1Sum := sha1.Sum(c.Leaf.Raw)
+	sha256Sum := sha256.Sum256(c.Leaf.Raw)
+	token.Header["x5t"] = base64.RawURLEncoding.EncodeToString(sha1Sum[:])
+	token.Header["x5t#S256"] = base64.RawURLEncoding.EncodeToString(sha256Sum[:])
+	return token.SignedString(c.Key)
+}
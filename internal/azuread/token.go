@@ -0,0 +1,107 @@
+// Package azuread acquires access tokens from Microsoft Entra ID (Azure AD)
+// for calls to Microsoft Graph and SharePoint.
+package azuread
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource returns a bearer token for outgoing requests.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a token managed outside the emitter.
+type StaticToken string
+
+// Token returns the token.
+func (t StaticToken) Token(ctx context.Context) (string, error) {
+	if t == "" {
+		return "", fmt.Errorf("no access token configured")
+	}
+	return string(t), nil
+}
+
+// ClientCredentials acquires app-only tokens with a client secret or a
+// certificate and caches them until shortly before they expire.
+type ClientCredentials struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	Certificate  *Certificate // Used instead of the secret when set
+	Scope        string       // e.g. https://graph.microsoft.com/.default
+	Authority    string       // Default https://login.microsoftonline.com
+	HTTPClient   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Token returns the cached token or acquires a new one.
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expires) > time.Minute {
+		return c.token, nil
+	}
+
+	authority := c.Authority
+	if authority == "" {
+		authority = "https://login.microsoftonline.com"
+	}
+	endpoint := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(c.TenantID) + "/oauth2/v2.0/token"
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {c.ClientID},
+		"scope":      {c.Scope},
+	}
+	if c.Certificate != nil {
+		assertion, err := c.Certificate.assertion(c.ClientID, endpoint)
+		if err != nil {
+			return "", fmt.Errorf("client assertion: %w", err)
+		}
+		form.Set("client_assertion_type", assertionType)
+		form.Set("client_assertion", assertion)
+	} else {
+		form.Set("client_secret", c.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("token request failed: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	c.token = body.AccessToken
+	c.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return c.token, nil
+}
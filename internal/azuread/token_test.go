@@ -0,0 +1,102 @@
+package azuread
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// writeCertificate writes a self-signed certificate followed by its key.
+func writeCertificate(t *testing.T) (string, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "koksmat-emit"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})...)
+	file := filepath.Join(t.TempDir(), "app.pem")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file, leaf
+}
+
+func TestClientCredentials_Certificate(t *testing.T) {
+	file, leaf := writeCertificate(t)
+	cert, err := LoadCertificate(file, "")
+	if err != nil {
+		t.Fatalf("LoadCertificate() error = %v", err)
+	}
+
+	var endpoint string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_secret") != "" || r.Form.Get("client_assertion_type") != assertionType {
+			t.Errorf("token request form = %v", r.Form)
+		}
+		token, err := jwt.Parse(r.Form.Get("client_assertion"), func(*jwt.Token) (interface{}, error) {
+			return leaf.PublicKey, nil
+		})
+		if err != nil {
+			t.Fatalf("client assertion error = %v", err)
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if claims["aud"] != endpoint || claims["iss"] != "app" || claims["sub"] != "app" || claims["jti"] == "" {
+			t.Errorf("client assertion claims = %v", claims)
+		}
+		sum := sha1.Sum(leaf.Raw)
+		if token.Header["x5t"] != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			t.Errorf("client assertion x5t = %v", token.Header["x5t"])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+	}))
+	defer server.Close()
+	endpoint = server.URL + "/tenant/oauth2/v2.0/token"
+
+	c := &ClientCredentials{TenantID: "tenant", ClientID: "app", ClientSecret: "unused", Certificate: cert, Authority: server.URL}
+	got, err := c.Token(context.Background())
+	if err != nil || got != "token" {
+		t.Errorf("Token() = %q, %v", got, err)
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	file, _ := writeCertificate(t)
+	other, _ := writeCertificate(t)
+	if _, err := LoadCertificate(file, other); err == nil {
+		t.Error("LoadCertificate() with the key of another certificate succeeded")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0o600)
+	if _, err := LoadCertificate(empty, file); err == nil {
+		t.Error("LoadCertificate() without a certificate succeeded")
+	}
+}
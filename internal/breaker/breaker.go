@@ -0,0 +1,201 @@
+// Package breaker implements a circuit breaker.
+//
+// A closed breaker lets calls through and counts their outcome in windows.
+// When enough calls of a window failed it opens and refuses calls for the
+// cool-down. Then it is half-open: a few probe calls are let through, and
+// it closes when they succeed or opens again when one fails.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// States of a breaker.
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half-open"
+)
+
+// ErrOpen is returned by Allow while the breaker refuses calls.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Settings tune a breaker. Zero values use the defaults.
+type Settings struct {
+	FailureRatio float64       // Share of failed calls opening the breaker, default 0.5
+	MinRequests  int           // Calls of a window before it is judged, default 5
+	Window       time.Duration // Length of a counting window, default 1m
+	CoolDown     time.Duration // Time the breaker stays open, default 30s
+	Probes       int           // Calls let through while half-open, default 1
+}
+
+func (s Settings) withDefaults() Settings {
+	if s.FailureRatio <= 0 {
+		s.FailureRatio = 0.5
+	}
+	if s.MinRequests <= 0 {
+		s.MinRequests = 5
+	}
+	if s.Window <= 0 {
+		s.Window = time.Minute
+	}
+	if s.CoolDown <= 0 {
+		s.CoolDown = 30 * time.Second
+	}
+	if s.Probes <= 0 {
+		s.Probes = 1
+	}
+	return s
+}
+
+// Status describes a breaker.
+type Status struct {
+	State     string    `json:"state"`
+	Requests  int       `json:"requests"` // Calls of the current window
+	Failures  int       `json:"failures"`
+	OpenedAt  time.Time `json:"openedAt,omitempty"`
+	ChangedAt time.Time `json:"changedAt,omitempty"`
+}
+
+// Breaker is safe for concurrent use.
+type Breaker struct {
+	now      func() time.Time
+	onChange func(from, to string)
+
+	mu          sync.Mutex
+	settings    Settings
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int    // Probe calls in flight while half-open
+	generation  uint64 // Counts the half-open periods
+	openedAt    time.Time
+	changedAt   time.Time
+}
+
+// New returns a closed breaker. onChange, when not nil, is called on every
+// state change while the breaker is locked, so it must not call back.
+func New(settings Settings, onChange func(from, to string)) *Breaker {
+	b := &Breaker{now: time.Now, onChange: onChange, settings: settings.withDefaults(), state: Closed}
+	b.windowStart = b.now()
+	return b
+}
+
+// Configure replaces the settings, keeping the state.
+func (b *Breaker) Configure(settings Settings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settings = settings.withDefaults()
+}
+
+// Allow reports whether a call may go ahead. Every allowed call must be
+// followed by Done or Cancel with the returned generation, which tells the
+// probes of the current half-open period from calls allowed before.
+func (b *Breaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch b.state {
+	case Open:
+		if now.Sub(b.openedAt) < b.settings.CoolDown {
+			return 0, ErrOpen
+		}
+		b.probes = 0
+		b.generation++
+		b.setState(HalfOpen, now)
+		fallthrough
+	case HalfOpen:
+		if b.probes >= b.settings.Probes {
+			return 0, ErrOpen
+		}
+		b.probes++
+	default:
+		if now.Sub(b.windowStart) >= b.settings.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+	}
+	return b.generation, nil
+}
+
+// Done records the outcome of an allowed call. While half-open, calls of an
+// earlier period are ignored.
+func (b *Breaker) Done(generation uint64, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch b.state {
+	case HalfOpen:
+		if generation != b.generation {
+			return
+		}
+		b.probes--
+		if !success {
+			b.openedAt = now
+			b.setState(Open, now)
+		} else if b.probes == 0 {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+			b.setState(Closed, now)
+		}
+	case Closed:
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= b.settings.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.settings.FailureRatio {
+			b.openedAt = now
+			b.setState(Open, now)
+		}
+	}
+}
+
+// Cancel ends an allowed call without an outcome, e.g. when it was not made.
+func (b *Breaker) Cancel(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen && generation == b.generation && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Reset closes the breaker.
+func (b *Breaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.windowStart, b.requests, b.failures, b.probes = now, 0, 0, 0
+	b.setState(Closed, now)
+}
+
+// Status returns the current state. An open breaker past its cool-down is
+// reported half-open.
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	if state == Open && b.now().Sub(b.openedAt) >= b.settings.CoolDown {
+		state = HalfOpen
+	}
+	return Status{
+		State:     state,
+		Requests:  b.requests,
+		Failures:  b.failures,
+		OpenedAt:  b.openedAt,
+		ChangedAt: b.changedAt,
+	}
+}
+
+func (b *Breaker) setState(state string, now time.Time) {
+	if state == b.state {
+		return
+	}
+	from := b.state
+	b.state = state
+	b.changedAt = now
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
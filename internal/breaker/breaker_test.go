@@ -0,0 +1,132 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	var changes []string
+	b := New(Settings{FailureRatio: 0.5, MinRequests: 4, CoolDown: time.Minute}, func(from, to string) {
+		changes = append(changes, from+">"+to)
+	})
+	b.now = func() time.Time { return now }
+	b.windowStart = now
+
+	call := func(success bool) error {
+		generation, err := b.Allow()
+		if err != nil {
+			return err
+		}
+		b.Done(generation, success)
+		return nil
+	}
+
+	// Below the minimum number of calls the breaker stays closed
+	for _, success := range []bool{false, false, true} {
+		if err := call(success); err != nil {
+			t.Fatalf("Allow() error = %v while closed", err)
+		}
+	}
+	if got := b.Status().State; got != Closed {
+		t.Fatalf("Status() = %s after 3 calls, want closed", got)
+	}
+
+	// Half of four calls failed
+	call(true)
+	if got := b.Status().State; got != Open {
+		t.Fatalf("Status() = %s, want open", got)
+	}
+	if err := call(true); err != ErrOpen {
+		t.Errorf("Allow() error = %v while open, want ErrOpen", err)
+	}
+
+	// After the cool-down one probe is let through; it fails
+	now = now.Add(time.Minute)
+	if got := b.Status().State; got != HalfOpen {
+		t.Errorf("Status() = %s after the cool-down, want half-open", got)
+	}
+	generation, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() probe error = %v", err)
+	}
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow() second probe error = %v, want ErrOpen", err)
+	}
+	b.Done(generation, false)
+	if got := b.Status().State; got != Open {
+		t.Fatalf("Status() = %s after a failed probe, want open", got)
+	}
+
+	// A successful probe closes the breaker
+	now = now.Add(time.Minute)
+	if err := call(true); err != nil {
+		t.Fatalf("Allow() probe error = %v", err)
+	}
+	if got := b.Status(); got.State != Closed || got.Requests != 0 {
+		t.Errorf("Status() = %+v after a successful probe, want closed and reset", got)
+	}
+
+	want := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if len(changes) != len(want) {
+		t.Fatalf("state changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("state change %d = %s, want %s", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestBreaker_Probes(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := New(Settings{MinRequests: 1, CoolDown: time.Minute, Probes: 2}, nil)
+	b.now = func() time.Time { return now }
+	b.windowStart = now
+
+	generation, _ := b.Allow()
+	b.Done(generation, false)
+	if got := b.Status().State; got != Open {
+		t.Fatalf("Status() = %s, want open", got)
+	}
+
+	// Two probes, the first fails while the second is in flight
+	now = now.Add(time.Minute)
+	first, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() first probe error = %v", err)
+	}
+	second, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() second probe error = %v", err)
+	}
+	b.Done(first, false)
+	if got := b.Status().State; got != Open {
+		t.Fatalf("Status() = %s after a failed probe, want open", got)
+	}
+
+	// The late probe of the last period neither counts nor takes a slot
+	now = now.Add(time.Minute)
+	probes := []uint64{}
+	for i := 0; i < 2; i++ {
+		generation, err := b.Allow()
+		if err != nil {
+			t.Fatalf("Allow() probe %d error = %v", i+1, err)
+		}
+		probes = append(probes, generation)
+	}
+	b.Done(second, true)
+	b.Cancel(second)
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow() third probe error = %v, want ErrOpen", err)
+	}
+	b.Done(probes[0], true)
+	if got := b.Status().State; got != HalfOpen {
+		t.Errorf("Status() = %s with a probe in flight, want half-open", got)
+	}
+	b.Done(probes[1], true)
+	if got := b.Status().State; got != Closed {
+		t.Errorf("Status() = %s after the probes succeeded, want closed", got)
+	}
+}
@@ -0,0 +1,391 @@
+// Package bus decouples receiving events from delivering them using a NATS
+// JetStream stream.
+//
+// Accepted events are published to the stream on subjects like
+// emit.<source>.<type>. A durable pull consumer, shared by all replicas,
+// feeds the delivery pipeline and acknowledges a message only once its
+// destinations succeeded. Failed messages are redelivered with backoff until
+// MaxDeliver is reached; the server then raises an advisory and the message
+// is copied to the dead letter stream.
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	natsutil "github.com/nexi-intra/koksmat-emit/services/nats"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Headers added to dead letter messages.
+const (
+	HeaderDeadLetterReason     = "Emit-Dlq-Reason"
+	HeaderDeadLetterDeliveries = "Emit-Dlq-Deliveries"
+	HeaderDeadLetterStreamSeq  = "Emit-Dlq-Stream-Seq"
+)
+
+// Config describes the streams and the consumer.
+type Config struct {
+	Stream        string
+	SubjectPrefix string // Events are published on <prefix>.<source>.<type>
+	Retention     nats.RetentionPolicy
+	Replicas      int
+	MaxAge        time.Duration
+	Consumer      string
+	AckWait       time.Duration
+	MaxDeliver    int
+	Backoff       []time.Duration
+	FetchBatch    int
+	Concurrency   int
+	DLQStream     string
+	DLQPrefix     string
+	Receipts      string // Key-value bucket of the destinations which received an event
+}
+
+// ConfigFromViper reads the BUS_* settings.
+func ConfigFromViper() (Config, error) {
+	viper.SetDefault("BUS_STREAM", "EMIT")
+	viper.SetDefault("BUS_SUBJECT_PREFIX", "emit")
+	viper.SetDefault("BUS_RETENTION", "limits")
+	viper.SetDefault("BUS_REPLICAS", 1)
+	viper.SetDefault("BUS_MAX_AGE", "168h")
+	viper.SetDefault("BUS_CONSUMER", "emit-delivery")
+	viper.SetDefault("BUS_ACK_WAIT", "60s")
+	viper.SetDefault("BUS_MAX_DELIVER", 5)
+	viper.SetDefault("BUS_BACKOFF", "10s,1m,5m,15m")
+	viper.SetDefault("BUS_FETCH_BATCH", 10)
+	viper.SetDefault("BUS_CONCURRENCY", 2)
+	viper.SetDefault("BUS_DLQ_STREAM", "EMIT_DLQ")
+	viper.SetDefault("BUS_DLQ_SUBJECT_PREFIX", "emit-dlq")
+	viper.SetDefault("BUS_RECEIPTS_BUCKET", "emit-receipts")
+
+	cfg := Config{
+		Stream:        viper.GetString("BUS_STREAM"),
+		SubjectPrefix: viper.GetString("BUS_SUBJECT_PREFIX"),
+		Replicas:      viper.GetInt("BUS_REPLICAS"),
+		MaxAge:        viper.GetDuration("BUS_MAX_AGE"),
+		Consumer:      viper.GetString("BUS_CONSUMER"),
+		AckWait:       viper.GetDuration("BUS_ACK_WAIT"),
+		MaxDeliver:    viper.GetInt("BUS_MAX_DELIVER"),
+		FetchBatch:    viper.GetInt("BUS_FETCH_BATCH"),
+		Concurrency:   viper.GetInt("BUS_CONCURRENCY"),
+		DLQStream:     viper.GetString("BUS_DLQ_STREAM"),
+		DLQPrefix:     viper.GetString("BUS_DLQ_SUBJECT_PREFIX"),
+		Receipts:      viper.GetString("BUS_RECEIPTS_BUCKET"),
+	}
+
+	switch strings.ToLower(viper.GetString("BUS_RETENTION")) {
+	case "limits":
+		cfg.Retention = nats.LimitsPolicy
+	case "workqueue":
+		cfg.Retention = nats.WorkQueuePolicy
+	case "interest":
+		cfg.Retention = nats.InterestPolicy
+	default:
+		return cfg, fmt.Errorf("BUS_RETENTION must be limits, workqueue or interest")
+	}
+
+	if cfg.MaxDeliver < 1 {
+		return cfg, fmt.Errorf("BUS_MAX_DELIVER must be at least 1")
+	}
+	for _, s := range strings.Split(viper.GetString("BUS_BACKOFF"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return cfg, fmt.Errorf("BUS_BACKOFF: %w", err)
+		}
+		cfg.Backoff = append(cfg.Backoff, d)
+	}
+	if len(cfg.Backoff) >= cfg.MaxDeliver {
+		// The server rejects more backoff steps than deliveries
+		cfg.Backoff = cfg.Backoff[:cfg.MaxDeliver-1]
+	}
+	return cfg, nil
+}
+
+// Handler processes an event taken from the stream. Returning an error
+// leads to a redelivery.
+type Handler func(ctx context.Context, ev events.Event) error
+
+// Bus publishes to and consumes from the event stream.
+type Bus struct {
+	client   *natsutil.NATSClient
+	js       nats.JetStreamContext
+	cfg      Config
+	obs      *observability.Observability
+	receipts *receipts
+}
+
+// New connects to JetStream and creates or updates the streams and the
+// consumer.
+func New(obs *observability.Observability, client *natsutil.NATSClient, cfg Config) (*Bus, error) {
+	js, err := client.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	b := &Bus{client: client, js: js, cfg: cfg, obs: obs}
+
+	if err := b.ensureStream(&nats.StreamConfig{
+		Name:      cfg.Stream,
+		Subjects:  []string{cfg.SubjectPrefix + ".>"},
+		Retention: cfg.Retention,
+		Replicas:  cfg.Replicas,
+		MaxAge:    cfg.MaxAge,
+		Storage:   nats.FileStorage,
+	}); err != nil {
+		return nil, err
+	}
+	if err := b.ensureStream(&nats.StreamConfig{
+		Name:     cfg.DLQStream,
+		Subjects: []string{cfg.DLQPrefix + ".>"},
+		Replicas: cfg.Replicas,
+		MaxAge:   cfg.MaxAge,
+		Storage:  nats.FileStorage,
+	}); err != nil {
+		return nil, err
+	}
+
+	consumer := &nats.ConsumerConfig{
+		Durable:       cfg.Consumer,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    cfg.MaxDeliver,
+		BackOff:       cfg.Backoff,
+		FilterSubject: cfg.SubjectPrefix + ".>",
+		DeliverPolicy: nats.DeliverAllPolicy,
+	}
+	if _, err := js.ConsumerInfo(cfg.Stream, cfg.Consumer); errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = js.AddConsumer(cfg.Stream, consumer)
+		if err != nil {
+			return nil, fmt.Errorf("creating consumer %s: %w", cfg.Consumer, err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else if _, err := js.UpdateConsumer(cfg.Stream, consumer); err != nil {
+		obs.Warning("Unable to update consumer", zap.String("consumer", cfg.Consumer), zap.Error(err))
+	}
+
+	if b.receipts, err = newReceipts(js, cfg.Receipts, cfg.Replicas, cfg.MaxAge); err != nil {
+		return nil, fmt.Errorf("creating key-value bucket %s: %w", cfg.Receipts, err)
+	}
+	return b, nil
+}
+
+func (b *Bus) ensureStream(cfg *nats.StreamConfig) error {
+	_, err := b.js.StreamInfo(cfg.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		if _, err := b.js.AddStream(cfg); err != nil {
+			return fmt.Errorf("creating stream %s: %w", cfg.Name, err)
+		}
+		b.obs.Info("Created stream", zap.String("stream", cfg.Name))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := b.js.UpdateStream(cfg); err != nil {
+		// Some settings, like the retention policy, cannot be changed
+		b.obs.Warning("Unable to update stream", zap.String("stream", cfg.Name), zap.Error(err))
+	}
+	return nil
+}
+
+// Subject returns the subject an event is published on.
+func (b *Bus) Subject(ev events.Event) string {
+	return ExpandSubject(b.cfg.SubjectPrefix+".{source}.{type}", ev)
+}
+
+// Publish stores the event in the stream. The idempotency key is used as
+// message ID, so the server drops retries within its duplicate window.
+func (b *Bus) Publish(ev events.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(b.Subject(ev))
+	msg.Data = data
+	msg.Header.Set(nats.MsgIdHdr, ev.Key())
+	_, err = b.js.PublishMsg(msg)
+	return err
+}
+
+// Consume runs the pull consumer until ctx is done.
+func (b *Bus) Consume(ctx context.Context, handler Handler) error {
+	sub, err := b.js.PullSubscribe(b.cfg.SubjectPrefix+".>", b.cfg.Consumer,
+		nats.Bind(b.cfg.Stream, b.cfg.Consumer), nats.ManualAck())
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	concurrency := b.cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	done := make(chan struct{})
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			b.fetchLoop(ctx, sub, handler)
+		}()
+	}
+	for i := 0; i < concurrency; i++ {
+		<-done
+	}
+	return nil
+}
+
+func (b *Bus) fetchLoop(ctx context.Context, sub *nats.Subscription, handler Handler) {
+	for ctx.Err() == nil {
+		fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		msgs, err := sub.Fetch(b.cfg.FetchBatch, nats.Context(fetchCtx))
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, nats.ErrTimeout) {
+			if ctx.Err() == nil {
+				b.obs.Warning("Fetching from stream failed", zap.Error(err))
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			b.handle(ctx, msg, handler)
+		}
+	}
+}
+
+func (b *Bus) handle(ctx context.Context, msg *nats.Msg, handler Handler) {
+	var ev events.Event
+	if err := json.Unmarshal(msg.Data, &ev); err != nil {
+		b.obs.Error("Dropping undecodable message", zap.String("subject", msg.Subject), zap.Error(err))
+		msg.Term()
+		return
+	}
+
+	if err := handler(ctx, ev); err != nil {
+		delay := b.backoff(msg)
+		b.obs.Warning("Delivery failed, will retry",
+			zap.String("id", ev.ID), zap.Duration("delay", delay), zap.Error(err))
+		msg.NakWithDelay(delay)
+		return
+	}
+	if err := msg.AckSync(); err != nil {
+		b.obs.Warning("Ack failed", zap.String("id", ev.ID), zap.Error(err))
+	}
+}
+
+// backoff picks the delay before the next delivery of a failed message.
+func (b *Bus) backoff(msg *nats.Msg) time.Duration {
+	if len(b.cfg.Backoff) == 0 {
+		return 0
+	}
+	n := 1
+	if meta, err := msg.Metadata(); err == nil {
+		n = int(meta.NumDelivered)
+	}
+	if n > len(b.cfg.Backoff) {
+		n = len(b.cfg.Backoff)
+	}
+	return b.cfg.Backoff[n-1]
+}
+
+// maxDeliveriesAdvisory is the part of the server advisory we need.
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries uint64 `json:"deliveries"`
+}
+
+// DeadLetters copies messages that exhausted their deliveries to the dead
+// letter stream until ctx is done. The advisories are shared through a queue
+// group, so only one replica copies each message.
+func (b *Bus) DeadLetters(ctx context.Context) error {
+	subject := fmt.Sprintf("$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s", b.cfg.Stream, b.cfg.Consumer)
+	sub, err := b.client.QueueSubscribe(subject, b.cfg.Consumer+"-dlq", func(m *nats.Msg) {
+		var adv maxDeliveriesAdvisory
+		if err := json.Unmarshal(m.Data, &adv); err != nil {
+			b.obs.Warning("Invalid advisory", zap.Error(err))
+			return
+		}
+		if err := b.deadLetter(adv); err != nil {
+			b.obs.Error("Failed to dead letter message",
+				zap.Uint64("stream_seq", adv.StreamSeq), zap.Error(err))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return sub.Unsubscribe()
+}
+
+func (b *Bus) deadLetter(adv maxDeliveriesAdvisory) error {
+	raw, err := b.js.GetMsg(adv.Stream, adv.StreamSeq)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(b.cfg.DLQPrefix + "." + strings.TrimPrefix(raw.Subject, b.cfg.SubjectPrefix+"."))
+	msg.Data = raw.Data
+	for name, values := range raw.Header {
+		if name != nats.MsgIdHdr {
+			msg.Header[name] = values
+		}
+	}
+	msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%d", adv.Stream, adv.StreamSeq))
+	msg.Header.Set(HeaderDeadLetterReason, "max deliveries")
+	msg.Header.Set(HeaderDeadLetterDeliveries, fmt.Sprint(adv.Deliveries))
+	msg.Header.Set(HeaderDeadLetterStreamSeq, fmt.Sprint(adv.StreamSeq))
+	if _, err := b.js.PublishMsg(msg); err != nil {
+		return err
+	}
+	b.obs.Warning("Message moved to dead letter stream",
+		zap.String("subject", raw.Subject), zap.Uint64("stream_seq", adv.StreamSeq))
+	return nil
+}
+
+// ExpandSubject fills the {source}, {type}, {tenant} and {subject}
+// placeholders of template with the fields of the event. The type may span
+// several tokens, the others are always one token.
+func ExpandSubject(template string, ev events.Event) string {
+	return strings.NewReplacer(
+		"{source}", SubjectToken(ev.Source),
+		"{type}", SubjectTokens(ev.Type),
+		"{tenant}", SubjectToken(ev.Tenant),
+		"{subject}", SubjectToken(ev.Subject),
+	).Replace(template)
+}
+
+// SubjectToken makes s usable as a single subject token.
+func SubjectToken(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// SubjectTokens makes s usable as one or more subject tokens, keeping the
+// dots of e.g. "pull_request.closed" as separators.
+func SubjectTokens(s string) string {
+	parts := strings.Split(s, ".")
+	for i, p := range parts {
+		parts[i] = SubjectToken(p)
+	}
+	return strings.Join(parts, ".")
+}
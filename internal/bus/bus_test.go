@@ -0,0 +1,105 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/spf13/viper"
+)
+
+func TestBus_Subject(t *testing.T) {
+	b := &Bus{cfg: Config{SubjectPrefix: "emit"}}
+	tests := []struct {
+		name   string
+		source string
+		typ    string
+		want   string
+	}{
+		{"Dotted type", "github", "pull_request.closed", "emit.github.pull_request.closed"},
+		{"Empty type", "erp", "", "emit.erp.unknown"},
+		{"Reserved characters", "my source", "a.*.>", "emit.my_source.a._._"},
+		{"Empty token in type", "x", "a..b", "emit.x.a.unknown.b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := events.Event{Source: tt.source, Type: tt.typ}
+			if got := b.Subject(ev); got != tt.want {
+				t.Errorf("Subject() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFromViper(t *testing.T) {
+	tests := []struct {
+		name        string
+		settings    map[string]any
+		wantBackoff []time.Duration
+		wantErr     bool
+	}{
+		{
+			name:        "Defaults",
+			wantBackoff: []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 15 * time.Minute},
+		},
+		{
+			name:        "Backoff limited by max deliveries",
+			settings:    map[string]any{"BUS_MAX_DELIVER": 2, "BUS_BACKOFF": "1s,2s,3s"},
+			wantBackoff: []time.Duration{time.Second},
+		},
+		{
+			name:     "Unknown retention",
+			settings: map[string]any{"BUS_RETENTION": "forever"},
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid backoff",
+			settings: map[string]any{"BUS_BACKOFF": "soon"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			defer viper.Reset()
+			for k, v := range tt.settings {
+				viper.Set(k, v)
+			}
+			cfg, err := ConfigFromViper()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigFromViper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(cfg.Backoff) != len(tt.wantBackoff) {
+				t.Fatalf("ConfigFromViper() backoff = %v, want %v", cfg.Backoff, tt.wantBackoff)
+			}
+			for i := range cfg.Backoff {
+				if cfg.Backoff[i] != tt.wantBackoff[i] {
+					t.Errorf("ConfigFromViper() backoff = %v, want %v", cfg.Backoff, tt.wantBackoff)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandSubject(t *testing.T) {
+	ev := events.Event{Source: "microsoftgraph", Type: "updated", Tenant: "contoso.com", Subject: "nexi-intra/koksmat-emit"}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"All placeholders", "koksmat.emit.{source}.{tenant}.{type}.{subject}", "koksmat.emit.microsoftgraph.contoso_com.updated.nexi-intra/koksmat-emit"},
+		{"Fixed tokens", "koksmat.emit.graph.{tenant}.{type}", "koksmat.emit.graph.contoso_com.updated"},
+		{"No placeholders", "audit", "audit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExpandSubject(tt.template, ev); got != tt.want {
+				t.Errorf("ExpandSubject() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
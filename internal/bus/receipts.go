@@ -0,0 +1,57 @@
+package bus
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// receipts remembers the destinations which received an event in a NATS
+// key-value bucket, so a message redelivered to another replica skips them.
+// Entries expire with the messages of the stream.
+type receipts struct {
+	kv nats.KeyValue
+}
+
+func newReceipts(js nats.JetStreamContext, bucket string, replicas int, ttl time.Duration) (*receipts, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "Destinations which received the events of the koksmat-emit stream",
+			History:     1,
+			TTL:         ttl,
+			Replicas:    replicas,
+			Storage:     nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &receipts{kv: kv}, nil
+}
+
+// receiptKey encodes the event ID and destination, which may contain
+// characters not allowed in keys.
+func receiptKey(eventID, destination string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(eventID)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(destination))
+}
+
+// Delivered reports whether the destination received the event, through
+// any replica.
+func (b *Bus) Delivered(eventID, destination string) (bool, error) {
+	_, err := b.receipts.kv.Get(receiptKey(eventID, destination))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RecordDelivery remembers that the destination received the event.
+func (b *Bus) RecordDelivery(eventID, destination string) error {
+	_, err := b.receipts.kv.Put(receiptKey(eventID, destination), []byte(time.Now().UTC().Format(time.RFC3339)))
+	return err
+}
@@ -0,0 +1,426 @@
+// Package cloudevents maps the normalized events to CloudEvents 1.0
+// envelopes and encodes them in the structured and binary content modes.
+//
+// In structured mode the envelope is the message body. In binary mode the
+// body is the data and the attributes are carried in ce- prefixed headers,
+// which the HTTP and NATS protocol bindings share.
+package cloudevents
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+const (
+	SpecVersion = "1.0"
+
+	ContentTypeJSON       = "application/json"
+	ContentTypeStructured = "application/cloudevents+json"
+	ContentTypeBatch      = "application/cloudevents-batch+json"
+
+	headerPrefix = "ce-"
+)
+
+// Content modes.
+const (
+	ModeStructured = "structured"
+	ModeBinary     = "binary"
+)
+
+// Event is a CloudEvents 1.0 envelope with JSON data.
+type Event struct {
+	SpecVersion     string
+	ID              string
+	Source          string // URI reference
+	Type            string
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	DataSchema      string
+	Data            json.RawMessage
+	Extensions      map[string]string // Lowercase alphanumeric names
+}
+
+// Options control how events are mapped to envelopes.
+type Options struct {
+	SourcePrefix string // Prepended to the event source, default "/koksmat-emit"
+	TypePrefix   string // Prepended to "<source>.<type>", default "com.koksmat.emit."
+}
+
+// FromEvent wraps a normalized event. The tenant, tags, correlation ID and
+// the details of coalesced events become extensions.
+//
+// Events received as CloudEvents keep the ID, source, type and extensions
+// of the sender; the extensions of the emitter are only added where the
+// sender did not set them. Coalesced and delayed copies have their own ID.
+func FromEvent(ev events.Event, opts Options) Event {
+	if opts.SourcePrefix == "" {
+		opts.SourcePrefix = "/koksmat-emit"
+	}
+	if opts.TypePrefix == "" {
+		opts.TypePrefix = "com.koksmat.emit."
+	}
+	ce := Event{
+		SpecVersion:     SpecVersion,
+		ID:              ev.ID,
+		Source:          strings.TrimSuffix(opts.SourcePrefix, "/") + "/" + ev.Source,
+		Type:            opts.TypePrefix + ev.Source,
+		Subject:         ev.Subject,
+		Time:            ev.Time,
+		DataContentType: ContentTypeJSON,
+		Data:            ev.Payload,
+		Extensions:      map[string]string{},
+	}
+	if ev.Type != "" {
+		ce.Type += "." + ev.Type
+	}
+	if ev.Tenant != "" {
+		ce.Extensions["tenant"] = ev.Tenant
+	}
+	if len(ev.Tags) > 0 {
+		ce.Extensions["tags"] = strings.Join(ev.Tags, ",")
+	}
+	if ev.CorrelationID != "" {
+		ce.Extensions["correlationid"] = ev.CorrelationID
+	}
+	if c := ev.Coalesced; c != nil {
+		ce.Extensions["coalescedcount"] = strconv.Itoa(c.Count)
+		ce.Extensions["coalescedfirst"] = c.First.Format(time.RFC3339Nano)
+		ce.Extensions["coalescedlast"] = c.Last.Format(time.RFC3339Nano)
+	}
+	if d := ev.Delayed; d != nil {
+		ce.Extensions["delayedevent"] = d.EventID
+		ce.Extensions["delayeddue"] = d.Due.Format(time.RFC3339Nano)
+	}
+	if e := ev.Envelope; e != nil {
+		if ev.Coalesced == nil && ev.Delayed == nil {
+			ce.ID = e.ID
+		}
+		ce.Source = e.Source
+		ce.Type = e.Type
+		ce.DataContentType = e.DataContentType
+		ce.DataSchema = e.DataSchema
+		for name, value := range e.Extensions {
+			ce.Extensions[name] = value
+		}
+		// ToEvent stands in null for missing data
+		if string(ev.Payload) == "null" {
+			ce.Data = nil
+		}
+	}
+	return ce
+}
+
+// MarshalJSON encodes the envelope in the JSON event format, with the
+// extensions as top level attributes.
+func (e Event) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(e.Extensions)+9)
+	for name, value := range e.Extensions {
+		m[name] = value
+	}
+	for name, value := range e.attributes() {
+		m[name] = value
+	}
+	if len(e.Data) > 0 {
+		m["data"] = e.Data
+	}
+	return json.Marshal(m)
+}
+
+// Structured returns the body and content type of the structured mode.
+func (e Event) Structured() ([]byte, string, error) {
+	data, err := json.Marshal(e)
+	return data, ContentTypeStructured, err
+}
+
+// Binary returns the body and headers of the binary mode. The headers
+// include Content-Type.
+func (e Event) Binary() ([]byte, map[string]string) {
+	headers := map[string]string{}
+	for name, value := range e.attributes() {
+		if name == "datacontenttype" {
+			headers["Content-Type"] = value
+			continue
+		}
+		headers[headerPrefix+name] = encodeHeaderValue(value)
+	}
+	for name, value := range e.Extensions {
+		headers[headerPrefix+name] = encodeHeaderValue(value)
+	}
+	return e.Data, headers
+}
+
+// attributes returns the context attributes which are set, by name.
+func (e Event) attributes() map[string]string {
+	attrs := map[string]string{
+		"specversion": e.SpecVersion,
+		"id":          e.ID,
+		"source":      e.Source,
+		"type":        e.Type,
+	}
+	if e.Subject != "" {
+		attrs["subject"] = e.Subject
+	}
+	if !e.Time.IsZero() {
+		attrs["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	if e.DataContentType != "" {
+		attrs["datacontenttype"] = e.DataContentType
+	}
+	if e.DataSchema != "" {
+		attrs["dataschema"] = e.DataSchema
+	}
+	return attrs
+}
+
+// ValidMode returns an error unless mode is structured or binary.
+func ValidMode(mode string) error {
+	if mode != ModeStructured && mode != ModeBinary {
+		return fmt.Errorf("mode must be %s or %s", ModeStructured, ModeBinary)
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes the JSON event format. Attributes which are not
+// context attributes are kept as extensions. Data given as data_base64 must
+// hold JSON.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*e = Event{Extensions: map[string]string{}}
+	for name, raw := range fields {
+		switch name {
+		case "data":
+			e.Data = raw
+			continue
+		case "data_base64":
+			var encoded string
+			if err := json.Unmarshal(raw, &encoded); err != nil {
+				return fmt.Errorf("data_base64: %w", err)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return fmt.Errorf("data_base64: %w", err)
+			}
+			e.Data = decoded
+			continue
+		}
+
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			// Extensions may be numbers or booleans
+			value = string(raw)
+		}
+		if err := e.setAttribute(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Event) setAttribute(name, value string) error {
+	switch name {
+	case "specversion":
+		e.SpecVersion = value
+	case "id":
+		e.ID = value
+	case "source":
+		e.Source = value
+	case "type":
+		e.Type = value
+	case "subject":
+		e.Subject = value
+	case "datacontenttype":
+		e.DataContentType = value
+	case "dataschema":
+		e.DataSchema = value
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("time: %w", err)
+		}
+		e.Time = t
+	default:
+		if e.Extensions == nil {
+			e.Extensions = map[string]string{}
+		}
+		e.Extensions[name] = value
+	}
+	return nil
+}
+
+// Validate checks the required attributes and that the data is JSON.
+func (e Event) Validate() error {
+	var errs []error
+	if e.SpecVersion != SpecVersion {
+		errs = append(errs, fmt.Errorf("specversion must be %s", SpecVersion))
+	}
+	for name, value := range map[string]string{"id": e.ID, "source": e.Source, "type": e.Type} {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	for name := range e.Extensions {
+		if !validName(name) {
+			errs = append(errs, fmt.Errorf("invalid attribute name %q", name))
+		}
+	}
+	if len(e.Data) > 0 && !isJSON(e.DataContentType) {
+		errs = append(errs, fmt.Errorf("datacontenttype %s is not supported, data must be JSON", e.DataContentType))
+	} else if len(e.Data) > 0 && !json.Valid(e.Data) {
+		errs = append(errs, errors.New("data is not valid JSON"))
+	}
+	return errors.Join(errs...)
+}
+
+// ToEvent returns the normalized event. The CloudEvents source and type are
+// kept as they are, the tenant extension becomes the tenant. Source and ID
+// identify retries by the sender. The attributes are kept in the envelope
+// of the event, see FromEvent.
+func (e Event) ToEvent() events.Event {
+	ev := events.New(e.Source, e.Type, e.Data)
+	if len(ev.Payload) == 0 {
+		ev.Payload = json.RawMessage("null")
+	}
+	ev.Subject = e.Subject
+	ev.Tenant = e.Extensions["tenant"]
+	ev.CorrelationID = e.Extensions["correlationid"]
+	if !e.Time.IsZero() {
+		ev.Time = e.Time.UTC()
+	}
+	ev.IdempotencyKey = "cloudevents:" + e.Source + "|" + e.ID
+	ev.Envelope = &events.Envelope{
+		ID:              e.ID,
+		Source:          e.Source,
+		Type:            e.Type,
+		DataContentType: e.DataContentType,
+		DataSchema:      e.DataSchema,
+	}
+	if len(e.Extensions) > 0 {
+		ev.Envelope.Extensions = make(map[string]string, len(e.Extensions))
+		for name, value := range e.Extensions {
+			ev.Envelope.Extensions[name] = value
+		}
+	}
+	return ev
+}
+
+// MaxBodySize limits the requests read by FromHTTPRequest.
+const MaxBodySize = 4 << 20
+
+// FromHTTPRequest decodes the events of a request in structured, batch or
+// binary mode. The events are not validated.
+func FromHTTPRequest(r *http.Request) ([]Event, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxBodySize {
+		return nil, fmt.Errorf("request body exceeds %d bytes", MaxBodySize)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == ContentTypeStructured:
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, err
+		}
+		return []Event{e}, nil
+	case mediaType == ContentTypeBatch:
+		var batch []Event
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		return batch, nil
+	case r.Header.Get(headerPrefix+"specversion") != "":
+		e := Event{Extensions: map[string]string{}, DataContentType: r.Header.Get("Content-Type")}
+		for name, values := range r.Header {
+			name = strings.ToLower(name)
+			if !strings.HasPrefix(name, headerPrefix) || len(values) == 0 {
+				continue
+			}
+			if err := e.setAttribute(strings.TrimPrefix(name, headerPrefix), decodeHeaderValue(values[0])); err != nil {
+				return nil, err
+			}
+		}
+		if len(body) > 0 {
+			e.Data = body
+		}
+		return []Event{e}, nil
+	default:
+		return nil, errors.New("the request is not a CloudEvent: use a ce-specversion header or a cloudevents content type")
+	}
+}
+
+// isJSON reports whether the content type is JSON. Without a content type
+// the data is assumed to be JSON.
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == ContentTypeJSON || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validName reports whether name is a valid attribute name, lowercase
+// letters and digits.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeHeaderValue percent-encodes the characters the HTTP binding does
+// not allow in header values.
+func encodeHeaderValue(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// decodeHeaderValue reverses encodeHeaderValue. Malformed escapes are kept.
+func decodeHeaderValue(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			if c, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
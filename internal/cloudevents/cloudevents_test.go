@@ -0,0 +1,246 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+func testEvent() events.Event {
+	return events.Event{
+		ID:      "1234",
+		Source:  "github",
+		Type:    "pull_request.closed",
+		Subject: "nexi-intra/koksmat-emit",
+		Tenant:  "nexi",
+		Tags:    []string{"cleanup"},
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Payload: json.RawMessage(`{"number":7}`),
+	}
+}
+
+func TestFromEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		wantSource string
+		wantType   string
+	}{
+		{"Defaults", Options{}, "/koksmat-emit/github", "com.koksmat.emit.github.pull_request.closed"},
+		{"Prefixes", Options{SourcePrefix: "https://emit.example.com/", TypePrefix: "example."}, "https://emit.example.com/github", "example.github.pull_request.closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := FromEvent(testEvent(), tt.opts)
+			if ce.Source != tt.wantSource || ce.Type != tt.wantType {
+				t.Errorf("FromEvent() = %s %s, want %s %s", ce.Source, ce.Type, tt.wantSource, tt.wantType)
+			}
+			if ce.Extensions["tenant"] != "nexi" || ce.Extensions["tags"] != "cleanup" {
+				t.Errorf("FromEvent() extensions = %v", ce.Extensions)
+			}
+		})
+	}
+}
+
+func TestEvent_Structured(t *testing.T) {
+	body, contentType, err := FromEvent(testEvent(), Options{}).Structured()
+	if err != nil {
+		t.Fatalf("Structured() error = %v", err)
+	}
+	if contentType != ContentTypeStructured {
+		t.Errorf("Structured() content type = %s", contentType)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"specversion":     "1.0",
+		"id":              "1234",
+		"subject":         "nexi-intra/koksmat-emit",
+		"time":            "2024-05-01T12:00:00Z",
+		"datacontenttype": "application/json",
+		"tenant":          "nexi",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("Structured() %s = %v, want %s", name, got[name], value)
+		}
+	}
+	if data, _ := got["data"].(map[string]interface{}); data["number"] != 7.0 {
+		t.Errorf("Structured() data = %v", got["data"])
+	}
+}
+
+func TestEvent_Binary(t *testing.T) {
+	body, headers := FromEvent(testEvent(), Options{}).Binary()
+	if string(body) != `{"number":7}` {
+		t.Errorf("Binary() body = %s", body)
+	}
+	want := map[string]string{
+		"ce-specversion": "1.0",
+		"ce-id":          "1234",
+		"ce-type":        "com.koksmat.emit.github.pull_request.closed",
+		"ce-tenant":      "nexi",
+		"Content-Type":   "application/json",
+	}
+	for name, value := range want {
+		if headers[name] != value {
+			t.Errorf("Binary() header %s = %q, want %q", name, headers[name], value)
+		}
+	}
+	if _, ok := headers["ce-datacontenttype"]; ok {
+		t.Errorf("Binary() sent datacontenttype as ce- header")
+	}
+}
+
+func TestFromHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		headers     map[string]string
+		body        string
+		wantIDs     []string
+		wantErr     bool
+		wantInvalid bool
+	}{
+		{
+			name:        "Structured",
+			contentType: "application/cloudevents+json; charset=utf-8",
+			body:        `{"specversion":"1.0","id":"a","source":"/erp","type":"order.created","tenant":"nexi","data":{"order":1}}`,
+			wantIDs:     []string{"a"},
+		},
+		{
+			name:        "Structured with base64 data",
+			contentType: ContentTypeStructured,
+			body:        `{"specversion":"1.0","id":"a","source":"/erp","type":"x","data_base64":"eyJvcmRlciI6MX0="}`,
+			wantIDs:     []string{"a"},
+		},
+		{
+			name:        "Batch",
+			contentType: ContentTypeBatch,
+			body:        `[{"specversion":"1.0","id":"a","source":"/erp","type":"x"},{"specversion":"1.0","id":"b","source":"/erp","type":"x"}]`,
+			wantIDs:     []string{"a", "b"},
+		},
+		{
+			name:        "Binary",
+			contentType: "application/json",
+			headers:     map[string]string{"ce-specversion": "1.0", "ce-id": "a", "ce-source": "/erp", "ce-type": "x", "ce-subject": "order%201"},
+			body:        `{"order":1}`,
+			wantIDs:     []string{"a"},
+		},
+		{
+			name:        "Binary with data which is not JSON",
+			contentType: "text/plain",
+			headers:     map[string]string{"ce-specversion": "1.0", "ce-id": "a", "ce-source": "/erp", "ce-type": "x"},
+			body:        `hello`,
+			wantIDs:     []string{"a"},
+			wantInvalid: true,
+		},
+		{
+			name:        "Missing attributes",
+			contentType: ContentTypeStructured,
+			body:        `{"specversion":"0.3","id":"a"}`,
+			wantIDs:     []string{"a"},
+			wantInvalid: true,
+		},
+		{
+			name:        "Plain JSON",
+			contentType: "application/json",
+			body:        `{"order":1}`,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			got, err := FromHTTPRequest(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromHTTPRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("FromHTTPRequest() returned %d events, want %d", len(got), len(tt.wantIDs))
+			}
+			invalid := false
+			for i, ce := range got {
+				if ce.ID != tt.wantIDs[i] {
+					t.Errorf("FromHTTPRequest() id = %s, want %s", ce.ID, tt.wantIDs[i])
+				}
+				if ce.Validate() != nil {
+					invalid = true
+				}
+			}
+			if invalid != tt.wantInvalid {
+				t.Errorf("Validate() invalid = %v, want %v", invalid, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestEvent_ToEvent(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(`{"order":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("ce-specversion", "1.0")
+	r.Header.Set("ce-id", "a")
+	r.Header.Set("ce-source", "/erp")
+	r.Header.Set("ce-type", "order.created")
+	r.Header.Set("ce-subject", "order%201")
+	r.Header.Set("ce-tenant", "nexi")
+	r.Header.Set("ce-time", "2024-05-01T12:00:00Z")
+	r.Header.Set("ce-partition", "7")
+	got, err := FromHTTPRequest(r)
+	if err != nil {
+		t.Fatalf("FromHTTPRequest() error = %v", err)
+	}
+
+	ev := got[0].ToEvent()
+	if ev.Source != "/erp" || ev.Type != "order.created" || ev.Subject != "order 1" || ev.Tenant != "nexi" {
+		t.Errorf("ToEvent() = %+v", ev)
+	}
+	if ev.IdempotencyKey != "cloudevents:/erp|a" {
+		t.Errorf("ToEvent() key = %s", ev.IdempotencyKey)
+	}
+	if !ev.Time.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) || string(ev.Payload) != `{"order":1}` {
+		t.Errorf("ToEvent() time %v payload %s", ev.Time, ev.Payload)
+	}
+
+	// The binary encoding round trips, with the envelope of the sender
+	ev.Tags = []string{"erp"}
+	body, headers := FromEvent(ev, Options{}).Binary()
+	if headers["ce-subject"] != "order 1" || string(body) != `{"order":1}` {
+		t.Errorf("Binary() subject = %q", headers["ce-subject"])
+	}
+	want := map[string]string{
+		"ce-id":        "a",
+		"ce-source":    "/erp",
+		"ce-type":      "order.created",
+		"ce-tenant":    "nexi",
+		"ce-partition": "7",
+		"ce-tags":      "erp",
+		"Content-Type": "application/json",
+	}
+	for name, value := range want {
+		if headers[name] != value {
+			t.Errorf("Binary() %s = %q, want %q", name, headers[name], value)
+		}
+	}
+
+	// Delayed copies keep the source and type but have their own ID
+	ev.Delayed = &events.Delayed{EventID: ev.ID}
+	ce := FromEvent(ev, Options{})
+	if ce.ID != ev.ID || ce.Source != "/erp" || ce.Type != "order.created" {
+		t.Errorf("FromEvent() = %s %s %s", ce.ID, ce.Source, ce.Type)
+	}
+}
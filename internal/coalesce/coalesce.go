@@ -0,0 +1,150 @@
+// Package coalesce merges bursts of events into one.
+//
+// Events are collected in groups by rule and key. A group is flushed when no
+// event was added for the quiet time of its rule, or at the latest after the
+// maximum wait since its first event. The groups are kept in a hold.State,
+// so a restart does not lose the events held back, and replicas sharing the
+// state add to the same groups and flush each once.
+package coalesce
+
+import (
+	"context"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
+)
+
+// MaxSeen bounds the event IDs a group keeps to recognize events redelivered
+// by the event stream. A redelivered event older than the last MaxSeen events
+// of its burst is counted again.
+const MaxSeen = 256
+
+// Group is a burst of events with the same rule and key.
+type Group struct {
+	ID       string       `json:"id"` // ID of the merged event, the same for every flush attempt
+	Rule     string       `json:"rule"`
+	Key      string       `json:"key"`
+	Event    events.Event `json:"event"` // The last event of the burst
+	Count    int          `json:"count"`
+	First    time.Time    `json:"first"`
+	Last     time.Time    `json:"last"`
+	Due      time.Time    `json:"due"`            // When the group is flushed
+	Deadline time.Time    `json:"deadline"`       // First added plus the maximum wait
+	Seen     []string     `json:"seen,omitempty"` // IDs of the last MaxSeen events
+}
+
+func (g *Group) seen(id string) bool {
+	for _, seen := range g.Seen {
+		if seen == id {
+			return true
+		}
+	}
+	return false
+}
+
+// see records event IDs, dropping the oldest beyond MaxSeen.
+func (g *Group) see(ids ...string) {
+	g.Seen = append(g.Seen, ids...)
+	if len(g.Seen) > MaxSeen {
+		g.Seen = append([]string(nil), g.Seen[len(g.Seen)-MaxSeen:]...)
+	}
+}
+
+// Merged returns the event standing for the group: the last event with the
+// ID of the group and the details of the burst.
+func (g Group) Merged() events.Event {
+	ev := g.Event
+	ev.ID = g.ID
+	ev.Tags = nil
+	ev.IdempotencyKey = "coalesce:" + g.ID
+	ev.Coalesced = &events.Coalesced{
+		Rule:  g.Rule,
+		Key:   g.Key,
+		Count: g.Count,
+		First: g.First,
+		Last:  g.Last,
+	}
+	return ev
+}
+
+// Flusher emits the merged event of a group.
+type Flusher func(ctx context.Context, g Group) error
+
+// Coalescer is safe for concurrent use, also by replicas sharing the state.
+type Coalescer struct {
+	queue *hold.Queue[Group]
+	flush Flusher
+	now   func() time.Time
+}
+
+// New returns a Coalescer keeping its groups in state.
+func New(state hold.State, flush Flusher) *Coalescer {
+	return &Coalescer{queue: hold.New(state, rest), flush: flush, now: time.Now}
+}
+
+// Add adds an event to the group of rule and key, starting the group when
+// needed. The group becomes due after quiet without further events, but no
+// later than maxWait after it was started.
+func (c *Coalescer) Add(rule, key string, quiet, maxWait time.Duration, ev events.Event) (Group, error) {
+	now := c.now()
+	it, err := c.queue.Update(rule+"|"+key, func(it *hold.Item[Group], exists bool) (bool, error) {
+		g := &it.Value
+		if !exists {
+			*g = Group{ID: events.NewID(), Rule: rule, Key: key, First: ev.Time, Deadline: now.Add(maxWait)}
+		} else if g.Event.ID == ev.ID || g.seen(ev.ID) {
+			// Redelivered by the event stream
+			return false, nil
+		}
+		g.Event = ev
+		g.see(ev.ID)
+		g.Count++
+		g.Last = ev.Time
+		g.Due = now.Add(quiet)
+		if g.Due.After(g.Deadline) {
+			g.Due = g.Deadline
+		}
+		it.Due = g.Due
+		return true, nil
+	})
+	return it.Value, err
+}
+
+// rest returns the burst of the events added while a group was flushed,
+// which is merged again under a new ID.
+func rest(flushed, current Group) (Group, bool) {
+	if current.Count <= flushed.Count {
+		return current, false
+	}
+	current.ID = events.NewID()
+	current.Count -= flushed.Count
+	current.First = flushed.Last
+	return current, true
+}
+
+// Pending returns the groups not flushed yet, the next due first.
+func (c *Coalescer) Pending() ([]Group, error) {
+	items, err := c.queue.List()
+	groups := make([]Group, 0, len(items))
+	for _, it := range items {
+		g := it.Value
+		g.Due = it.Next()
+		groups = append(groups, g)
+	}
+	return groups, err
+}
+
+// Flush flushes the due groups. A group whose flush fails is retried after
+// hold.RetryDelay, with the events added meanwhile. The number of flushed
+// groups is returned.
+func (c *Coalescer) Flush(ctx context.Context) (int, error) {
+	return c.queue.Flush(ctx, c.now(), func(ctx context.Context, it hold.Item[Group]) error {
+		return c.flush(ctx, it.Value)
+	})
+}
+
+// Run flushes the due groups every interval until ctx is done. Errors are
+// passed to onError.
+func (c *Coalescer) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	hold.Run(ctx, interval, c.Flush, onError)
+}
@@ -0,0 +1,124 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
+	"github.com/nexi-intra/koksmat-emit/internal/hold/holdtest"
+)
+
+func TestCoalescer_Flush(t *testing.T) {
+	state, reopen := holdtest.State(t)
+	clock := holdtest.NewClock()
+	var flushed holdtest.Recorder[Group]
+	c := New(state, flushed.Flush)
+	c.now = clock.Now
+	ctx := context.Background()
+
+	add := func(payload string) {
+		ev := events.New("microsoftgraph", "updated", []byte(payload))
+		ev.Time = clock.Now()
+		if _, err := c.Add("docs", "drives/1", 10*time.Second, time.Minute, ev); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	// Events keep the group open while they arrive within the quiet time
+	for i := 0; i < 3; i++ {
+		add(fmt.Sprintf(`{"n":%d}`, i+1))
+		clock.Add(5 * time.Second)
+		if n, _ := c.Flush(ctx); n != 0 {
+			t.Fatalf("Flush() flushed %d groups during the burst", n)
+		}
+	}
+	clock.Add(5 * time.Second)
+	if n, err := c.Flush(ctx); n != 1 || err != nil {
+		t.Fatalf("Flush() = %d, %v, want 1 group", n, err)
+	}
+	merged := flushed.Values[0].Merged()
+	c1 := merged.Coalesced
+	if c1 == nil || c1.Count != 3 || string(merged.Payload) != `{"n":3}` {
+		t.Fatalf("Flush() merged event = %+v %s", c1, merged.Payload)
+	}
+	if c1.Last.Sub(c1.First) != 10*time.Second {
+		t.Errorf("Flush() first %s and last %s", c1.First, c1.Last)
+	}
+	if pending, err := c.Pending(); len(pending) != 0 || err != nil {
+		t.Errorf("Pending() after flush = %d groups, %v", len(pending), err)
+	}
+
+	// Events redelivered by the event stream are counted once
+	flushed.Reset()
+	first := events.New("microsoftgraph", "updated", []byte(`{"n":1}`))
+	second := events.New("microsoftgraph", "updated", []byte(`{"n":2}`))
+	for _, ev := range []events.Event{first, second, first, second} {
+		if _, err := c.Add("docs", "drives/1", 10*time.Second, time.Minute, ev); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	clock.Add(10 * time.Second)
+	c.Flush(ctx)
+	if len(flushed.Values) != 1 || flushed.Values[0].Count != 2 || string(flushed.Values[0].Event.Payload) != `{"n":2}` {
+		t.Fatalf("Flush() with redelivered events = %+v", flushed.Values)
+	}
+
+	// A steady stream is flushed after the maximum wait
+	flushed.Reset()
+	for i := 0; i < 15; i++ {
+		add(`{}`)
+		clock.Add(5 * time.Second)
+		c.Flush(ctx)
+	}
+	if len(flushed.Values) != 1 || flushed.Values[0].Count != 12 {
+		t.Fatalf("Flush() of a steady stream = %d events", len(flushed.Values))
+	}
+
+	// A failed flush is retried, and the groups survive a restart
+	flushed.Err = errors.New("destination down")
+	clock.Add(time.Minute)
+	if _, err := c.Flush(ctx); err == nil {
+		t.Fatalf("Flush() error = nil")
+	}
+	restarted := New(reopen(), flushed.Flush)
+	restarted.now = clock.Now
+	clock.Add(hold.RetryDelay)
+	flushed.Err = nil
+	flushed.Reset()
+	if n, err := restarted.Flush(ctx); n != 1 || err != nil {
+		t.Fatalf("Flush() after restart = %d, %v", n, err)
+	}
+	if flushed.Values[0].Count != 3 {
+		t.Errorf("Flush() after restart count = %d, want 3", flushed.Values[0].Count)
+	}
+}
+
+func TestCoalescer_Replicas(t *testing.T) {
+	state, _ := holdtest.State(t)
+	clock := holdtest.NewClock()
+	var flushed holdtest.Recorder[Group]
+	replicas := []*Coalescer{New(state, flushed.Flush), New(state, flushed.Flush)}
+	ctx := context.Background()
+
+	// The events of a burst reach both replicas
+	for i, c := range replicas {
+		c.now = clock.Now
+		ev := events.New("microsoftgraph", "updated", []byte(fmt.Sprintf(`{"n":%d}`, i+1)))
+		if _, err := c.Add("docs", "drives/1", 10*time.Second, time.Minute, ev); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	clock.Add(10 * time.Second)
+	for _, c := range replicas {
+		if _, err := c.Flush(ctx); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+	}
+	if len(flushed.Values) != 1 || flushed.Values[0].Count != 2 {
+		t.Fatalf("Flush() by the replicas = %+v, want one group of 2", flushed.Values)
+	}
+}
@@ -0,0 +1,203 @@
+// Package codehost maps the webhooks of GitLab and Azure DevOps onto the
+// event types of GitHub, so routing rules written for GitHub match the
+// same activity on the other code hosts.
+//
+// The subject is the repository as "<namespace>/<name>", like the
+// "<owner>/<repo>" of GitHub events. The tenant is the top level GitLab
+// group or the Azure DevOps organization, like the organization of GitHub
+// events. The original payload is kept.
+package codehost
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+// Sources of the normalized events.
+const (
+	SourceGitLab      = "gitlab"
+	SourceAzureDevOps = "azuredevops"
+)
+
+// gitLabPayload holds the fields of GitLab webhooks used for mapping.
+type gitLabPayload struct {
+	ObjectKind string `json:"object_kind"`
+	Project    struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		Action string `json:"action"`
+		Status string `json:"status"`
+	} `json:"object_attributes"`
+}
+
+// GitLab normalizes a GitLab webhook. eventName is the X-Gitlab-Event
+// header, e.g. "Merge Request Hook", and uuid the X-Gitlab-Event-UUID.
+func GitLab(eventName, uuid string, body []byte) (events.Event, error) {
+	var p gitLabPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return events.Event{}, fmt.Errorf("invalid GitLab payload: %w", err)
+	}
+
+	ev := events.New(SourceGitLab, gitLabType(eventName, p), body)
+	ev.Subject = p.Project.PathWithNamespace
+	ev.Tenant, _, _ = strings.Cut(p.Project.PathWithNamespace, "/")
+	if uuid != "" {
+		ev.IdempotencyKey = SourceGitLab + ":" + uuid
+	}
+	return ev, nil
+}
+
+// gitLabActions maps merge request and issue actions to GitHub actions.
+var gitLabActions = map[string]string{
+	"open":   "opened",
+	"reopen": "reopened",
+	"close":  "closed",
+	"merge":  "closed",
+	"update": "synchronize",
+}
+
+func gitLabType(eventName string, p gitLabPayload) string {
+	switch eventName {
+	case "Push Hook", "Tag Push Hook":
+		return "push"
+	case "Merge Request Hook":
+		return withAction("pull_request", mapAction(gitLabActions, p.ObjectAttributes.Action))
+	case "Issue Hook", "Confidential Issue Hook":
+		action := mapAction(gitLabActions, p.ObjectAttributes.Action)
+		if action == "synchronize" {
+			action = "edited"
+		}
+		return withAction("issues", action)
+	case "Note Hook", "Confidential Note Hook":
+		return "issue_comment.created"
+	case "Pipeline Hook":
+		return withAction("workflow_run", pipelineAction(p.ObjectAttributes.Status))
+	case "Release Hook":
+		return withAction("release", mapAction(map[string]string{"create": "created", "update": "edited", "delete": "deleted"}, p.ObjectAttributes.Action))
+	}
+	// Unknown events keep their name, e.g. "Wiki Page Hook" becomes wiki_page
+	name := strings.TrimSuffix(eventName, " Hook")
+	if name == "" {
+		name = p.ObjectKind
+	}
+	return strings.ReplaceAll(strings.ToLower(name), " ", "_")
+}
+
+// pipelineAction maps a pipeline status to a workflow_run action.
+func pipelineAction(status string) string {
+	switch status {
+	case "created", "waiting_for_resource", "preparing", "pending", "scheduled":
+		return "requested"
+	case "running":
+		return "in_progress"
+	case "success", "failed", "canceled", "skipped", "manual":
+		return "completed"
+	}
+	return status
+}
+
+// azureDevOpsPayload holds the fields of Azure DevOps service hooks used for
+// mapping.
+type azureDevOpsPayload struct {
+	ID        string `json:"id"`
+	EventType string `json:"eventType"`
+	Resource  struct {
+		Status     string `json:"status"`
+		Repository struct {
+			Name    string `json:"name"`
+			Project struct {
+				Name string `json:"name"`
+			} `json:"project"`
+		} `json:"repository"`
+	} `json:"resource"`
+	ResourceContainers struct {
+		Account struct {
+			ID      string `json:"id"`
+			BaseURL string `json:"baseUrl"`
+		} `json:"account"`
+	} `json:"resourceContainers"`
+}
+
+// AzureDevOps normalizes an Azure DevOps service hook.
+func AzureDevOps(body []byte) (events.Event, error) {
+	var p azureDevOpsPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return events.Event{}, fmt.Errorf("invalid Azure DevOps payload: %w", err)
+	}
+	if p.EventType == "" {
+		return events.Event{}, fmt.Errorf("invalid Azure DevOps payload: eventType is missing")
+	}
+
+	ev := events.New(SourceAzureDevOps, azureDevOpsType(p), body)
+	if repo := p.Resource.Repository; repo.Name != "" {
+		ev.Subject = repo.Project.Name + "/" + repo.Name
+	}
+	ev.Tenant = azureDevOpsOrganization(p.ResourceContainers.Account.BaseURL)
+	if ev.Tenant == "" {
+		ev.Tenant = p.ResourceContainers.Account.ID
+	}
+	if p.ID != "" {
+		ev.IdempotencyKey = SourceAzureDevOps + ":" + p.ID
+	}
+	return ev, nil
+}
+
+// azureDevOpsOrganization returns the organization name of an account URL,
+// https://dev.azure.com/<organization>/ or https://<organization>.visualstudio.com/.
+func azureDevOpsOrganization(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	if org, ok := strings.CutSuffix(strings.ToLower(u.Hostname()), ".visualstudio.com"); ok {
+		return org
+	}
+	org, _, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	return org
+}
+
+func azureDevOpsType(p azureDevOpsPayload) string {
+	switch p.EventType {
+	case "git.push":
+		return "push"
+	case "git.pullrequest.created":
+		return "pull_request.opened"
+	case "git.pullrequest.merged":
+		return "pull_request.closed"
+	case "git.pullrequest.updated":
+		if p.Resource.Status == "completed" || p.Resource.Status == "abandoned" {
+			return "pull_request.closed"
+		}
+		return "pull_request.synchronize"
+	case "build.complete":
+		return "workflow_run.completed"
+	case "workitem.created":
+		return "issues.opened"
+	case "workitem.updated":
+		return "issues.edited"
+	case "workitem.deleted":
+		return "issues.deleted"
+	case "workitem.commented":
+		return "issue_comment.created"
+	}
+	return p.EventType
+}
+
+func mapAction(actions map[string]string, action string) string {
+	if mapped, ok := actions[action]; ok {
+		return mapped
+	}
+	return action
+}
+
+func withAction(event, action string) string {
+	if action == "" {
+		return event
+	}
+	return event + "." + action
+}
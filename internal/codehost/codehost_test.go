@@ -0,0 +1,96 @@
+package codehost
+
+import "testing"
+
+func TestGitLab(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       string
+		body        string
+		wantType    string
+		wantSubject string
+	}{
+		{"Push", "Push Hook", `{"object_kind":"push","project":{"path_with_namespace":"nexi/koksmat"}}`, "push", "nexi/koksmat"},
+		{"Tag push", "Tag Push Hook", `{"object_kind":"tag_push"}`, "push", ""},
+		{"Merge request opened", "Merge Request Hook", `{"object_attributes":{"action":"open"}}`, "pull_request.opened", ""},
+		{"Merge request merged", "Merge Request Hook", `{"object_attributes":{"action":"merge"}}`, "pull_request.closed", ""},
+		{"Merge request approved", "Merge Request Hook", `{"object_attributes":{"action":"approved"}}`, "pull_request.approved", ""},
+		{"Issue updated", "Issue Hook", `{"object_attributes":{"action":"update"}}`, "issues.edited", ""},
+		{"Pipeline running", "Pipeline Hook", `{"object_attributes":{"status":"running"}}`, "workflow_run.in_progress", ""},
+		{"Pipeline failed", "Pipeline Hook", `{"object_attributes":{"status":"failed"}}`, "workflow_run.completed", ""},
+		{"Unknown", "Wiki Page Hook", `{"object_kind":"wiki_page"}`, "wiki_page", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := GitLab(tt.event, "uuid-1", []byte(tt.body))
+			if err != nil {
+				t.Fatalf("GitLab() error = %v", err)
+			}
+			if ev.Source != SourceGitLab || ev.Type != tt.wantType || ev.Subject != tt.wantSubject || ev.IdempotencyKey != "gitlab:uuid-1" {
+				t.Errorf("GitLab() = %s %s %s %s", ev.Source, ev.Type, ev.Subject, ev.IdempotencyKey)
+			}
+			if tt.wantSubject != "" && ev.Tenant != "nexi" {
+				t.Errorf("GitLab() tenant = %q, want nexi", ev.Tenant)
+			}
+		})
+	}
+}
+
+func TestAzureDevOps(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantType    string
+		wantSubject string
+		wantErr     bool
+		wantTenant  string
+	}{
+		{
+			name:        "Push",
+			body:        `{"id":"e1","eventType":"git.push","resource":{"repository":{"name":"koksmat","project":{"name":"Nexi"}}}}`,
+			wantType:    "push",
+			wantSubject: "Nexi/koksmat",
+		},
+		{
+			name:       "Organization",
+			body:       `{"id":"e1","eventType":"git.push","resourceContainers":{"account":{"id":"a1","baseUrl":"https://dev.azure.com/nexi/"}}}`,
+			wantType:   "push",
+			wantTenant: "nexi",
+		},
+		{
+			name:       "Legacy organization URL",
+			body:       `{"id":"e1","eventType":"git.push","resourceContainers":{"account":{"id":"a1","baseUrl":"https://Nexi.visualstudio.com/"}}}`,
+			wantType:   "push",
+			wantTenant: "nexi",
+		},
+		{
+			name:       "Account ID",
+			body:       `{"id":"e1","eventType":"git.push","resourceContainers":{"account":{"id":"a1"}}}`,
+			wantType:   "push",
+			wantTenant: "a1",
+		},
+		{"Pull request created", `{"id":"e1","eventType":"git.pullrequest.created"}`, "pull_request.opened", "", false, ""},
+		{"Pull request completed", `{"id":"e1","eventType":"git.pullrequest.updated","resource":{"status":"completed"}}`, "pull_request.closed", "", false, ""},
+		{"Pull request updated", `{"id":"e1","eventType":"git.pullrequest.updated","resource":{"status":"active"}}`, "pull_request.synchronize", "", false, ""},
+		{"Build complete", `{"id":"e1","eventType":"build.complete"}`, "workflow_run.completed", "", false, ""},
+		{"Unknown", `{"id":"e1","eventType":"tfvc.checkin"}`, "tfvc.checkin", "", false, ""},
+		{"Missing event type", `{"id":"e1"}`, "", "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := AzureDevOps([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AzureDevOps() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ev.Source != SourceAzureDevOps || ev.Type != tt.wantType || ev.Subject != tt.wantSubject || ev.IdempotencyKey != "azuredevops:e1" {
+				t.Errorf("AzureDevOps() = %s %s %s %s", ev.Source, ev.Type, ev.Subject, ev.IdempotencyKey)
+			}
+			if ev.Tenant != tt.wantTenant {
+				t.Errorf("AzureDevOps() tenant = %q, want %q", ev.Tenant, tt.wantTenant)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_Next(t *testing.T) {
+	cph, err := time.LoadLocation("Europe/Copenhagen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{spec: "*/15 * * * *", from: time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC), want: time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)},
+		{spec: "0 2 * * *", from: time.Date(2024, 5, 1, 2, 0, 0, 0, cph), want: time.Date(2024, 5, 2, 2, 0, 0, 0, cph)},
+		{spec: "30 9 * * mon-fri", from: time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC), want: time.Date(2024, 5, 6, 9, 30, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", from: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 12 1 * 0", from: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), want: time.Date(2024, 5, 5, 12, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 7", from: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), want: time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{spec: "@monthly", from: time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC), want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "@every 90m", from: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), want: time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{spec: "@every 90m", from: time.Date(2024, 5, 1, 10, 29, 59, 0, time.UTC), want: time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		// 02:30 does not exist when daylight saving starts
+		{spec: "30 2 * * *", from: time.Date(2024, 3, 30, 12, 0, 0, 0, cph), want: time.Date(2024, 4, 1, 2, 30, 0, 0, cph)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@every 1ms"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) error = nil", spec)
+		}
+	}
+}
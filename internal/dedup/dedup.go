@@ -0,0 +1,126 @@
+// Package dedup suppresses events that were already accepted.
+//
+// Every event carries an idempotency key. The first event with a key claims
+// it for the TTL window; later events with the same key are duplicates. Keys
+// are persisted in the store so the window survives restarts.
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+const bucket = "dedup"
+
+// Deduper is safe for concurrent use.
+type Deduper struct {
+	ttl   time.Duration
+	store *store.Store
+	now   func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]time.Time // Key to expiry
+}
+
+// New returns a Deduper remembering keys for ttl. When st is not nil the
+// keys claimed before a restart are loaded from it.
+func New(ttl time.Duration, st *store.Store) (*Deduper, error) {
+	d := &Deduper{ttl: ttl, store: st, now: time.Now, keys: map[string]time.Time{}}
+	if st == nil {
+		return d, nil
+	}
+
+	now := d.now()
+	var expired []string
+	err := st.Each(bucket, func(key string, data []byte) error {
+		var expires time.Time
+		if err := expires.UnmarshalJSON(data); err != nil || !expires.After(now) {
+			expired = append(expired, key)
+			return nil
+		}
+		d.keys[key] = expires
+		return nil
+	})
+	for _, key := range expired {
+		st.Delete(bucket, key)
+	}
+	return d, err
+}
+
+// Claim reports whether key is new. A new key is remembered for the TTL, so
+// claiming it again returns false until it expires or is released. The
+// error reports a key which is claimed, but not persisted.
+func (d *Deduper) Claim(key string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if expires, ok := d.keys[key]; ok && expires.After(now) {
+		return false, nil
+	}
+	expires := now.Add(d.ttl)
+	d.keys[key] = expires
+	if d.store != nil {
+		if err := d.store.Put(bucket, key, expires); err != nil {
+			return true, fmt.Errorf("persisting idempotency key: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// Claimed returns when key was claimed, if it is claimed and not expired.
+func (d *Deduper) Claimed(key string) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expires, ok := d.keys[key]
+	if !ok || !expires.After(d.now()) {
+		return time.Time{}, false
+	}
+	return expires.Add(-d.ttl), true
+}
+
+// Release forgets key, used when processing failed and the sender should be
+// able to retry.
+func (d *Deduper) Release(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.keys, key)
+	if d.store != nil {
+		d.store.Delete(bucket, key)
+	}
+}
+
+// Expire removes expired keys every interval until ctx is done.
+func (d *Deduper) Expire(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.expireOnce()
+		}
+	}
+}
+
+func (d *Deduper) expireOnce() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for key, expires := range d.keys {
+		if !expires.After(now) {
+			delete(d.keys, key)
+			if d.store != nil {
+				d.store.Delete(bucket, key)
+			}
+		}
+	}
+}
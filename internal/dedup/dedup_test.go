@@ -0,0 +1,100 @@
+package dedup
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+func TestDeduper_Claim(t *testing.T) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(time.Hour, st)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	claim := func(d *Deduper, key string) bool {
+		t.Helper()
+		claimed, err := d.Claim(key)
+		if err != nil {
+			t.Fatalf("Claim() error = %v", err)
+		}
+		return claimed
+	}
+
+	if !claim(d, "github:1") {
+		t.Fatalf("Claim() of a new key = false")
+	}
+	if claim(d, "github:1") {
+		t.Errorf("Claim() of a claimed key = true")
+	}
+
+	d.Release("github:1")
+	if !claim(d, "github:1") {
+		t.Errorf("Claim() of a released key = false")
+	}
+
+	// Keys of Graph drive items are longer than a file name may be
+	long := "microsoftgraph:" + strings.Repeat("drives/b!abc/items/01XYZ|", 20)
+	if !claim(d, long) {
+		t.Fatalf("Claim() of a long key = false")
+	}
+	// A restart keeps the window
+	restarted, err := New(time.Hour, st)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	restarted.now = d.now
+	if claim(restarted, "github:1") || claim(restarted, long) {
+		t.Errorf("Claim() after restart = true")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if !claim(restarted, "github:1") {
+		t.Errorf("Claim() of an expired key = false")
+	}
+}
+
+func TestDeduper_ExpireOnce(t *testing.T) {
+	d, _ := New(time.Minute, nil)
+	now := time.Unix(1700000000, 0)
+	d.now = func() time.Time { return now }
+
+	d.Claim("a")
+	now = now.Add(30 * time.Second)
+	d.Claim("b")
+	now = now.Add(45 * time.Second)
+	d.expireOnce()
+
+	if _, ok := d.keys["a"]; ok {
+		t.Errorf("expireOnce() kept an expired key")
+	}
+	if _, ok := d.keys["b"]; !ok {
+		t.Errorf("expireOnce() removed a live key")
+	}
+}
+
+func TestDeduper_Claimed(t *testing.T) {
+	d, _ := New(time.Minute, nil)
+	now := time.Unix(1700000000, 0)
+	d.now = func() time.Time { return now }
+
+	if _, ok := d.Claimed("a"); ok {
+		t.Errorf("Claimed() of a new key = true")
+	}
+	d.Claim("a")
+	now = now.Add(30 * time.Second)
+	if at, ok := d.Claimed("a"); !ok || !at.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Claimed() = %v, %v", at, ok)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := d.Claimed("a"); ok {
+		t.Errorf("Claimed() of an expired key = true")
+	}
+}
@@ -0,0 +1,212 @@
+// Package delay holds deliveries back until they are due.
+//
+// A delivery keeps a copy of an event for the destinations of a rule until
+// its due time. Deliveries are kept in a hold.State, so a restart does not
+// lose them, and replicas sharing the state make each once. A later event
+// can cancel the deliveries of a rule and key; the Cancellations remember it
+// for events before it which are received late.
+package delay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
+)
+
+// ErrNotFound is returned for deliveries which are not pending.
+var ErrNotFound = errors.New("delayed delivery not found")
+
+// Delivery is an event held back for the destinations of a rule.
+type Delivery struct {
+	ID    string       `json:"id"` // ID of the delayed copy, the same for every attempt
+	Rule  string       `json:"rule"`
+	Key   string       `json:"key"`
+	Event events.Event `json:"event"`
+	Due   time.Time    `json:"due"`
+}
+
+func storeKey(rule, eventID string) string {
+	return rule + "|" + eventID
+}
+
+// Delayed returns the copy of the event delivered when the delivery is due.
+func (d Delivery) Delayed() events.Event {
+	ev := d.Event
+	ev.ID = d.ID
+	ev.Tags = nil
+	ev.IdempotencyKey = "delay:" + d.ID
+	ev.Delayed = &events.Delayed{Rule: d.Rule, Key: d.Key, EventID: d.Event.ID, Due: d.Due}
+	return ev
+}
+
+// Deliverer delivers the copy of a due delivery.
+type Deliverer func(ctx context.Context, d Delivery) error
+
+// Cancellations remembers when the deliveries of a rule and key were last
+// cancelled.
+type Cancellations interface {
+	Cancel(rule, key string, at time.Time) error
+	Cancelled(rule, key string) (time.Time, bool, error)
+}
+
+// LocalCancellations keeps the cancellations in memory, for a single
+// replica. A cancellation is forgotten ttl after it, which should exceed the
+// longest delay.
+type LocalCancellations struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu     sync.Mutex
+	last   map[string]time.Time
+	pruned time.Time
+}
+
+// NewLocalCancellations returns empty LocalCancellations.
+func NewLocalCancellations(ttl time.Duration) *LocalCancellations {
+	return &LocalCancellations{ttl: ttl, now: time.Now, last: map[string]time.Time{}}
+}
+
+func (c *LocalCancellations) Cancel(rule, key string, at time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.pruned) > time.Minute {
+		for k, last := range c.last {
+			if now.Sub(last) > c.ttl {
+				delete(c.last, k)
+			}
+		}
+		c.pruned = now
+	}
+	if last, ok := c.last[rule+"|"+key]; !ok || last.Before(at) {
+		c.last[rule+"|"+key] = at
+	}
+	return nil
+}
+
+func (c *LocalCancellations) Cancelled(rule, key string) (time.Time, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, ok := c.last[rule+"|"+key]
+	return at, ok, nil
+}
+
+// Queue is safe for concurrent use, also by replicas sharing the state.
+type Queue struct {
+	queue   *hold.Queue[Delivery]
+	cancels Cancellations
+	deliver Deliverer
+	now     func() time.Time
+}
+
+// New returns a Queue keeping its deliveries in state and the cancellations
+// in cancels.
+func New(state hold.State, cancels Cancellations, deliver Deliverer) *Queue {
+	return &Queue{queue: hold.New[Delivery](state, nil), cancels: cancels, deliver: deliver, now: time.Now}
+}
+
+// cancelled reports whether the delivery was cancelled by an event after its
+// own, which may have been received earlier or through another replica.
+func (q *Queue) cancelled(rule, key string, ev events.Event) (bool, error) {
+	at, ok, err := q.cancels.Cancelled(rule, key)
+	return ok && at.After(ev.Time), err
+}
+
+// Add holds the event for rule until due. It reports false when an event
+// after it cancelled the key already, e.g. when it was received late.
+func (q *Queue) Add(rule, key string, due time.Time, ev events.Event) (Delivery, bool, error) {
+	cancelled, err := q.cancelled(rule, key, ev)
+	if err != nil || cancelled {
+		return Delivery{}, false, err
+	}
+
+	it, err := q.queue.Update(storeKey(rule, ev.ID), func(it *hold.Item[Delivery], exists bool) (bool, error) {
+		if exists {
+			// Redelivered by the event stream
+			return false, nil
+		}
+		it.Value = Delivery{ID: events.NewID(), Rule: rule, Key: key, Event: ev, Due: due}
+		it.Due = due
+		return true, nil
+	})
+	return it.Value, err == nil, err
+}
+
+// Cancel drops the pending deliveries of rule and key holding events which
+// happened before at, and returns them.
+func (q *Queue) Cancel(rule, key string, at time.Time) ([]Delivery, error) {
+	firstErr := q.cancels.Cancel(rule, key, at)
+	items, err := q.queue.List()
+	if err != nil {
+		return nil, errors.Join(firstErr, err)
+	}
+	var cancelled []Delivery
+	for _, it := range items {
+		d := it.Value
+		if d.Rule != rule || d.Key != key || !d.Event.Time.Before(at) {
+			continue
+		}
+		_, removed, err := q.queue.Remove(it.Key)
+		if removed {
+			cancelled = append(cancelled, d)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return cancelled, firstErr
+}
+
+// Remove drops the pending delivery with the ID.
+func (q *Queue) Remove(id string) (Delivery, error) {
+	items, err := q.queue.List()
+	if err != nil {
+		return Delivery{}, err
+	}
+	for _, it := range items {
+		if it.Value.ID == id {
+			if _, removed, err := q.queue.Remove(it.Key); err != nil || removed {
+				return it.Value, err
+			}
+		}
+	}
+	return Delivery{}, ErrNotFound
+}
+
+// Pending returns the deliveries not made yet, the next due first.
+func (q *Queue) Pending() ([]Delivery, error) {
+	items, err := q.queue.List()
+	deliveries := make([]Delivery, 0, len(items))
+	for _, it := range items {
+		d := it.Value
+		d.Due = it.Next()
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, err
+}
+
+// Flush makes the due deliveries. A delivery which fails is attempted again
+// after hold.RetryDelay. The number of deliveries made is returned.
+func (q *Queue) Flush(ctx context.Context) (int, error) {
+	return q.queue.Flush(ctx, q.now(), func(ctx context.Context, it hold.Item[Delivery]) error {
+		d := it.Value
+		cancelled, err := q.cancelled(d.Rule, d.Key, d.Event)
+		if err != nil {
+			return err
+		}
+		if cancelled {
+			return hold.ErrDropped
+		}
+		return q.deliver(ctx, d)
+	})
+}
+
+// Run makes the due deliveries every interval until ctx is done. Errors are
+// passed to onError.
+func (q *Queue) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	hold.Run(ctx, interval, q.Flush, onError)
+}
@@ -0,0 +1,136 @@
+package delay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hold/holdtest"
+)
+
+// memoryCancellations stands for the cancellations shared with another
+// replica.
+type memoryCancellations map[string]time.Time
+
+func (m memoryCancellations) Cancel(rule, key string, at time.Time) error {
+	m[rule+"|"+key] = at
+	return nil
+}
+
+func (m memoryCancellations) Cancelled(rule, key string) (time.Time, bool, error) {
+	at, ok := m[rule+"|"+key]
+	return at, ok, nil
+}
+
+func TestQueue_Flush(t *testing.T) {
+	state, reopen := holdtest.State(t)
+	var delivered holdtest.Recorder[Delivery]
+	shared := memoryCancellations{}
+	q := New(state, shared, delivered.Flush)
+	clock := holdtest.NewClock()
+	now := clock.Now()
+	q.now = clock.Now
+	ctx := context.Background()
+
+	add := func(key string, at time.Time) (events.Event, bool) {
+		ev := events.New("github", "pull_request.closed", []byte(`{}`))
+		ev.Time = at
+		_, held, err := q.Add("cleanup", key, at.Add(30*time.Minute), ev)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		return ev, held
+	}
+	kept, _ := add("org/repo#1", now)
+	add("org/repo#2", now)
+	if _, held, _ := q.Add("cleanup", "org/repo#1", now.Add(30*time.Minute), kept); !held {
+		t.Fatalf("Add() of a redelivered event = %v, want true", held)
+	}
+	if pending, err := q.Pending(); len(pending) != 2 || err != nil {
+		t.Fatalf("Pending() = %d, %v, want 2", len(pending), err)
+	}
+
+	// Reopened, an event before it is kept
+	cancelled, err := q.Cancel("cleanup", "org/repo#2", now.Add(time.Minute))
+	if err != nil || len(cancelled) != 1 {
+		t.Fatalf("Cancel() = %d, %v, want 1 cancelled", len(cancelled), err)
+	}
+	if _, held := add("org/repo#2", now.Add(-time.Minute)); held {
+		t.Errorf("Add() held an event before the cancellation")
+	}
+	if _, held := add("org/repo#2", now.Add(2*time.Minute)); !held {
+		t.Errorf("Add() did not hold an event after the cancellation")
+	}
+
+	if n, _ := q.Flush(ctx); n != 0 {
+		t.Fatalf("Flush() delivered %d before they were due", n)
+	}
+	clock.Add(31 * time.Minute)
+	delivered.Err = errors.New("unavailable")
+	if _, err := q.Flush(ctx); err == nil {
+		t.Fatalf("Flush() expected an error")
+	}
+	// Kept for a restart
+	q = New(reopen(), shared, delivered.Flush)
+	q.now = clock.Now
+	if pending, err := q.Pending(); len(pending) != 2 || err != nil {
+		t.Fatalf("Pending() after a restart = %d, %v, want 2", len(pending), err)
+	}
+
+	// Cancelled through another replica while waiting for the retry
+	shared["cleanup|org/repo#2"] = clock.Now()
+	delivered.Err = nil
+	clock.Add(5 * time.Minute)
+	if n, err := q.Flush(ctx); err != nil || n != 1 {
+		t.Fatalf("Flush() = %d, %v, want 1", n, err)
+	}
+	ev := delivered.Values[0].Delayed()
+	if ev.Delayed == nil || ev.Delayed.EventID != kept.ID || ev.ID == kept.ID || ev.IdempotencyKey != "delay:"+ev.ID {
+		t.Errorf("Flush() delivered %+v, want a copy of %s", ev, kept.ID)
+	}
+	if pending, _ := q.Pending(); len(pending) != 0 {
+		t.Errorf("Pending() = %d after the flush, want 0", len(pending))
+	}
+}
+
+func TestQueue_Remove(t *testing.T) {
+	state, _ := holdtest.State(t)
+	q := New(state, NewLocalCancellations(time.Hour), func(ctx context.Context, d Delivery) error { return nil })
+	d, _, err := q.Add("cleanup", "org/repo#1", time.Now().Add(time.Hour), events.New("github", "pull_request.closed", []byte(`{}`)))
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := q.Remove(d.ID); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := q.Remove(d.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalCancellations(t *testing.T) {
+	state, _ := holdtest.State(t)
+	local := NewLocalCancellations(time.Hour)
+	clock := holdtest.NewClock()
+	local.now = clock.Now
+	q := New(state, local, func(ctx context.Context, d Delivery) error { return nil })
+
+	// A cancellation received before the event it cancels
+	if _, err := q.Cancel("cleanup", "org/repo#1", clock.Now()); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	late := events.New("github", "pull_request.closed", []byte(`{}`))
+	late.Time = clock.Now().Add(-time.Minute)
+	if _, held, err := q.Add("cleanup", "org/repo#1", clock.Now().Add(time.Hour), late); held || err != nil {
+		t.Errorf("Add() = %v, %v, want the late event cancelled", held, err)
+	}
+
+	// Forgotten after the TTL
+	clock.Add(2 * time.Hour)
+	local.Cancel("cleanup", "org/repo#2", clock.Now())
+	if _, ok, _ := local.Cancelled("cleanup", "org/repo#1"); ok {
+		t.Errorf("Cancelled() kept a cancellation beyond the TTL")
+	}
+}
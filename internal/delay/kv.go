@@ -0,0 +1,60 @@
+package delay
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// KVCancellations keeps the cancellations in a NATS key-value bucket shared
+// by the replicas. Entries expire after the TTL of the bucket, which should
+// exceed the longest delay.
+type KVCancellations struct {
+	kv nats.KeyValue
+}
+
+// NewKVCancellations creates or binds the key-value bucket.
+func NewKVCancellations(js nats.JetStreamContext, bucket string, ttl time.Duration) (*KVCancellations, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "Cancellations of the koksmat-emit delayed deliveries",
+			History:     1,
+			TTL:         ttl,
+			Storage:     nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &KVCancellations{kv: kv}, nil
+}
+
+// kvKey encodes rule and key, which may contain characters not allowed in
+// keys.
+func kvKey(rule, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(rule + "|" + key))
+}
+
+func (c *KVCancellations) Cancel(rule, key string, at time.Time) error {
+	if last, ok, err := c.Cancelled(rule, key); err != nil || (ok && !last.Before(at)) {
+		return err
+	}
+	_, err := c.kv.Put(kvKey(rule, key), []byte(at.UTC().Format(time.RFC3339Nano)))
+	return err
+}
+
+func (c *KVCancellations) Cancelled(rule, key string) (time.Time, bool, error) {
+	entry, err := c.kv.Get(kvKey(rule, key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	at, err := time.Parse(time.RFC3339Nano, string(entry.Value()))
+	return at, err == nil, err
+}
@@ -0,0 +1,58 @@
+package emitter
+
+import (
+	"context"
+
+	"github.com/nexi-intra/koksmat-emit/internal/aggregate"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"go.uber.org/zap"
+)
+
+// aggregate counts the event in the window of an aggregating rule.
+func (a *App) aggregate(ev events.Event, h routing.Held) error {
+	agg := h.Rule.Aggregate
+	start, end := agg.Bounds(ev.Time)
+	var item string
+	if agg.Item != nil {
+		item = agg.Item.Expand(ev)
+	}
+	w, err := a.Aggregator.Add(h.Rule.Name, h.Key, start, end, item, agg.MaxItems, ev)
+	if err != nil {
+		a.Obs.Error("Failed to aggregate event",
+			zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.Error(err))
+		return err
+	}
+	a.metrics.aggregated.WithLabelValues(h.Rule.Name).Inc()
+	a.Obs.Verbose("Event aggregated",
+		zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.String("key", h.Key),
+		zap.Int("count", w.Count), zap.Time("windowEnd", w.End))
+	return nil
+}
+
+// emitAggregate emits the aggregate event of a closed window. It takes the
+// same way as received events, but only to the destinations of its rule.
+func (a *App) emitAggregate(ctx context.Context, w aggregate.Window) error {
+	ev := w.Event()
+	if _, ok := a.History.Get(ev.ID); !ok {
+		a.History.Add(ev)
+	}
+	a.Obs.Info("Emitting aggregate",
+		zap.String("id", ev.ID), zap.String("rule", w.Rule), zap.String("key", w.Key), zap.Int("count", w.Count))
+	if a.Bus != nil {
+		return a.Bus.Publish(ev)
+	}
+	return a.Process(ctx, ev)
+}
+
+// aggregateDestinations returns the destinations and tags of the rule of an
+// aggregate event.
+func (a *App) aggregateDestinations(ev events.Event) ([]routing.Destination, []string) {
+	rule, ok := a.Router.Current().Rule(ev, ev.Aggregated.Rule)
+	if !ok || rule.Aggregate == nil {
+		a.Obs.Warning("Aggregating rule of aggregate event no longer exists",
+			zap.String("id", ev.ID), zap.String("rule", ev.Aggregated.Rule))
+		return nil, nil
+	}
+	return rule.Destinations, rule.Tags
+}
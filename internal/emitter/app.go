@@ -2,17 +2,36 @@
 package emitter
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"time"
 
+	"github.com/nexi-intra/koksmat-emit/internal/aggregate"
+	"github.com/nexi-intra/koksmat-emit/internal/auth"
+	"github.com/nexi-intra/koksmat-emit/internal/azuread"
+	"github.com/nexi-intra/koksmat-emit/internal/bus"
+	"github.com/nexi-intra/koksmat-emit/internal/cloudevents"
+	"github.com/nexi-intra/koksmat-emit/internal/coalesce"
+	"github.com/nexi-intra/koksmat-emit/internal/dedup"
+	"github.com/nexi-intra/koksmat-emit/internal/delay"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/graph"
+	"github.com/nexi-intra/koksmat-emit/internal/history"
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
 	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"github.com/nexi-intra/koksmat-emit/internal/scheduler"
+	"github.com/nexi-intra/koksmat-emit/internal/sharepoint"
+	"github.com/nexi-intra/koksmat-emit/internal/signing"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
 	"github.com/nexi-intra/koksmat-emit/services"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
-
-	"github.com/golang-jwt/jwt"
 )
 
 type EventRecord struct {
@@ -25,34 +44,31 @@ type EventRecord struct {
 	Payload     json.RawMessage `json:"payload"`
 }
 
-// Define a secret key (ensure this is kept secure in production)
-var jwtSecret = []byte("your-very-secure-secret")
-
-// CreateJWT generates a JWT with the app_displayname as a payload claim
-func CreateJWT(appDisplayName string) (string, error) {
-	// Define the token claims
-	claims := jwt.MapClaims{
-		"app_displayname": appDisplayName,
-		"exp":             time.Now().Add(time.Hour * 72).Unix(), // Token expires in 72 hours
-		"iat":             time.Now().Unix(),
-	}
-
-	// Create a new token object specifying signing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign the token with the secret
-	tokenString, err := token.SignedString(jwtSecret)
-	if err != nil {
-		return "", err
-	}
+type App struct {
+	Obs     *observability.Observability
+	Mix     *services.MicroService
+	Router  *routing.Router
+	Signer  *signing.Signer
+	History *history.History
+	Data    *store.Store // State which has to survive restarts
+	Dedup   *dedup.Deduper
+	Bus     *bus.Bus            // Set when delivery runs from the JetStream stream
+	Auth    *auth.Authenticator // Guards the admin API, metrics and /verbose
 
-	return tokenString, nil
-}
+	Coalescer  *coalesce.Coalescer   // Holds the bursts of coalescing rules
+	Aggregator *aggregate.Aggregator // Holds the windows of aggregating rules
+	Delays     *delay.Queue          // Holds the deliveries of delaying rules
+	Scheduler  *scheduler.Scheduler  // Fires the schedules, started by serve only
 
-type App struct {
-	Obs *observability.Observability
-	Mix *services.MicroService
+	SharePoint *sharepoint.Fetcher // Set when SHAREPOINT_BASE_URL is configured
+	Graph      *graph.Client       // Set when Graph credentials are configured
+	GraphDelta *graph.Syncer       // Set when GRAPH_DELTA_RESOURCES is configured
 	// Other services can be added here
+
+	metrics     *metrics
+	throttles   *throttles
+	breakers    *breakers
+	cloudEvents cloudevents.Options
 }
 
 func NewApp(obs *observability.Observability) *App {
@@ -61,19 +77,270 @@ func NewApp(obs *observability.Observability) *App {
 		obs.Error("Failed to connect to MagicMix", zap.Error(err))
 		return nil
 	}
-	return &App{
-		Obs: obs,
-		Mix: mixClient,
+	signer, err := signing.NewSignerFromConfig()
+	if err != nil {
+		obs.Error("Failed to configure MagicMix token signing", zap.Error(err))
+		return nil
+	}
+	viper.SetDefault("DATA_DIR", "data")
+	data, err := store.Open(viper.GetString("DATA_DIR"))
+	if err != nil {
+		obs.Error("Failed to open data directory", zap.Error(err))
+		return nil
+	}
+	app := &App{
+		Obs:       obs,
+		Mix:       mixClient,
+		Signer:    signer,
+		Data:      data,
+		metrics:   newMetrics(obs),
+		throttles: newThrottles(),
+		cloudEvents: cloudevents.Options{
+			SourcePrefix: viper.GetString("CLOUDEVENTS_SOURCE_PREFIX"),
+			TypePrefix:   viper.GetString("CLOUDEVENTS_TYPE_PREFIX"),
+		},
 		// Initialize other services here
 	}
+	app.breakers = newBreakers(app)
+
+	app.Auth, err = auth.NewAuthenticatorFromConfig()
+	if err != nil {
+		obs.Error("Invalid admin authentication settings, the admin API and metrics reject all requests", zap.Error(err))
+		app.Auth = &auth.Authenticator{}
+	}
+
+	configFile := viper.GetString("EMIT_CONFIG")
+	if configFile == "" {
+		configFile = "emit.yaml"
+	}
+	app.Router, err = routing.NewRouter(obs, configFile, app.newDestination)
+	if err != nil {
+		obs.Error("Failed to load routing configuration", zap.Error(err))
+		return nil
+	}
+
+	viper.SetDefault("HISTORY_SIZE", 1000)
+	viper.SetDefault("HISTORY_RETENTION", "168h")
+	var historyStore *store.Store
+	if dir := viper.GetString("HISTORY_DIR"); dir != "" {
+		if historyStore, err = store.Open(dir); err != nil {
+			obs.Error("Failed to open event history", zap.Error(err))
+			return nil
+		}
+	}
+	app.History = history.New(viper.GetInt("HISTORY_SIZE"), historyStore, viper.GetDuration("HISTORY_RETENTION"))
+
+	viper.SetDefault("DEDUP_TTL", "24h")
+	app.Dedup, err = dedup.New(viper.GetDuration("DEDUP_TTL"), data)
+	if err != nil {
+		obs.Error("Failed to load idempotency keys", zap.Error(err))
+		return nil
+	}
+
+	if base := viper.GetString("SHAREPOINT_BASE_URL"); base != "" {
+		if viper.GetString("SHAREPOINT_CLIENT_STATE") == "" {
+			// Without it anyone could make the emitter fetch the changes of any list
+			obs.Error("SHAREPOINT_CLIENT_STATE is required with SHAREPOINT_BASE_URL")
+			return nil
+		}
+		var tokens azuread.TokenSource = azuread.StaticToken(viper.GetString("SHAREPOINT_ACCESS_TOKEN"))
+		if viper.GetString("SHAREPOINT_CLIENT_ID") != "" {
+			credentials := &azuread.ClientCredentials{
+				TenantID:     viper.GetString("SHAREPOINT_TENANT_ID"),
+				ClientID:     viper.GetString("SHAREPOINT_CLIENT_ID"),
+				ClientSecret: viper.GetString("SHAREPOINT_CLIENT_SECRET"),
+				Scope:        strings.TrimSuffix(base, "/") + "/.default",
+			}
+			if certFile := viper.GetString("SHAREPOINT_CLIENT_CERTIFICATE"); certFile != "" {
+				credentials.Certificate, err = azuread.LoadCertificate(certFile, viper.GetString("SHAREPOINT_CLIENT_KEY"))
+				if err != nil {
+					obs.Error("Failed to load the SharePoint client certificate", zap.Error(err))
+					return nil
+				}
+			} else {
+				obs.Warning("SharePoint REST rejects app-only tokens acquired with a client secret, set SHAREPOINT_CLIENT_CERTIFICATE")
+			}
+			tokens = credentials
+		}
+		client := &sharepoint.Client{BaseURL: base, Tokens: tokens, HTTPClient: &http.Client{Timeout: 30 * time.Second}}
+		app.SharePoint = sharepoint.NewFetcher(obs, client, data, app.Emit)
+		if window := viper.GetDuration("SHAREPOINT_INITIAL_WINDOW"); window > 0 {
+			app.SharePoint.InitialWindow = window
+		}
+	}
+
+	if viper.GetString("GRAPH_CLIENT_ID") != "" || viper.GetString("GRAPH_ACCESS_TOKEN") != "" {
+		var tokens azuread.TokenSource = azuread.StaticToken(viper.GetString("GRAPH_ACCESS_TOKEN"))
+		if viper.GetString("GRAPH_CLIENT_ID") != "" {
+			tokens = &azuread.ClientCredentials{
+				TenantID:     viper.GetString("GRAPH_TENANT_ID"),
+				ClientID:     viper.GetString("GRAPH_CLIENT_ID"),
+				ClientSecret: viper.GetString("GRAPH_CLIENT_SECRET"),
+				Scope:        "https://graph.microsoft.com/.default",
+				Authority:    viper.GetString("GRAPH_AUTHORITY"),
+			}
+		}
+		app.Graph = &graph.Client{
+			BaseURL:    viper.GetString("GRAPH_BASE_URL"),
+			Tokens:     tokens,
+			HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		}
+
+		var resources []string
+		for _, resource := range strings.Split(viper.GetString("GRAPH_DELTA_RESOURCES"), ",") {
+			if resource = strings.TrimSpace(resource); resource != "" {
+				resources = append(resources, resource)
+			}
+		}
+		if len(resources) > 0 {
+			app.GraphDelta = graph.NewSyncer(obs, app.Graph, data, app.Dedup, app.Emit, resources)
+			app.GraphDelta.Full = viper.GetBool("GRAPH_DELTA_FULL")
+			app.GraphDelta.TenantID = viper.GetString("GRAPH_TENANT_ID")
+		}
+	}
+
+	switch mode := viper.GetString("BUS"); mode {
+	case "", "direct":
+	case "jetstream":
+		cfg, err := bus.ConfigFromViper()
+		if err != nil {
+			obs.Error("Invalid event stream configuration", zap.Error(err))
+			return nil
+		}
+		app.Bus, err = bus.New(obs, mixClient.NATS(), cfg)
+		if err != nil {
+			obs.Error("Failed to set up the event stream", zap.Error(err))
+			return nil
+		}
+	default:
+		obs.Error("BUS must be direct or jetstream", zap.String("bus", mode))
+		return nil
+	}
+
+	coalesced, err := app.heldState("coalesce")
+	if err != nil {
+		obs.Error("Failed to load coalesced events", zap.Error(err))
+		return nil
+	}
+	app.Coalescer = coalesce.New(coalesced, app.flushCoalesced)
+	windows, err := app.heldState("aggregates")
+	if err != nil {
+		obs.Error("Failed to load aggregation windows", zap.Error(err))
+		return nil
+	}
+	app.Aggregator = aggregate.New(windows, app.emitAggregate)
+
+	cancels, err := app.delayCancellations()
+	if err != nil {
+		obs.Error("Failed to set up the delay cancellations", zap.Error(err))
+		return nil
+	}
+	deliveries, err := app.heldState("delay")
+	if err != nil {
+		obs.Error("Failed to load delayed deliveries", zap.Error(err))
+		return nil
+	}
+	app.Delays = delay.New(deliveries, cancels, app.emitDelayed)
+
+	state, err := app.schedulerState()
+	if err != nil {
+		obs.Error("Failed to set up the scheduler state", zap.Error(err))
+		return nil
+	}
+	app.Scheduler = scheduler.New(obs, app.Router, state, app.Emit)
+	return app
+}
+
+// heldState returns the state of the events held back by the coalescing,
+// aggregating and delaying rules, see HELD_STATE. Like the scheduler state
+// it defaults to NATS with the JetStream bus, so the replicas add to the
+// same bursts and windows and flush each once.
+func (a *App) heldState(name string) (hold.State, error) {
+	mode := viper.GetString("HELD_STATE")
+	if mode == "" {
+		mode = "local"
+		if a.Bus != nil {
+			mode = "nats"
+		}
+	}
+	switch mode {
+	case "local":
+		return hold.NewStoreState(a.Data, name)
+	case "nats":
+		js, err := a.Mix.NATS().JetStream()
+		if err != nil {
+			return nil, err
+		}
+		viper.SetDefault("HELD_BUCKET", "emit-held")
+		return hold.NewKVState(js, viper.GetString("HELD_BUCKET"), name)
+	default:
+		return nil, fmt.Errorf("HELD_STATE must be local or nats, not %q", mode)
+	}
+}
+
+// delayCancellations returns the cancellations of delayed deliveries, see
+// DELAY_CANCELLATIONS. Like the scheduler state they are shared through NATS
+// by default with the JetStream bus, and kept in memory otherwise.
+func (a *App) delayCancellations() (delay.Cancellations, error) {
+	mode := viper.GetString("DELAY_CANCELLATIONS")
+	if mode == "" {
+		mode = "local"
+		if a.Bus != nil {
+			mode = "nats"
+		}
+	}
+	viper.SetDefault("DELAY_CANCELLATIONS_TTL", "720h")
+	switch mode {
+	case "local":
+		return delay.NewLocalCancellations(viper.GetDuration("DELAY_CANCELLATIONS_TTL")), nil
+	case "nats":
+		js, err := a.Mix.NATS().JetStream()
+		if err != nil {
+			return nil, err
+		}
+		viper.SetDefault("DELAY_CANCELLATIONS_BUCKET", "emit-delay-cancellations")
+		return delay.NewKVCancellations(js, viper.GetString("DELAY_CANCELLATIONS_BUCKET"),
+			viper.GetDuration("DELAY_CANCELLATIONS_TTL"))
+	default:
+		return nil, fmt.Errorf("DELAY_CANCELLATIONS must be local or nats, not %q", mode)
+	}
+}
+
+// schedulerState returns the state shared by the schedulers of the replicas,
+// see SCHEDULER_STATE. It defaults to NATS with the JetStream bus, whose
+// replicas share a stream, and to the data directory otherwise.
+func (a *App) schedulerState() (scheduler.State, error) {
+	mode := viper.GetString("SCHEDULER_STATE")
+	if mode == "" {
+		mode = "local"
+		if a.Bus != nil {
+			mode = "nats"
+		}
+	}
+	switch mode {
+	case "local":
+		return scheduler.NewStoreState(a.Data), nil
+	case "nats":
+		js, err := a.Mix.NATS().JetStream()
+		if err != nil {
+			return nil, err
+		}
+		viper.SetDefault("SCHEDULER_BUCKET", "emit-scheduler")
+		return scheduler.NewKVState(js, viper.GetString("SCHEDULER_BUCKET"))
+	default:
+		return nil, fmt.Errorf("SCHEDULER_STATE must be local or nats, not %q", mode)
+	}
 }
 
 func (a *App) Routes() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/hello", a.Obs.InstrumentedHandler("/hello", a.HelloHandler))
-	mux.HandleFunc("/verbose", a.Obs.InstrumentedHandler("/verbose", a.VerboseHandler))
+	read := a.Auth.Require(auth.RoleRead)
+	mux.Handle("/verbose", read(a.Obs.InstrumentedHandler("/verbose", a.VerboseHandler)))
+	mux.Handle("/metrics", read(a.Obs.MetricsHandler))
 	mux.HandleFunc("/health", a.Obs.InstrumentedHandler("/health", a.HealthHandler))
+	mux.HandleFunc("/ready", a.Obs.InstrumentedHandler("/ready", a.ReadyHandler))
 
 	return mux
 }
@@ -97,25 +364,21 @@ func (a *App) HealthHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) SaveWebhook(endpoint string, body string) error {
 	a.Obs.Verbose("Saving webhook", zap.String("endpoint", endpoint), zap.String("body", string(body)))
 
-	procedure := "create_event"
-
-	token, err := CreateJWT("koksmat-emit")
-	if err != nil {
-		a.Obs.Error("Failed to create JWT", zap.Error(err))
-		return err
-	}
 	if !json.Valid([]byte(body)) {
 		a.Obs.Error("Invalid JSON", zap.String("body", body))
 		return fmt.Errorf("invalid json: %s", body)
 	}
-	record := EventRecord{
-		Tenant:      "",
-		Searchindex: "",
-		Name:        "webhook",
-		Description: "webhook",
-		Source:      "koksmat-emit",
-		Tag:         endpoint,
-		Payload:     json.RawMessage(body),
+	ev := events.New(endpoint, "webhook", []byte(body))
+	record := newEventRecord(a.CloudEvent(ev), ev)
+	return a.saveRecord(defaultMixSubject, defaultMixProcedure, record, defaultMixTimeout)
+}
+
+// saveRecord executes procedure in MagicMix with the record as payload.
+func (a *App) saveRecord(subject string, procedure string, record EventRecord, timeout time.Duration) error {
+	token, err := a.Signer.Token("koksmat-emit")
+	if err != nil {
+		a.Obs.Error("Failed to create JWT", zap.Error(err))
+		return err
 	}
 	payload, err := json.Marshal(record)
 	if err != nil {
@@ -123,9 +386,9 @@ func (a *App) SaveWebhook(endpoint string, body string) error {
 		return err
 	}
 
-	args := []string{"execute", "mix", procedure, token, body}
+	args := []string{"execute", "mix", procedure, token, string(record.Payload)}
 
-	result, err := a.Mix.Request("magic-mix.app", args, string(payload), 5*time.Second)
+	result, err := a.Mix.Request(subject, args, string(payload), timeout)
 	if err != nil {
 		a.Obs.Error("Failed to save webhook", zap.Error(err))
 		return err
@@ -134,3 +397,309 @@ func (a *App) SaveWebhook(endpoint string, body string) error {
 
 	return nil
 }
+
+// Emit accepts an event. It is recorded in the history and, when the event
+// stream is enabled, published to it. Otherwise it is processed right away.
+//
+// With tenants configured, the tenant value of the event is replaced by the
+// Koksmat tenant, see resolveTenant. Events of unknown tenants are refused
+// with ErrUnknownTenant or quarantined, as the configuration says.
+//
+// Received events cannot use the sources of the events the emitter creates
+// itself, they are refused with ErrReservedSource.
+//
+// Events whose idempotency key was accepted before are ignored. When
+// publishing or a delivery fails the key is released again, so a retry by
+// the sender is processed.
+func (a *App) Emit(ctx context.Context, ev events.Event) error {
+	if events.Reserved(ev.Source) && !ev.Internal {
+		return fmt.Errorf("%w: %s", ErrReservedSource, ev.Source)
+	}
+	ev, quarantine, err := a.resolveTenant(ev, true)
+	if err != nil {
+		return err
+	}
+	ev.IdempotencyKey = ev.Key()
+	claimed, err := a.Dedup.Claim(ev.IdempotencyKey)
+	if err != nil {
+		a.Obs.Warning("Duplicates of the event are not detected after a restart",
+			zap.String("id", ev.ID), zap.String("key", ev.IdempotencyKey), zap.Error(err))
+	}
+	if !claimed {
+		a.metrics.duplicates.WithLabelValues(ev.Source).Inc()
+		a.Obs.Info("Duplicate event ignored",
+			zap.String("id", ev.ID), zap.String("source", ev.Source), zap.String("key", ev.IdempotencyKey))
+		return nil
+	}
+
+	a.History.Add(ev)
+	if quarantine {
+		a.History.Quarantine(ev.ID)
+		a.Obs.Warning("Event of unknown tenant quarantined",
+			zap.String("id", ev.ID), zap.String("source", ev.Source), zap.String("tenant", ev.Tenant))
+		return nil
+	}
+
+	if a.Bus != nil {
+		err = a.Bus.Publish(ev)
+		if err != nil {
+			a.Obs.Error("Failed to publish event", zap.String("id", ev.ID), zap.Error(err))
+		}
+	} else {
+		err = a.Process(ctx, ev)
+	}
+	if err != nil {
+		a.Dedup.Release(ev.IdempotencyKey)
+	}
+	return err
+}
+
+// Process routes the event and delivers it to every matching destination.
+// Destinations of coalescing, aggregating and delaying rules receive the
+// merged event of the burst, the aggregate of the window or a copy of the
+// event later, see hold. The event first cancels the pending deliveries of
+// delaying rules it matches a cancel of.
+// All destinations are attempted, the returned error joins the failures.
+// Destinations which already received the event are skipped, so a retried
+// event only goes to those that failed.
+func (a *App) Process(ctx context.Context, ev events.Event) error {
+	rec, ok := a.History.Get(ev.ID)
+	if !ok {
+		// Received by another replica
+		a.History.Add(ev)
+	}
+
+	destinations, held, tags := a.Router.Plan(ev)
+	ev.Tags = append(ev.Tags, tags...)
+	switch {
+	case ev.Coalesced != nil:
+		// The merged event of a burst only goes to the destinations its rule held
+		destinations = coalescedDestinations(ev, held)
+		held = nil
+	case ev.Delayed != nil:
+		// The delayed copy only goes to the destinations of its rule
+		destinations, held = a.delayedDestinations(ev), nil
+	case ev.Aggregated != nil:
+		destinations, tags = a.aggregateDestinations(ev)
+		ev.Tags, held = tags, nil
+	default:
+		if err := a.cancelDelayed(ev); err != nil {
+			return err
+		}
+	}
+	if len(destinations) > 0 {
+		var err error
+		if ev, err = a.enrich(ctx, ev); err != nil {
+			return err
+		}
+	}
+	a.History.Routed(ev, len(destinations)+len(held))
+	if len(destinations) == 0 && len(held) == 0 {
+		a.Obs.Info("No route for event",
+			zap.String("id", ev.ID), zap.String("source", ev.Source), zap.String("type", ev.Type))
+		return nil
+	}
+	if err := a.hold(ev, held); err != nil {
+		return err
+	}
+	if len(destinations) == 0 {
+		a.History.Held(ev.ID)
+		return nil
+	}
+
+	pending := destinations[:0:0]
+	for _, d := range destinations {
+		if !a.delivered(ev.ID, rec.Attempts, d.Name()) {
+			pending = append(pending, d)
+		}
+	}
+	return a.deliver(ctx, ev, pending, "")
+}
+
+// enrich runs the enrichment stages of the rules matching the event.
+func (a *App) enrich(ctx context.Context, ev events.Event) (events.Event, error) {
+	for _, stage := range a.Router.Enrichments(ev) {
+		switch stage {
+		case routing.EnrichGraph:
+			if ev.Source != graph.Source {
+				continue
+			}
+			if a.Graph == nil {
+				a.Obs.Warning("Graph enrichment requested, but GRAPH_CLIENT_ID is not set", zap.String("id", ev.ID))
+				continue
+			}
+			enriched, err := a.Graph.Enrich(ctx, ev)
+			if err != nil {
+				a.Obs.Error("Graph enrichment failed", zap.String("id", ev.ID), zap.Error(err))
+				return ev, fmt.Errorf("graph enrichment: %w", err)
+			}
+			ev = enriched
+		}
+	}
+	return ev, nil
+}
+
+// delivered reports whether an attempt to the destination succeeded. With
+// the event stream the attempts of the other replicas count too.
+func (a *App) delivered(id string, attempts []history.Attempt, destination string) bool {
+	for _, at := range attempts {
+		if at.Destination == destination && at.Success && !at.Replay {
+			return true
+		}
+	}
+	if a.Bus == nil {
+		return false
+	}
+	ok, err := a.Bus.Delivered(id, destination)
+	if err != nil {
+		a.Obs.Warning("Unable to look up the deliveries of other replicas, delivering again",
+			zap.String("id", id), zap.String("destination", destination), zap.Error(err))
+	}
+	return ok
+}
+
+// CloudEvent returns the CloudEvents envelope of the event.
+func (a *App) CloudEvent(ev events.Event) cloudevents.Event {
+	return cloudevents.FromEvent(ev, a.cloudEvents)
+}
+
+// ErrEventNotFound is returned when an event is not in the history.
+var ErrEventNotFound = errors.New("event not found")
+
+// ErrReservedSource is returned by Emit for received events using the
+// source of aggregates or schedules.
+var ErrReservedSource = errors.New("source is reserved for the events of the emitter")
+
+// Redeliver pushes an event from the history through the active routing
+// again. When destinations is not empty, only those of the routed
+// destinations are used. With dryRun nothing is delivered. The attempts are
+// recorded as replays by actor. The names of the destinations are returned.
+func (a *App) Redeliver(ctx context.Context, id string, destinations []string, dryRun bool, actor string) ([]string, error) {
+	rec, ok := a.History.Get(id)
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	ev := rec.Event
+	if rec.Status == history.StatusQuarantined {
+		var quarantine bool
+		var err error
+		if ev, quarantine, err = a.resolveTenant(ev, false); err != nil {
+			return nil, err
+		}
+		if quarantine {
+			return nil, fmt.Errorf("%w %q", ErrUnknownTenant, ev.Tenant)
+		}
+		if !dryRun {
+			a.History.Routed(ev, 1)
+		}
+	}
+
+	routed, _ := a.Router.Route(ev)
+	if len(destinations) > 0 {
+		byName := make(map[string]routing.Destination, len(routed))
+		for _, d := range routed {
+			byName[d.Name()] = d
+		}
+		routed = routed[:0]
+		var missing []string
+		for _, name := range destinations {
+			if d, ok := byName[name]; ok {
+				routed = append(routed, d)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("the event is not routed to %s", strings.Join(missing, ", "))
+		}
+	}
+
+	names := make([]string, 0, len(routed))
+	for _, d := range routed {
+		names = append(names, d.Name())
+	}
+	if dryRun {
+		return names, nil
+	}
+
+	a.Obs.Info("Redelivering event",
+		zap.String("id", ev.ID), zap.Strings("destinations", names), zap.String("actor", actor))
+	return names, a.deliver(ctx, ev, routed, actor)
+}
+
+// deliver sends the event to each destination and records the attempts.
+// A non empty replayedBy marks the attempts as a manual replay.
+func (a *App) deliver(ctx context.Context, ev events.Event, destinations []routing.Destination, replayedBy string) error {
+	var errs []error
+	for _, d := range destinations {
+		start := time.Now()
+		err := d.Deliver(ctx, ev)
+		attempt := history.Attempt{
+			Destination: d.Name(),
+			Time:        start.UTC(),
+			DurationMs:  time.Since(start).Milliseconds(),
+			Success:     err == nil,
+			Replay:      replayedBy != "",
+			ReplayedBy:  replayedBy,
+		}
+		if err != nil {
+			attempt.Error = err.Error()
+			a.Obs.Error("Delivery failed",
+				zap.String("id", ev.ID), zap.String("destination", d.Name()), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", d.Name(), err))
+		} else {
+			a.Obs.Verbose("Event delivered", zap.String("id", ev.ID), zap.String("destination", d.Name()))
+			if a.Bus != nil && replayedBy == "" {
+				if err := a.Bus.RecordDelivery(ev.ID, d.Name()); err != nil {
+					a.Obs.Warning("Unable to record the delivery for the other replicas",
+						zap.String("id", ev.ID), zap.String("destination", d.Name()), zap.Error(err))
+				}
+			}
+		}
+		a.History.AddAttempt(ev.ID, attempt)
+	}
+	return errors.Join(errs...)
+}
+
+// Start runs the background tasks of the app until ctx is done.
+func (a *App) Start(ctx context.Context) {
+	go func() {
+		if err := a.Router.Watch(ctx); err != nil {
+			a.Obs.Warning("Not watching routing configuration", zap.Error(err))
+		}
+	}()
+	go a.History.Prune(ctx, time.Hour)
+	go a.Dedup.Expire(ctx, time.Minute)
+	go a.Coalescer.Run(ctx, time.Second, func(err error) {
+		a.Obs.Error("Failed to flush coalesced events", zap.Error(err))
+	})
+	go a.Aggregator.Run(ctx, time.Second, func(err error) {
+		a.Obs.Error("Failed to emit aggregates", zap.Error(err))
+	})
+	go a.Delays.Run(ctx, time.Second, func(err error) {
+		a.Obs.Error("Failed to make delayed deliveries", zap.Error(err))
+	})
+	if a.GraphDelta != nil {
+		viper.SetDefault("GRAPH_DELTA_INTERVAL", "1h")
+		go a.GraphDelta.Run(ctx, viper.GetDuration("GRAPH_DELTA_INTERVAL"))
+	}
+	if a.Bus != nil {
+		go func() {
+			if err := a.Bus.Consume(ctx, a.Process); err != nil {
+				a.Obs.Error("Not consuming the event stream", zap.Error(err))
+			}
+		}()
+		go func() {
+			if err := a.Bus.DeadLetters(ctx); err != nil {
+				a.Obs.Error("Not handling dead letters", zap.Error(err))
+			}
+		}()
+	}
+}
+
+// StartScheduler fires the schedules until ctx is done. Only the serve
+// command runs the scheduler, so workers do not fire schedules.
+func (a *App) StartScheduler(ctx context.Context) {
+	viper.SetDefault("SCHEDULER_INTERVAL", "1s")
+	go a.Scheduler.Run(ctx, viper.GetDuration("SCHEDULER_INTERVAL"))
+}
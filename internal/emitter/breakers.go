@@ -0,0 +1,158 @@
+package emitter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/breaker"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"go.uber.org/zap"
+)
+
+// ErrDestinationNotFound is returned for destinations missing in the active
+// configuration.
+var ErrDestinationNotFound = errors.New("destination not found")
+
+// circuitStates are the values of the emit_destination_circuit_state gauge.
+var circuitStates = map[string]float64{breaker.Closed: 0, breaker.HalfOpen: 1, breaker.Open: 2}
+
+// breakers keeps the circuit breakers of the destinations across
+// configuration reloads, so an open circuit stays open.
+type breakers struct {
+	app *App
+
+	mu       sync.Mutex
+	breakers map[string]*breaker.Breaker
+}
+
+func newBreakers(app *App) *breakers {
+	return &breakers{app: app, breakers: map[string]*breaker.Breaker{}}
+}
+
+func breakerSettings(cfg routing.BreakerConfig) breaker.Settings {
+	return breaker.Settings{
+		FailureRatio: cfg.FailureRatio,
+		MinRequests:  cfg.MinRequests,
+		Window:       cfg.Window,
+		CoolDown:     cfg.CoolDown,
+		Probes:       cfg.Probes,
+	}
+}
+
+// get returns the breaker of a destination, nil when it is disabled.
+func (b *breakers) get(name string, cfg routing.BreakerConfig) *breaker.Breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.Disabled {
+		if br, ok := b.breakers[name]; ok {
+			br.Reset()
+			delete(b.breakers, name)
+		}
+		return nil
+	}
+	if br, ok := b.breakers[name]; ok {
+		br.Configure(breakerSettings(cfg))
+		return br
+	}
+	br := breaker.New(breakerSettings(cfg), func(from, to string) {
+		b.app.metrics.circuitState.WithLabelValues(name).Set(circuitStates[to])
+		if to == breaker.Open {
+			b.app.Obs.Warning("Circuit of destination opened, deliveries go to the retry path",
+				zap.String("destination", name), zap.String("from", from))
+		} else {
+			b.app.Obs.Info("Circuit of destination changed",
+				zap.String("destination", name), zap.String("from", from), zap.String("to", to))
+		}
+	})
+	b.app.metrics.circuitState.WithLabelValues(name).Set(circuitStates[breaker.Closed])
+	b.breakers[name] = br
+	return br
+}
+
+// lookup returns the breaker of a destination without creating it.
+func (b *breakers) lookup(name string) (*breaker.Breaker, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.breakers[name]
+	return br, ok
+}
+
+// DestinationStatus describes the health of a destination.
+type DestinationStatus struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Circuit     *breaker.Status `json:"circuit,omitempty"` // Not set when the breaker is disabled
+	PausedUntil time.Time       `json:"pausedUntil,omitempty"`
+	InFlight    int             `json:"inFlight"`
+}
+
+// Destinations returns the status of the destinations of the active
+// configuration, sorted by name.
+func (a *App) Destinations() []DestinationStatus {
+	rs := a.Router.Current()
+	statuses := make([]DestinationStatus, 0, len(rs.Config.Destinations))
+	for _, cfg := range rs.Config.Destinations {
+		st := DestinationStatus{Name: cfg.Name, Type: cfg.Type}
+		if !cfg.Breaker.Disabled {
+			circuit := breaker.Status{State: breaker.Closed}
+			if br, ok := a.breakers.lookup(cfg.Name); ok {
+				circuit = br.Status()
+			}
+			st.Circuit = &circuit
+		}
+		limiter := a.throttles.get("destination:"+cfg.Name, cfg.Limits)
+		if until := limiter.PausedUntil(); until.After(time.Now()) {
+			st.PausedUntil = until
+		}
+		st.InFlight = limiter.InFlight()
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// ResetCircuit closes the circuit of a destination.
+func (a *App) ResetCircuit(name string) error {
+	rs := a.Router.Current()
+	if _, ok := rs.Destinations[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrDestinationNotFound, name)
+	}
+	if br, ok := a.breakers.lookup(name); ok {
+		br.Reset()
+	}
+	a.Obs.Info("Circuit of destination reset", zap.String("destination", name))
+	return nil
+}
+
+// ReadyHandler reports the circuits of the destinations. It answers 503
+// only when every destination with a breaker is open, so a replica with
+// a single failing destination keeps receiving events for the others.
+func (a *App) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	circuits := map[string]string{}
+	open, guarded := 0, 0
+	for _, st := range a.Destinations() {
+		if st.Circuit == nil {
+			continue
+		}
+		guarded++
+		circuits[st.Name] = st.Circuit.State
+		if st.Circuit.State == breaker.Open {
+			open++
+		}
+	}
+	status := "ready"
+	code := http.StatusOK
+	if guarded > 0 && open == guarded {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	} else if open > 0 {
+		status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "destinations": circuits})
+}
@@ -0,0 +1,68 @@
+package emitter
+
+import (
+	"context"
+
+	"github.com/nexi-intra/koksmat-emit/internal/coalesce"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"go.uber.org/zap"
+)
+
+// hold adds the event to the bursts of the coalescing rules, to the windows
+// of the aggregating rules and to the deliveries of the delaying rules it
+// matched.
+func (a *App) hold(ev events.Event, held []routing.Held) error {
+	for _, h := range held {
+		switch {
+		case h.Rule.Aggregate != nil:
+			if err := a.aggregate(ev, h); err != nil {
+				return err
+			}
+			continue
+		case h.Rule.Delay != nil:
+			if err := a.delay(ev, h); err != nil {
+				return err
+			}
+			continue
+		}
+		c := h.Rule.Coalesce
+		g, err := a.Coalescer.Add(h.Rule.Name, h.Key, c.Quiet, c.MaxWait, ev)
+		if err != nil {
+			a.Obs.Error("Failed to hold event for coalescing",
+				zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.Error(err))
+			return err
+		}
+		a.metrics.coalesced.WithLabelValues(h.Rule.Name).Inc()
+		a.Obs.Verbose("Event held for coalescing",
+			zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.String("key", h.Key),
+			zap.Int("count", g.Count), zap.Time("due", g.Due))
+	}
+	return nil
+}
+
+// flushCoalesced emits the merged event of a burst. It takes the same way
+// as received events, but only to the destinations held by its rule.
+func (a *App) flushCoalesced(ctx context.Context, g coalesce.Group) error {
+	ev := g.Merged()
+	if _, ok := a.History.Get(ev.ID); !ok {
+		a.History.Add(ev)
+	}
+	a.Obs.Info("Emitting coalesced event",
+		zap.String("id", ev.ID), zap.String("rule", g.Rule), zap.String("key", g.Key), zap.Int("count", g.Count))
+	if a.Bus != nil {
+		return a.Bus.Publish(ev)
+	}
+	return a.Process(ctx, ev)
+}
+
+// coalescedDestinations returns the destinations held by the rule of a
+// merged event.
+func coalescedDestinations(ev events.Event, held []routing.Held) []routing.Destination {
+	for _, h := range held {
+		if h.Rule.Name == ev.Coalesced.Rule {
+			return h.Destinations
+		}
+	}
+	return nil
+}
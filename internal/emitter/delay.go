@@ -0,0 +1,81 @@
+package emitter
+
+import (
+	"context"
+
+	"github.com/nexi-intra/koksmat-emit/internal/delay"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"go.uber.org/zap"
+)
+
+// delay holds the event for the destinations of a delaying rule.
+func (a *App) delay(ev events.Event, h routing.Held) error {
+	due, err := h.Rule.Delay.Due(ev)
+	if err != nil {
+		a.Obs.Warning("Invalid delivery time, using the delay of the rule",
+			zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.Error(err))
+	}
+	d, held, err := a.Delays.Add(h.Rule.Name, h.Key, due, ev)
+	if err != nil {
+		a.Obs.Error("Failed to delay event",
+			zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.Error(err))
+		return err
+	}
+	if !held {
+		a.Obs.Info("Delayed delivery already cancelled by a later event",
+			zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.String("key", h.Key))
+		return nil
+	}
+	a.metrics.delayed.WithLabelValues(h.Rule.Name).Inc()
+	a.Obs.Verbose("Event delayed",
+		zap.String("id", ev.ID), zap.String("rule", h.Rule.Name), zap.String("key", h.Key), zap.Time("due", d.Due))
+	return nil
+}
+
+// cancelDelayed cancels the pending deliveries of the delaying rules whose
+// cancels the event matches.
+func (a *App) cancelDelayed(ev events.Event) error {
+	for _, c := range a.Router.Current().Cancellations(ev) {
+		cancelled, err := a.Delays.Cancel(c.Rule, c.Key, ev.Time)
+		if err != nil {
+			a.Obs.Error("Failed to cancel delayed deliveries",
+				zap.String("id", ev.ID), zap.String("rule", c.Rule), zap.String("key", c.Key), zap.Error(err))
+			return err
+		}
+		a.metrics.delayCancels.WithLabelValues(c.Rule).Inc()
+		for _, d := range cancelled {
+			a.Obs.Info("Delayed delivery cancelled",
+				zap.String("id", d.Event.ID), zap.String("rule", d.Rule), zap.String("key", d.Key),
+				zap.String("cancelledBy", ev.ID))
+		}
+	}
+	return nil
+}
+
+// emitDelayed emits the copy of a due delivery. It takes the same way as
+// received events, but only to the destinations of its rule.
+func (a *App) emitDelayed(ctx context.Context, d delay.Delivery) error {
+	ev := d.Delayed()
+	if _, ok := a.History.Get(ev.ID); !ok {
+		a.History.Add(ev)
+	}
+	a.Obs.Info("Emitting delayed event",
+		zap.String("id", ev.ID), zap.String("event", d.Event.ID), zap.String("rule", d.Rule), zap.String("key", d.Key))
+	if a.Bus != nil {
+		return a.Bus.Publish(ev)
+	}
+	return a.Process(ctx, ev)
+}
+
+// delayedDestinations returns the destinations of the rule of a delayed
+// copy.
+func (a *App) delayedDestinations(ev events.Event) []routing.Destination {
+	rule, ok := a.Router.Current().Rule(ev, ev.Delayed.Rule)
+	if !ok || rule.Delay == nil {
+		a.Obs.Warning("Delaying rule of delayed event no longer exists",
+			zap.String("id", ev.ID), zap.String("rule", ev.Delayed.Rule))
+		return nil
+	}
+	return rule.Destinations
+}
@@ -0,0 +1,380 @@
+package emitter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nexi-intra/koksmat-emit/internal/bus"
+	"github.com/nexi-intra/koksmat-emit/internal/cloudevents"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"github.com/nexi-intra/koksmat-emit/services"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultMixSubject   = "magic-mix.app"
+	defaultMixProcedure = "create_event"
+	defaultMixTimeout   = 5 * time.Second
+
+	defaultNATSSubject = "koksmat.emit.{source}.{type}"
+)
+
+// Headers of the messages published by the nats destination.
+const (
+	HeaderEventID      = "Emit-Id"
+	HeaderEventSource  = "Emit-Source"
+	HeaderEventType    = "Emit-Type"
+	HeaderEventSubject = "Emit-Subject"
+	HeaderEventTenant  = "Emit-Tenant"
+	HeaderCorrelation  = "Emit-Correlation-Id"
+	HeaderTraceParent  = "traceparent"
+	HeaderTraceState   = "tracestate"
+)
+
+// newDestination is the routing.Factory of the emitter. It knows the
+// destination types which can be declared in the configuration file, and
+// applies the delivery limits and the circuit breaker to all of them.
+func (a *App) newDestination(cfg routing.DestinationConfig) (routing.Destination, error) {
+	d, err := a.buildDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &guardedDestination{Destination: d, app: a, limits: cfg.Limits, breaker: cfg.Breaker}, nil
+}
+
+func (a *App) buildDestination(cfg routing.DestinationConfig) (routing.Destination, error) {
+	switch cfg.Type {
+	case "magicmix":
+		return newMagicMixDestination(a, cfg)
+	case "github-workflow":
+		return newGitHubWorkflowDestination(cfg)
+	case "nats":
+		return newNATSDestination(a, cfg)
+	case "http":
+		return newHTTPDestination(a, cfg)
+	default:
+		return nil, fmt.Errorf("unknown destination type %q", cfg.Type)
+	}
+}
+
+// option returns the named option or def when it is not set.
+func option(cfg routing.DestinationConfig, name string, def string) string {
+	if v, ok := cfg.Options[name]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// durationOption parses the named option as a time.Duration.
+func durationOption(cfg routing.DestinationConfig, name string, def time.Duration) (time.Duration, error) {
+	v := option(cfg, name, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// magicMixDestination stores events in MagicMix using the create_event
+// procedure.
+//
+// Options: subject, procedure, timeout.
+type magicMixDestination struct {
+	app       *App
+	name      string
+	subject   string
+	procedure string
+	timeout   time.Duration
+}
+
+func newMagicMixDestination(app *App, cfg routing.DestinationConfig) (*magicMixDestination, error) {
+	timeout, err := durationOption(cfg, "timeout", defaultMixTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &magicMixDestination{
+		app:       app,
+		name:      cfg.Name,
+		subject:   option(cfg, "subject", defaultMixSubject),
+		procedure: option(cfg, "procedure", defaultMixProcedure),
+		timeout:   timeout,
+	}, nil
+}
+
+func (d *magicMixDestination) Name() string {
+	return d.name
+}
+
+// Deliver saves the event, using the MagicMix subject of the event's tenant
+// when it has one.
+func (d *magicMixDestination) Deliver(ctx context.Context, ev events.Event) error {
+	subject := d.subject
+	if t, ok := d.app.Router.Current().Tenants[ev.Tenant]; ok && t.Config.MagicMixSubject != "" {
+		subject = t.Config.MagicMixSubject
+	}
+	return d.app.saveRecord(subject, d.procedure, newEventRecord(d.app.CloudEvent(ev), ev), d.timeout)
+}
+
+// newEventRecord maps the envelope of an event to the record of the
+// create_event procedure.
+func newEventRecord(ce cloudevents.Event, ev events.Event) EventRecord {
+	description := ce.Type
+	if ce.Subject != "" {
+		description += " " + ce.Subject
+	}
+	return EventRecord{
+		Tenant:      ev.Tenant,
+		Searchindex: ce.Subject,
+		Name:        ce.Type,
+		Description: description,
+		Source:      ce.Source,
+		Tag:         ev.Source,
+		Payload:     ce.Data,
+	}
+}
+
+// gitHubWorkflowDestination triggers a GitHub Actions workflow_dispatch.
+//
+// Options: owner, repo, workflow, ref (default main), token_env (name of the
+// setting holding the token, default GITHUB_PAT) and event_input (name of a
+// workflow input receiving the event as JSON, omitted when empty).
+type gitHubWorkflowDestination struct {
+	name       string
+	owner      string
+	repo       string
+	workflow   string
+	ref        string
+	tokenEnv   string
+	eventInput string
+}
+
+func newGitHubWorkflowDestination(cfg routing.DestinationConfig) (*gitHubWorkflowDestination, error) {
+	d := &gitHubWorkflowDestination{
+		name:       cfg.Name,
+		owner:      option(cfg, "owner", ""),
+		repo:       option(cfg, "repo", ""),
+		workflow:   option(cfg, "workflow", ""),
+		ref:        option(cfg, "ref", "main"),
+		tokenEnv:   option(cfg, "token_env", "GITHUB_PAT"),
+		eventInput: option(cfg, "event_input", ""),
+	}
+	if d.owner == "" || d.repo == "" || d.workflow == "" {
+		return nil, fmt.Errorf("owner, repo and workflow are required")
+	}
+	return d, nil
+}
+
+func (d *gitHubWorkflowDestination) Name() string {
+	return d.name
+}
+
+func (d *gitHubWorkflowDestination) Deliver(ctx context.Context, ev events.Event) error {
+	inputs := map[string]interface{}{}
+	if d.eventInput != "" {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		inputs[d.eventInput] = string(data)
+	}
+	return gitHubRetryAfter(services.TriggerGitHubWorkflow(ctx, d.owner, d.repo, d.workflow, d.ref, inputs, viper.GetString(d.tokenEnv)))
+}
+
+// natsDestination publishes the event to a subject built from its fields,
+// so other services can subscribe to the events they are interested in.
+//
+// Options: subject (template with {source}, {type}, {tenant} and {subject},
+// default koksmat.emit.{source}.{type}), mode (CloudEvents content mode,
+// binary or structured, default binary) and jetstream ("true" to publish
+// with an acknowledgement from a stream covering the subject).
+type natsDestination struct {
+	app       *App
+	name      string
+	subject   string
+	mode      string
+	jetstream bool
+}
+
+func newNATSDestination(app *App, cfg routing.DestinationConfig) (*natsDestination, error) {
+	mode := option(cfg, "mode", cloudevents.ModeBinary)
+	if err := cloudevents.ValidMode(mode); err != nil {
+		return nil, err
+	}
+	return &natsDestination{
+		app:       app,
+		name:      cfg.Name,
+		subject:   option(cfg, "subject", defaultNATSSubject),
+		mode:      mode,
+		jetstream: option(cfg, "jetstream", "false") == "true",
+	}, nil
+}
+
+func (d *natsDestination) Name() string {
+	return d.name
+}
+
+func (d *natsDestination) Deliver(ctx context.Context, ev events.Event) error {
+	msg := nats.NewMsg(bus.ExpandSubject(d.subject, ev))
+	body, headers, err := encodeCloudEvent(d.app.CloudEvent(ev), d.mode)
+	if err != nil {
+		return err
+	}
+	msg.Data = body
+	for name, value := range headers {
+		msg.Header[name] = []string{value}
+	}
+	msg.Header.Set(nats.MsgIdHdr, ev.ID)
+	msg.Header.Set(HeaderEventID, ev.ID)
+	msg.Header.Set(HeaderEventSource, ev.Source)
+	msg.Header.Set(HeaderEventType, ev.Type)
+	if ev.Subject != "" {
+		msg.Header.Set(HeaderEventSubject, ev.Subject)
+	}
+	if ev.Tenant != "" {
+		msg.Header.Set(HeaderEventTenant, ev.Tenant)
+	}
+	if ev.CorrelationID != "" {
+		msg.Header.Set(HeaderCorrelation, ev.CorrelationID)
+	}
+	traceParent, traceState := traceContext(ev)
+	msg.Header[HeaderTraceParent] = []string{traceParent}
+	if traceState != "" {
+		msg.Header[HeaderTraceState] = []string{traceState}
+	}
+
+	client := d.app.Mix.NATS()
+	if !d.jetstream {
+		return client.PublishMsg(msg)
+	}
+	js, err := client.JetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
+
+// encodeCloudEvent returns the body and headers of the envelope in the
+// content mode.
+func encodeCloudEvent(ce cloudevents.Event, mode string) ([]byte, map[string]string, error) {
+	if mode == cloudevents.ModeBinary {
+		body, headers := ce.Binary()
+		return body, headers, nil
+	}
+	body, contentType, err := ce.Structured()
+	return body, map[string]string{"Content-Type": contentType}, err
+}
+
+// httpDestination sends the event as a CloudEvent to an HTTP endpoint.
+//
+// Options: url, method (default POST), mode (binary or structured, default
+// binary), timeout (default 10s) and token_env (name of a setting holding a
+// bearer token, omitted when empty).
+type httpDestination struct {
+	name     string
+	app      *App
+	url      string
+	method   string
+	mode     string
+	tokenEnv string
+	client   *http.Client
+}
+
+func newHTTPDestination(app *App, cfg routing.DestinationConfig) (*httpDestination, error) {
+	timeout, err := durationOption(cfg, "timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	d := &httpDestination{
+		name:     cfg.Name,
+		app:      app,
+		url:      option(cfg, "url", ""),
+		method:   option(cfg, "method", http.MethodPost),
+		mode:     option(cfg, "mode", cloudevents.ModeBinary),
+		tokenEnv: option(cfg, "token_env", ""),
+		client:   &http.Client{Timeout: timeout},
+	}
+	if d.url == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	if err := cloudevents.ValidMode(d.mode); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *httpDestination) Name() string {
+	return d.name
+}
+
+func (d *httpDestination) Deliver(ctx context.Context, ev events.Event) error {
+	body, headers, err := encodeCloudEvent(d.app.CloudEvent(ev), d.mode)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, d.method, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if traceParent, traceState := traceContext(ev); traceParent != "" {
+		req.Header.Set(HeaderTraceParent, traceParent)
+		if traceState != "" {
+			req.Header.Set(HeaderTraceState, traceState)
+		}
+	}
+	if d.tokenEnv != "" {
+		req.Header.Set("Authorization", "Bearer "+viper.GetString(d.tokenEnv))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return retryAfterError(resp, fmt.Errorf("%s %s: %s %s", d.method, d.url, resp.Status, bytes.TrimSpace(detail)))
+	}
+	return nil
+}
+
+// traceContext returns the W3C trace context received with the event. Without
+// one a new span is started in a trace identified by the event ID.
+func traceContext(ev events.Event) (traceParent string, traceState string) {
+	for name, value := range ev.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Traceparent":
+			traceParent = value
+		case "Tracestate":
+			traceState = value
+		}
+	}
+	if traceParent != "" {
+		return traceParent, traceState
+	}
+
+	span := make([]byte, 8)
+	rand.Read(span)
+	traceID := ev.ID
+	if len(traceID) != 32 {
+		sum := make([]byte, 16)
+		rand.Read(sum)
+		traceID = hex.EncodeToString(sum)
+	}
+	return "00-" + traceID + "-" + hex.EncodeToString(span) + "-01", ""
+}
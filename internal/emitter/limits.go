@@ -0,0 +1,175 @@
+package emitter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/ratelimit"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"go.uber.org/zap"
+)
+
+const defaultMaxWait = 30 * time.Second
+
+// throttles keeps the delivery limiters across configuration reloads, so
+// pauses and in-flight deliveries are not forgotten. A limiter is replaced
+// when its limits change.
+type throttles struct {
+	mu       sync.Mutex
+	limiters map[string]*throttle
+}
+
+type throttle struct {
+	limits  routing.LimitConfig
+	limiter *ratelimit.Limiter
+}
+
+func newThrottles() *throttles {
+	return &throttles{limiters: map[string]*throttle{}}
+}
+
+func (t *throttles) get(key string, limits routing.LimitConfig) *ratelimit.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if th, ok := t.limiters[key]; ok && th.limits == limits {
+		return th.limiter
+	}
+	th := &throttle{limits: limits, limiter: ratelimit.NewLimiter(limits.RateLimit, limits.Burst, limits.MaxInFlight)}
+	t.limiters[key] = th
+	return th.limiter
+}
+
+// guardedDestination applies the circuit breaker and the limits of the
+// destination and of the event's tenant, and pauses the destination when
+// the upstream asks for it.
+//
+// While the circuit is open deliveries fail right away with
+// breaker.ErrOpen, so the event goes to the retry path without waiting for
+// the failing upstream.
+type guardedDestination struct {
+	routing.Destination
+	app     *App
+	limits  routing.LimitConfig
+	breaker routing.BreakerConfig
+}
+
+func (d *guardedDestination) Deliver(ctx context.Context, ev events.Event) error {
+	name := d.Name()
+	br := d.app.breakers.get(name, d.breaker)
+	var generation uint64
+	if br != nil {
+		var err error
+		if generation, err = br.Allow(); err != nil {
+			d.app.metrics.shortCircuited.WithLabelValues(name).Inc()
+			return err
+		}
+	}
+
+	err := d.deliver(ctx, ev)
+	if br != nil {
+		switch {
+		case errors.Is(err, ratelimit.ErrThrottled) || ctx.Err() != nil:
+			// Not an outcome of the upstream
+			br.Cancel(generation)
+		default:
+			br.Done(generation, err == nil)
+		}
+	}
+	return err
+}
+
+func (d *guardedDestination) deliver(ctx context.Context, ev events.Event) error {
+	name := d.Name()
+	limiter := d.app.throttles.get("destination:"+name, d.limits)
+	release, err := d.acquire(ctx, limiter, d.limits)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if t, ok := d.app.Router.Current().Tenants[ev.Tenant]; ok && t.Config.Delivery.Limited() {
+		release, err := d.acquire(ctx, d.app.throttles.get("tenant:"+t.Name, t.Config.Delivery), t.Config.Delivery)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	err = d.Destination.Deliver(ctx, ev)
+	var retryAfter *routing.RetryAfterError
+	if errors.As(err, &retryAfter) {
+		limiter.Pause(retryAfter.Until)
+		d.app.metrics.throttled.WithLabelValues(name, "retry_after").Inc()
+		d.app.Obs.Warning("Destination asked to pause",
+			zap.String("destination", name), zap.Time("until", retryAfter.Until))
+	}
+	return err
+}
+
+// acquire waits for the limiter up to the maximum wait of the limits.
+func (d *guardedDestination) acquire(ctx context.Context, limiter *ratelimit.Limiter, limits routing.LimitConfig) (func(), error) {
+	maxWait := limits.MaxWait
+	if maxWait <= 0 {
+		maxWait = defaultMaxWait
+	}
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	queued := d.app.metrics.queued.WithLabelValues(d.Name())
+	queued.Inc()
+	release, waited, err := limiter.Acquire(ctx)
+	queued.Dec()
+	switch {
+	case err != nil:
+		d.app.metrics.throttled.WithLabelValues(d.Name(), "refused").Inc()
+		return nil, err
+	case waited:
+		d.app.metrics.throttled.WithLabelValues(d.Name(), "delayed").Inc()
+	}
+	return release, nil
+}
+
+// retryAfterError returns a RetryAfterError when the response asks to hold
+// back, with Retry-After or an exhausted X-RateLimit-Remaining and its
+// X-RateLimit-Reset.
+func retryAfterError(resp *http.Response, err error) error {
+	if value := resp.Header.Get("Retry-After"); value != "" &&
+		(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if seconds, convErr := strconv.Atoi(value); convErr == nil {
+			return &routing.RetryAfterError{Until: time.Now().Add(time.Duration(seconds) * time.Second), Err: err}
+		}
+		if at, convErr := http.ParseTime(value); convErr == nil {
+			return &routing.RetryAfterError{Until: at, Err: err}
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, convErr := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); convErr == nil {
+			return &routing.RetryAfterError{Until: time.Unix(reset, 0), Err: err}
+		}
+	}
+	return err
+}
+
+// gitHubRetryAfter turns the rate limit errors of the GitHub client into a
+// RetryAfterError.
+func gitHubRetryAfter(err error) error {
+	var rateLimit *github.RateLimitError
+	if errors.As(err, &rateLimit) {
+		return &routing.RetryAfterError{Until: rateLimit.Rate.Reset.Time, Err: err}
+	}
+	var abuse *github.AbuseRateLimitError
+	if errors.As(err, &abuse) {
+		wait := time.Minute
+		if abuse.RetryAfter != nil {
+			wait = *abuse.RetryAfter
+		}
+		return &routing.RetryAfterError{Until: time.Now().Add(wait), Err: err}
+	}
+	return err
+}
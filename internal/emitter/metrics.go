@@ -0,0 +1,98 @@
+package emitter
+
+import (
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the counters of the event pipeline.
+type metrics struct {
+	duplicates       *prometheus.CounterVec
+	tenantRejections *prometheus.CounterVec
+	throttled        *prometheus.CounterVec
+	queued           *prometheus.GaugeVec
+	circuitState     *prometheus.GaugeVec
+	shortCircuited   *prometheus.CounterVec
+	coalesced        *prometheus.CounterVec
+	aggregated       *prometheus.CounterVec
+	delayed          *prometheus.CounterVec
+	delayCancels     *prometheus.CounterVec
+}
+
+func newMetrics(obs *observability.Observability) *metrics {
+	m := &metrics{
+		duplicates: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "emit_duplicate_events_total",
+				Help: "Number of events ignored because their idempotency key was already accepted",
+			},
+			[]string{"source"},
+		),
+		tenantRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "emit_tenant_rejections_total",
+				Help: "Number of events of unknown tenants by policy, or refused by the tenant rate limit",
+			},
+			[]string{"source", "reason"},
+		),
+	}
+	m.throttled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emit_delivery_throttled_total",
+			Help: "Number of deliveries delayed or refused by limits, and pauses asked for by destinations",
+		},
+		[]string{"destination", "reason"},
+	)
+	m.queued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "emit_delivery_queued",
+			Help: "Number of deliveries waiting for their turn",
+		},
+		[]string{"destination"},
+	)
+	m.circuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "emit_destination_circuit_state",
+			Help: "Circuit breaker state of a destination: 0 closed, 1 half-open, 2 open",
+		},
+		[]string{"destination"},
+	)
+	m.shortCircuited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emit_delivery_short_circuited_total",
+			Help: "Number of deliveries refused because the circuit of the destination is open",
+		},
+		[]string{"destination"},
+	)
+	m.coalesced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emit_coalesced_events_total",
+			Help: "Number of events held back by coalescing rules",
+		},
+		[]string{"rule"},
+	)
+	m.aggregated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emit_aggregated_events_total",
+			Help: "Number of events counted in the windows of aggregating rules",
+		},
+		[]string{"rule"},
+	)
+	m.delayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emit_delayed_events_total",
+			Help: "Number of events held back by delaying rules",
+		},
+		[]string{"rule"},
+	)
+	m.delayCancels = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emit_delay_cancellations_total",
+			Help: "Number of events cancelling the pending deliveries of delaying rules",
+		},
+		[]string{"rule"},
+	)
+	obs.MetricsRegistry.MustRegister(m.duplicates, m.tenantRejections, m.throttled, m.queued, m.circuitState,
+		m.shortCircuited, m.coalesced, m.aggregated, m.delayed, m.delayCancels)
+	return m
+}
@@ -0,0 +1,114 @@
+package emitter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Errors of the tenant checks in Emit.
+var (
+	ErrUnknownTenant = errors.New("unknown tenant")
+	ErrTenantSecret  = errors.New("tenant secret does not match")
+	ErrRateLimited   = errors.New("tenant rate limit exceeded")
+)
+
+// resolveTenant replaces the tenant value set by the receiver with the
+// Koksmat tenant from the registry and checks the tenant's secret and rate
+// limit. Without tenants in the configuration the event is unchanged. The
+// returned flag marks an unknown tenant to be quarantined. Allowed events of
+// unknown tenants keep their tenant value, unless it names a tenant.
+func (a *App) resolveTenant(ev events.Event, limit bool) (events.Event, bool, error) {
+	rs := a.Router.Current()
+	if len(rs.Tenants) == 0 {
+		return ev, false, nil
+	}
+
+	t, ok := rs.Tenant(ev)
+	if !ok {
+		policy := rs.UnknownTenantPolicy()
+		a.metrics.tenantRejections.WithLabelValues(ev.Source, policy).Inc()
+		switch policy {
+		case routing.UnknownTenantsReject:
+			a.Obs.Warning("Event of unknown tenant rejected",
+				zap.String("source", ev.Source), zap.String("tenant", ev.Tenant))
+			return ev, false, fmt.Errorf("%w %q", ErrUnknownTenant, ev.Tenant)
+		case routing.UnknownTenantsQuarantine:
+			return ev, true, nil
+		}
+		if _, clash := rs.Tenants[ev.Tenant]; clash {
+			// The tenant name would give the event the rules and settings
+			// of that tenant
+			a.Obs.Warning("Tenant of unknown tenant event cleared, it names a configured tenant",
+				zap.String("source", ev.Source), zap.String("tenant", ev.Tenant))
+			ev.Tenant = ""
+		}
+		return ev, false, nil
+	}
+
+	if setting := t.Config.Secrets[ev.Source]; setting != "" {
+		if err := verifyTenantSecret(ev, viper.GetString(setting)); err != nil {
+			a.Obs.Warning("Event with wrong tenant secret rejected",
+				zap.String("source", ev.Source), zap.String("tenant", t.Name), zap.Error(err))
+			return ev, false, err
+		}
+	}
+	if limit && !t.Allow() {
+		a.metrics.tenantRejections.WithLabelValues(ev.Source, "rate_limited").Inc()
+		return ev, false, fmt.Errorf("%w for %s", ErrRateLimited, t.Name)
+	}
+	ev.Tenant = t.Name
+	return ev, false, nil
+}
+
+// verifyTenantSecret checks the GitHub signature or the Graph client state of
+// the event against the tenant's secret.
+func verifyTenantSecret(ev events.Event, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("%w: secret is not set", ErrTenantSecret)
+	}
+	switch ev.Source {
+	case "github":
+		signature := strings.TrimPrefix(header(ev, "X-Hub-Signature-256"), "sha256=")
+		got, err := hex.DecodeString(signature)
+		if err != nil || signature == "" {
+			return fmt.Errorf("%w: missing or malformed signature", ErrTenantSecret)
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(ev.Payload)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return ErrTenantSecret
+		}
+	case "microsoftgraph":
+		var n struct {
+			ClientState string `json:"clientState"`
+		}
+		json.Unmarshal(ev.Payload, &n)
+		if subtle.ConstantTimeCompare([]byte(n.ClientState), []byte(secret)) != 1 {
+			return ErrTenantSecret
+		}
+	default:
+		return fmt.Errorf("%w: secrets are not supported for %s", ErrTenantSecret, ev.Source)
+	}
+	return nil
+}
+
+// header returns a request header stored with the event.
+func header(ev events.Event, name string) string {
+	for key, value := range ev.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
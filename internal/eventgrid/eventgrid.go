@@ -0,0 +1,150 @@
+// Package eventgrid decodes Azure Event Grid deliveries.
+//
+// Event Grid delivers batches in its own schema or in the CloudEvents 1.0
+// schema. Before delivering events to a webhook it validates the
+// subscription: with the Event Grid schema by sending a
+// SubscriptionValidationEvent, with the CloudEvents schema by the OPTIONS
+// abuse protection handshake.
+package eventgrid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/cloudevents"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+// Source of the normalized events.
+const Source = "eventgrid"
+
+// SubscriptionValidationEvent is the event type of the validation handshake.
+const SubscriptionValidationEvent = "Microsoft.EventGrid.SubscriptionValidationEvent"
+
+// Origin is the WebHook-Request-Origin of the CloudEvents handshake.
+const Origin = "eventgrid.azure.net"
+
+// Event is an event in the Event Grid schema.
+type Event struct {
+	ID              string          `json:"id"`
+	Topic           string          `json:"topic"`
+	Subject         string          `json:"subject"`
+	EventType       string          `json:"eventType"`
+	EventTime       time.Time       `json:"eventTime"`
+	Data            json.RawMessage `json:"data"`
+	DataVersion     string          `json:"dataVersion"`
+	MetadataVersion string          `json:"metadataVersion"`
+
+	raw json.RawMessage
+}
+
+// Validation is the data of a SubscriptionValidationEvent.
+type Validation struct {
+	ValidationCode string `json:"validationCode"`
+	ValidationURL  string `json:"validationUrl,omitempty"`
+}
+
+// Parse decodes a batch in the Event Grid schema. A single event which is
+// not wrapped in an array is accepted as well.
+func Parse(body []byte) ([]Event, error) {
+	body = bytes.TrimSpace(body)
+	var raws []json.RawMessage
+	if len(body) > 0 && body[0] == '{' {
+		raws = []json.RawMessage{body}
+	} else if err := json.Unmarshal(body, &raws); err != nil {
+		return nil, err
+	}
+
+	batch := make([]Event, 0, len(raws))
+	var errs []error
+	for i, raw := range raws {
+		var e Event
+		if err := json.Unmarshal(raw, &e); err != nil {
+			errs = append(errs, fmt.Errorf("event %d: %w", i, err))
+			continue
+		}
+		if e.ID == "" || e.EventType == "" {
+			errs = append(errs, fmt.Errorf("event %d: id and eventType are required", i))
+			continue
+		}
+		e.raw = raw
+		batch = append(batch, e)
+	}
+	return batch, errors.Join(errs...)
+}
+
+// Validate returns the handshake data when the batch is a subscription
+// validation.
+func Validate(batch []Event) (*Validation, bool) {
+	for _, e := range batch {
+		if e.EventType != SubscriptionValidationEvent {
+			continue
+		}
+		var v Validation
+		if err := json.Unmarshal(e.Data, &v); err != nil || v.ValidationCode == "" {
+			return nil, false
+		}
+		return &v, true
+	}
+	return nil, false
+}
+
+// Confirm completes the validation by visiting the validation URL, used
+// when the synchronous response cannot be returned. Only https URLs of Event Grid are visited.
+func Confirm(ctx context.Context, client *http.Client, v *Validation) error {
+	u, err := url.Parse(v.ValidationURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), "."+Origin) {
+		return fmt.Errorf("validation URL %s is not an Event Grid URL", u.Redacted())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.ValidationURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("validation URL returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ToEvent normalizes the event. The payload is the whole Event Grid event,
+// keeping the topic and data version, the subject is the resource path.
+func (e Event) ToEvent() events.Event {
+	ev := events.New(Source, e.EventType, e.raw)
+	ev.Subject = e.Subject
+	if !e.EventTime.IsZero() {
+		ev.Time = e.EventTime.UTC()
+	}
+	ev.IdempotencyKey = Source + ":" + e.ID
+	return ev
+}
+
+// FromCloudEvent normalizes an event delivered in the CloudEvents schema.
+// The payload is the envelope.
+func FromCloudEvent(ce cloudevents.Event) (events.Event, error) {
+	payload, err := json.Marshal(ce)
+	if err != nil {
+		return events.Event{}, err
+	}
+	ev := events.New(Source, ce.Type, payload)
+	ev.Subject = ce.Subject
+	if !ce.Time.IsZero() {
+		ev.Time = ce.Time.UTC()
+	}
+	ev.IdempotencyKey = Source + ":" + ce.ID
+	return ev, nil
+}
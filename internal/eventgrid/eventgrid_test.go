@@ -0,0 +1,95 @@
+package eventgrid
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/nexi-intra/koksmat-emit/internal/cloudevents"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantLen  int
+		wantCode string
+		wantErr  bool
+	}{
+		{
+			name:    "Batch",
+			body:    `[{"id":"1","topic":"/subscriptions/x","subject":"/blobServices/default/containers/c/blobs/a.txt","eventType":"Microsoft.Storage.BlobCreated","eventTime":"2024-05-01T12:00:00Z","data":{"api":"PutBlob"},"dataVersion":"","metadataVersion":"1"},{"id":"2","eventType":"Microsoft.Storage.BlobDeleted","data":{}}]`,
+			wantLen: 2,
+		},
+		{
+			name:     "Validation",
+			body:     `[{"id":"v","eventType":"Microsoft.EventGrid.SubscriptionValidationEvent","data":{"validationCode":"512d38b6","validationUrl":"https://rp-eastus2.eventgrid.azure.net/validate?id=1"}}]`,
+			wantLen:  1,
+			wantCode: "512d38b6",
+		},
+		{
+			name:    "Single event",
+			body:    `{"id":"1","eventType":"Microsoft.KeyVault.SecretNewVersionCreated","data":{}}`,
+			wantLen: 1,
+		},
+		{
+			name:    "Missing event type",
+			body:    `[{"id":"1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Not JSON",
+			body:    `hello`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch, err := Parse([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(batch) != tt.wantLen {
+				t.Fatalf("Parse() returned %d events, want %d", len(batch), tt.wantLen)
+			}
+			v, ok := Validate(batch)
+			if ok != (tt.wantCode != "") || (ok && v.ValidationCode != tt.wantCode) {
+				t.Errorf("Validate() = %v, %v", v, ok)
+			}
+		})
+	}
+}
+
+func TestEvent_ToEvent(t *testing.T) {
+	batch, err := Parse([]byte(`[{"id":"1","subject":"/containers/c/blobs/a.txt","eventType":"Microsoft.Storage.BlobCreated","eventTime":"2024-05-01T12:00:00Z","data":{}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := batch[0].ToEvent()
+	if ev.Source != Source || ev.Type != "Microsoft.Storage.BlobCreated" || ev.Subject != "/containers/c/blobs/a.txt" || ev.IdempotencyKey != "eventgrid:1" {
+		t.Errorf("ToEvent() = %+v", ev)
+	}
+	if ev.Time.Year() != 2024 || len(ev.Payload) == 0 {
+		t.Errorf("ToEvent() time %v payload %s", ev.Time, ev.Payload)
+	}
+
+	ce := cloudevents.Event{SpecVersion: "1.0", ID: "2", Source: "/subscriptions/x", Type: "Microsoft.Storage.BlobDeleted", Subject: "/containers/c"}
+	ev, err = FromCloudEvent(ce)
+	if err != nil {
+		t.Fatalf("FromCloudEvent() error = %v", err)
+	}
+	if ev.Source != Source || ev.Type != ce.Type || ev.IdempotencyKey != "eventgrid:2" {
+		t.Errorf("FromCloudEvent() = %+v", ev)
+	}
+}
+
+func TestConfirm_RejectsForeignURLs(t *testing.T) {
+	for _, u := range []string{"http://rp.eventgrid.azure.net/validate", "https://example.com/validate", "https://eventgrid.azure.net.example.com/"} {
+		if err := Confirm(context.Background(), http.DefaultClient, &Validation{ValidationURL: u}); err == nil {
+			t.Errorf("Confirm(%s) error = nil", u)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package events defines the normalized event that flows from the webhook
+// receivers, through routing, to the destinations.
+package events
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Event is the normalized shape every receiver produces.
+type Event struct {
+	ID      string            `json:"id"`
+	Source  string            `json:"source"`            // Receiver that accepted the event, e.g. "github"
+	Type    string            `json:"type"`              // Source specific type, e.g. "pull_request.closed"
+	Subject string            `json:"subject,omitempty"` // What the event is about, e.g. a repository or Graph resource
+	Tenant  string            `json:"tenant,omitempty"`
+	Tags    []string          `json:"tags,omitempty"` // Added by the routing rules the event matched
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload json.RawMessage   `json:"payload"`
+
+	// CorrelationID groups events received together, e.g. the notifications
+	// of one Graph callback.
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// IdempotencyKey identifies retries of the same event by the sender, e.g.
+	// the GitHub delivery ID. See Key.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Coalesced is set on the event standing for a burst of events merged by
+	// a coalescing rule.
+	Coalesced *Coalesced `json:"coalesced,omitempty"`
+
+	// Delayed is set on the copy of an event delivered later by a delaying
+	// rule.
+	Delayed *Delayed `json:"delayed,omitempty"`
+
+	// Aggregated is set on the event of an aggregation window.
+	Aggregated *Aggregated `json:"aggregated,omitempty"`
+
+	// Envelope is set on events received as CloudEvents. It keeps the
+	// attributes of the sender, so the event is forwarded unchanged.
+	Envelope *Envelope `json:"envelope,omitempty"`
+
+	// Internal marks events the emitter created itself, like schedule runs
+	// and aggregates. Their tenant is a Koksmat tenant name. It is never
+	// decoded, so senders cannot set it.
+	Internal bool `json:"-"`
+}
+
+// Coalesced describes the events merged into one. The merged event carries
+// the payload of the last of them.
+type Coalesced struct {
+	Rule  string    `json:"rule"`
+	Key   string    `json:"key"`
+	Count int       `json:"count"`
+	First time.Time `json:"first"` // Time of the first merged event
+	Last  time.Time `json:"last"`
+}
+
+// Delayed describes the delivery of an event held back by a rule.
+type Delayed struct {
+	Rule    string    `json:"rule"`
+	Key     string    `json:"key"`
+	EventID string    `json:"eventId"` // ID of the original event
+	Due     time.Time `json:"due"`
+}
+
+// Aggregated names the rule and key of an aggregate event.
+type Aggregated struct {
+	Rule string `json:"rule"`
+	Key  string `json:"key"`
+}
+
+// Sources of the events the emitter creates itself. Received events cannot
+// use them, see Reserved.
+const (
+	SourceAggregate = "aggregate"
+	SourceSchedule  = "schedule"
+)
+
+// Reserved reports whether source is kept for the events of the emitter.
+func Reserved(source string) bool {
+	return source == SourceAggregate || source == SourceSchedule
+}
+
+// Envelope holds the CloudEvents attributes of an event as received.
+type Envelope struct {
+	ID              string            `json:"id"`
+	Source          string            `json:"source"`
+	Type            string            `json:"type"`
+	DataContentType string            `json:"datacontenttype,omitempty"`
+	DataSchema      string            `json:"dataschema,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+}
+
+// New creates an event with a fresh ID stamped with the current time.
+func New(source, eventType string, payload []byte) Event {
+	return Event{
+		ID:      NewID(),
+		Source:  source,
+		Type:    eventType,
+		Time:    time.Now().UTC(),
+		Payload: json.RawMessage(payload),
+	}
+}
+
+// Key returns the idempotency key of the event. Without one set by the
+// receiver, the key is derived from the source and a hash of the payload.
+func (e Event) Key() string {
+	if e.IdempotencyKey != "" {
+		return e.IdempotencyKey
+	}
+	sum := sha256.Sum256(e.Payload)
+	return e.Source + ":sha256:" + hex.EncodeToString(sum[:])
+}
+
+// NewID returns a random 128 bit identifier encoded as hex.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,267 @@
+package graph
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/dedup"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+	"go.uber.org/zap"
+)
+
+const (
+	deltaBucket = "graph-delta-links"
+	runsBucket  = "graph-delta-runs"
+)
+
+// Emitter accepts the synthesized events.
+type Emitter func(ctx context.Context, ev events.Event) error
+
+// SyncResult is the outcome of syncing one resource.
+type SyncResult struct {
+	Resource string    `json:"resource"`
+	Emitted  int       `json:"emitted"`
+	Skipped  int       `json:"skipped"` // Already notified through the webhook
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Syncer catches changes missed by change notifications with delta queries.
+//
+// For every tracked resource, e.g. "users" or "groups", the delta link of the
+// last run is kept in the store. A run follows the next links from there,
+// emits an event for every changed object and stores the new delta link.
+// Objects notified through the webhook since the previous run are skipped.
+// The notifications are claimed in the deduper, so they and the time of the
+// previous run survive restarts.
+type Syncer struct {
+	client   *Client
+	store    *store.Store
+	notified *dedup.Deduper
+	emit     Emitter
+	obs      *observability.Observability
+
+	Resources []string
+	// Full makes the first run of a resource emit all its objects. Otherwise
+	// it only records the current state with $deltatoken=latest.
+	Full bool
+	// TenantID is set on the events.
+	TenantID string
+	// MaxPages bounds the pages of one run, default 100.
+	MaxPages int
+
+	mu sync.Mutex // Serializes runs
+}
+
+// NewSyncer returns a Syncer keeping the delta links in st and the webhook
+// notifications in notified.
+func NewSyncer(obs *observability.Observability, client *Client, st *store.Store, notified *dedup.Deduper, emit Emitter, resources []string) *Syncer {
+	return &Syncer{
+		client:    client,
+		store:     st,
+		notified:  notified,
+		emit:      emit,
+		obs:       obs,
+		Resources: resources,
+		MaxPages:  100,
+	}
+}
+
+// resourceKey normalizes resource paths, Graph notifications use
+// "Users/<id>" while delta items are found under "users".
+func resourceKey(path string) string {
+	return strings.ToLower(strings.Trim(path, "/"))
+}
+
+// notifiedKey is the deduper key of the notifications of a resource.
+func notifiedKey(resource string) string {
+	return "graphnotified:" + resourceKey(resource)
+}
+
+// Notified records that a change of the resource was received through the
+// webhook.
+func (s *Syncer) Notified(resource string) {
+	key := notifiedKey(resource)
+	s.notified.Release(key)
+	if _, err := s.notified.Claim(key); err != nil {
+		s.obs.Warning("Graph notification not persisted, the delta sync may emit it again", zap.String("resource", resource), zap.Error(err))
+	}
+}
+
+// notifiedSince reports whether the resource was notified after t.
+func (s *Syncer) notifiedSince(resource string, t time.Time) bool {
+	at, ok := s.notified.Claimed(notifiedKey(resource))
+	return ok && !at.Before(t)
+}
+
+// SyncAll syncs the tracked resources.
+func (s *Syncer) SyncAll(ctx context.Context) []SyncResult {
+	results := make([]SyncResult, 0, len(s.Resources))
+	for _, resource := range s.Resources {
+		results = append(results, s.Sync(ctx, resource))
+	}
+	return results
+}
+
+// Sync emits the changes of a resource since its stored delta link.
+func (s *Syncer) Sync(ctx context.Context, resource string) SyncResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resource = strings.Trim(resource, "/")
+	key := resourceKey(resource)
+	result := SyncResult{Resource: resource, At: time.Now().UTC()}
+	var since time.Time
+	if _, err := s.store.Get(runsBucket, key, &since); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	started := time.Now()
+
+	var link string
+	if _, err := s.store.Get(deltaBucket, key, &link); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	initial := link == ""
+	if initial {
+		link = s.client.url(resource + "/delta")
+		if !s.Full {
+			link += "?$deltatoken=latest"
+		}
+	}
+
+	for page := 0; ; page++ {
+		if page >= s.MaxPages {
+			s.obs.Warning("More Graph delta pages than fetched, continuing with the next run", zap.String("resource", resource))
+			break
+		}
+		body, _, err := s.client.fetch(ctx, link, "")
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		var delta struct {
+			Value     []json.RawMessage `json:"value"`
+			NextLink  string            `json:"@odata.nextLink"`
+			DeltaLink string            `json:"@odata.deltaLink"`
+		}
+		if err := json.Unmarshal(body, &delta); err != nil {
+			result.Error = fmt.Sprintf("delta response: %v", err)
+			return result
+		}
+
+		for _, item := range delta.Value {
+			ev, path, err := s.deltaEvent(resource, item)
+			if err != nil {
+				result.Error = err.Error()
+				return result
+			}
+			if s.notifiedSince(path, since) {
+				result.Skipped++
+				continue
+			}
+			if err := s.emit(ctx, ev); err != nil {
+				// The page is fetched again by the next run
+				result.Error = err.Error()
+				return result
+			}
+			result.Emitted++
+		}
+
+		next := delta.NextLink
+		if next == "" {
+			next = delta.DeltaLink
+		}
+		if next == "" {
+			result.Error = "delta response without next or delta link"
+			return result
+		}
+		if err := s.store.Put(deltaBucket, key, next); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		link = next
+		if delta.NextLink == "" {
+			break
+		}
+	}
+
+	if err := s.store.Put(runsBucket, key, started); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// deltaEvent builds the event of a changed object. The payload has the shape
+// of a change notification, with the object as "resourceContent" so it is
+// not fetched again by enrichment.
+func (s *Syncer) deltaEvent(resource string, item json.RawMessage) (events.Event, string, error) {
+	var object struct {
+		ID      string          `json:"id"`
+		Type    string          `json:"@odata.type"`
+		Removed json.RawMessage `json:"@removed"`
+	}
+	if err := json.Unmarshal(item, &object); err != nil {
+		return events.Event{}, "", fmt.Errorf("delta item: %w", err)
+	}
+	path := resource + "/" + object.ID
+	changeType := "updated"
+	notification := map[string]interface{}{
+		"resource": path,
+		"resourceData": map[string]string{
+			"@odata.type": object.Type,
+			"@odata.id":   path,
+			"id":          object.ID,
+		},
+		"tenantId":    s.TenantID,
+		"synthesized": true,
+	}
+	if object.Removed != nil {
+		changeType = "deleted"
+		notification["resourceDeleted"] = true
+	} else {
+		notification["resourceContent"] = item
+	}
+	notification["changeType"] = changeType
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return events.Event{}, "", err
+	}
+	ev := events.New(Source, changeType, payload)
+	ev.Subject = path
+	ev.Tenant = s.TenantID
+	sum := sha256.Sum256(item)
+	ev.IdempotencyKey = "graphdelta:" + resourceKey(path) + "|" + hex.EncodeToString(sum[:])
+	return ev, path, nil
+}
+
+// Run syncs the tracked resources every interval until ctx is done.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, result := range s.SyncAll(ctx) {
+			if result.Error != "" {
+				s.obs.Error("Graph delta sync failed", zap.String("resource", result.Resource), zap.String("error", result.Error))
+			} else if result.Emitted > 0 {
+				s.obs.Info("Graph delta sync emitted missed changes",
+					zap.String("resource", result.Resource), zap.Int("emitted", result.Emitted), zap.Int("skipped", result.Skipped))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/azuread"
+	"github.com/nexi-intra/koksmat-emit/internal/dedup"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+// deltaStub starts users at token "t0" and has two pages of changes after it.
+func deltaStub(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/delta" {
+			t.Errorf("GET %s", r.URL.Path)
+		}
+		link := server.URL + "/users/delta?$deltatoken="
+		switch token := r.URL.Query().Get("$deltatoken") + r.URL.Query().Get("$skiptoken"); token {
+		case "latest":
+			fmt.Fprintf(w, `{"value":[],"@odata.deltaLink":%q}`, link+"t0")
+		case "t0":
+			fmt.Fprintf(w, `{"value":[{"id":"1","displayName":"Ada"},{"id":"2","displayName":"Bob"}],"@odata.nextLink":%q}`,
+				server.URL+"/users/delta?$skiptoken=p2")
+		case "p2":
+			fmt.Fprintf(w, `{"value":[{"id":"3","@removed":{"reason":"changed"}}],"@odata.deltaLink":%q}`, link+"t1")
+		case "t1":
+			fmt.Fprintf(w, `{"value":[],"@odata.deltaLink":%q}`, link+"t1")
+		default:
+			t.Errorf("unexpected token %q", token)
+		}
+	}))
+	return server
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	server := deltaStub(t)
+	defer server.Close()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, _ := observability.NewObservability()
+	var emitted []events.Event
+	emit := func(ctx context.Context, ev events.Event) error {
+		emitted = append(emitted, ev)
+		return nil
+	}
+	client := &Client{BaseURL: server.URL, Tokens: azuread.StaticToken("token")}
+	newSyncer := func() *Syncer {
+		d, err := dedup.New(time.Hour, st)
+		if err != nil {
+			t.Fatalf("dedup.New() error = %v", err)
+		}
+		return NewSyncer(obs, client, st, d, emit, []string{"users"})
+	}
+	s := newSyncer()
+	ctx := context.Background()
+
+	// The first run only records the current state
+	if result := s.Sync(ctx, "users"); result.Error != "" || result.Emitted != 0 {
+		t.Fatalf("Sync() first run = %+v", result)
+	}
+
+	// User 2 was already received through the webhook, before a restart
+	s.Notified("Users/2")
+	s = newSyncer()
+	result := s.Sync(ctx, "users")
+	if result.Error != "" {
+		t.Fatalf("Sync() error = %v", result.Error)
+	}
+	if result.Emitted != 2 || result.Skipped != 1 {
+		t.Errorf("Sync() emitted %d and skipped %d, want 2 and 1", result.Emitted, result.Skipped)
+	}
+	if len(emitted) != 2 {
+		t.Fatalf("Sync() emitted %d events, want 2", len(emitted))
+	}
+	if ev := emitted[0]; ev.Source != Source || ev.Type != "updated" || ev.Subject != "users/1" {
+		t.Errorf("Sync() event = %+v", ev)
+	}
+	if ev := emitted[1]; ev.Type != "deleted" || ev.Subject != "users/3" {
+		t.Errorf("Sync() removed event = %+v", ev)
+	}
+
+	// The delta link continues after the last page
+	emitted = nil
+	if result := s.Sync(ctx, "users"); result.Error != "" || len(emitted) != 0 {
+		t.Errorf("Sync() again = %+v, emitted %d", result, len(emitted))
+	}
+}
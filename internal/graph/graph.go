@@ -0,0 +1,244 @@
+// Package graph fetches the resources Microsoft Graph change notifications
+// refer to, so the events carry the changed object.
+//
+// Responses are cached by etag: a notification with the etag of the cached
+// object is answered from the cache, otherwise the object is requested with
+// If-None-Match. Throttled requests are retried after Retry-After.
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/azuread"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+// Source of the events of Graph change notifications.
+const Source = "microsoftgraph"
+
+// DefaultBaseURL is the Graph endpoint used without configuration.
+const DefaultBaseURL = "https://graph.microsoft.com/v1.0"
+
+// ErrNotFound is returned for resources which no longer exist.
+var ErrNotFound = errors.New("resource not found")
+
+// Client reads resources from Graph.
+type Client struct {
+	BaseURL    string
+	Tokens     azuread.TokenSource
+	HTTPClient *http.Client
+	MaxRetries int // Retries of throttled requests, default 3
+	CacheSize  int // Cached resources, default 1000
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	etag string
+	body json.RawMessage
+}
+
+// Get returns the resource at path, relative to the base URL. A non empty
+// etag which matches the cached copy avoids the request.
+func (c *Client) Get(ctx context.Context, path, etag string) (json.RawMessage, error) {
+	c.mu.Lock()
+	hit, ok := c.cache[path]
+	c.mu.Unlock()
+	if ok && etag != "" && hit.etag == etag {
+		return hit.body, nil
+	}
+
+	body, responseETag, err := c.fetch(ctx, c.url(path), hit.etag)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		// Not modified
+		return hit.body, nil
+	}
+	c.store(path, responseETag, body)
+	return body, nil
+}
+
+// url returns the absolute URL of a path relative to the base URL.
+func (c *Client) url(path string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// fetch requests url and retries throttled requests. A nil body without
+// error means not modified.
+func (c *Client) fetch(ctx context.Context, url, ifNoneMatch string) (json.RawMessage, string, error) {
+	retries := c.MaxRetries
+	if retries == 0 {
+		retries = 3
+	}
+	for attempt := 0; ; attempt++ {
+		body, etag, retryAfter, err := c.get(ctx, url, ifNoneMatch)
+		if err == nil || retryAfter == 0 || attempt >= retries {
+			return body, etag, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("%w, retry after %s", err, retryAfter)
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// get performs one request. A nil body with no error means not modified. A
+// positive retryAfter marks a throttled request.
+func (c *Client) get(ctx context.Context, url, ifNoneMatch string) (json.RawMessage, string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	token, err := c.Tokens.Token(ctx)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if !json.Valid(body) {
+			return nil, "", 0, fmt.Errorf("GET %s: response is not JSON", req.URL.Path)
+		}
+		return body, resp.Header.Get("ETag"), 0, nil
+	case resp.StatusCode == http.StatusNotModified && ifNoneMatch != "":
+		return nil, "", 0, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", 0, ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		return nil, "", retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("GET %s: %s", req.URL.Path, resp.Status)
+	default:
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", 0, fmt.Errorf("GET %s: %s %s", req.URL.Path, resp.Status, bytes.TrimSpace(detail))
+	}
+}
+
+// retryAfter parses the Retry-After header, in seconds or as HTTP date.
+// Without a usable value a short pause is used.
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds)*time.Second + time.Millisecond
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return time.Second
+}
+
+func (c *Client) store(path, etag string, body json.RawMessage) {
+	if etag == "" {
+		return
+	}
+	size := c.CacheSize
+	if size == 0 {
+		size = 1000
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[string]cached{}
+	}
+	if _, ok := c.cache[path]; !ok && len(c.cache) >= size {
+		// Make room by dropping an arbitrary entry
+		for key := range c.cache {
+			delete(c.cache, key)
+			break
+		}
+	}
+	c.cache[path] = cached{etag: etag, body: body}
+}
+
+// Enrich fetches the resources of the notifications in a Graph event and
+// adds them to each notification as "resourceContent". Resources which no
+// longer exist are marked with "resourceDeleted". The payload is either a
+// notification or a callback with a "value" list of notifications.
+func (c *Client) Enrich(ctx context.Context, ev events.Event) (events.Event, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return ev, fmt.Errorf("graph payload: %w", err)
+	}
+
+	notifications := []map[string]interface{}{payload}
+	if values, ok := payload["value"].([]interface{}); ok {
+		notifications = notifications[:0]
+		for _, v := range values {
+			if n, ok := v.(map[string]interface{}); ok {
+				notifications = append(notifications, n)
+			}
+		}
+	}
+
+	for _, n := range notifications {
+		path, etag := resourcePath(n)
+		if _, done := n["resourceContent"]; path == "" || done {
+			continue
+		}
+		body, err := c.Get(ctx, path, etag)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			n["resourceDeleted"] = true
+		case err != nil:
+			return ev, err
+		default:
+			n["resourceContent"] = body
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ev, err
+	}
+	ev.Payload = data
+	return ev, nil
+}
+
+// resourcePath returns the path and etag of the resource of a notification.
+func resourcePath(n map[string]interface{}) (string, string) {
+	var path, etag string
+	if data, ok := n["resourceData"].(map[string]interface{}); ok {
+		path, _ = data["@odata.id"].(string)
+		etag, _ = data["@odata.etag"].(string)
+	}
+	if path == "" {
+		path, _ = n["resource"].(string)
+	}
+	return path, etag
+}
@@ -0,0 +1,126 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/azuread"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+// stub serves users/1 with etag "v2", users/2 as deleted and throttles the
+// first request of users/3.
+func stub(t *testing.T, requests *int32) *httptest.Server {
+	var throttled int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("GET %s without token", r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/users/1":
+			if r.Header.Get("If-None-Match") == `"v2"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v2"`)
+			w.Write([]byte(`{"id":"1","displayName":"Ada"}`))
+		case "/users/3":
+			if atomic.AddInt32(&throttled, 1) == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"id":"3"}`))
+		default:
+			http.Error(w, `{"error":{"code":"Request_ResourceNotFound"}}`, http.StatusNotFound)
+		}
+	}))
+}
+
+func TestClient_Get(t *testing.T) {
+	var requests int32
+	server := stub(t, &requests)
+	defer server.Close()
+	c := &Client{BaseURL: server.URL, Tokens: azuread.StaticToken("token")}
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		path     string
+		etag     string
+		want     string
+		wantErr  error
+		requests int32
+	}{
+		{name: "Fetched", path: "users/1", want: `{"id":"1","displayName":"Ada"}`, requests: 1},
+		{name: "Cached etag", path: "users/1", etag: `"v2"`, want: `{"id":"1","displayName":"Ada"}`, requests: 0},
+		{name: "Not modified", path: "users/1", etag: `"v3"`, want: `{"id":"1","displayName":"Ada"}`, requests: 1},
+		{name: "Deleted", path: "users/2", wantErr: ErrNotFound, requests: 1},
+		{name: "Throttled", path: "/users/3", want: `{"id":"3"}`, requests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			got, err := c.Get(ctx, tt.path, tt.etag)
+			if err != tt.wantErr {
+				t.Fatalf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Get() = %s, want %s", got, tt.want)
+			}
+			if n := atomic.LoadInt32(&requests); n != tt.requests {
+				t.Errorf("Get() made %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestClient_Enrich(t *testing.T) {
+	var requests int32
+	server := stub(t, &requests)
+	defer server.Close()
+	c := &Client{BaseURL: server.URL, Tokens: azuread.StaticToken("token")}
+
+	payload := `{"value":[
+		{"changeType":"updated","resource":"Users/1","resourceData":{"@odata.id":"users/1"}},
+		{"changeType":"deleted","resource":"users/2"}
+	]}`
+	ev, err := c.Enrich(context.Background(), events.New(Source, "updated", []byte(payload)))
+	if err != nil {
+		t.Fatalf("Enrich() error = %v", err)
+	}
+
+	var got struct {
+		Value []struct {
+			ResourceContent json.RawMessage `json:"resourceContent"`
+			ResourceDeleted bool            `json:"resourceDeleted"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(ev.Payload, &got); err != nil {
+		t.Fatalf("Enrich() payload: %v", err)
+	}
+	if len(got.Value) != 2 {
+		t.Fatalf("Enrich() returned %d notifications, want 2", len(got.Value))
+	}
+	if string(got.Value[0].ResourceContent) != `{"id":"1","displayName":"Ada"}` {
+		t.Errorf("Enrich() resourceContent = %s", got.Value[0].ResourceContent)
+	}
+	if !got.Value[1].ResourceDeleted {
+		t.Errorf("Enrich() did not mark the deleted resource")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if got := retryAfter("2"); got < 2*time.Second || got > 3*time.Second {
+		t.Errorf("retryAfter(2) = %s", got)
+	}
+	if got := retryAfter(""); got != time.Second {
+		t.Errorf("retryAfter() = %s, want 1s", got)
+	}
+}
@@ -0,0 +1,320 @@
+// Package history keeps the recently received events together with their
+// delivery attempts, so integrations can be debugged from the admin API.
+//
+// The most recent events are held in a fixed size ring buffer. When a store
+// is configured every record is also written to disk and kept for the
+// retention period, surviving restarts and the ring buffer wrapping around.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+const bucket = "events"
+
+// Delivery statuses of a record.
+const (
+	StatusReceived  = "received"  // Not routed yet
+	StatusUnrouted  = "unrouted"  // No rule matched
+	StatusDelivered = "delivered" // Every destination succeeded
+	StatusPartial   = "partial"   // Some destinations failed
+	StatusFailed    = "failed"    // Every destination failed
+
+	StatusQuarantined = "quarantined" // Unknown tenant, not routed
+	StatusHeld        = "held"        // Only coalesced or aggregated, delivered later
+)
+
+// Attempt is one delivery of an event to a destination.
+type Attempt struct {
+	Destination string    `json:"destination"`
+	Time        time.Time `json:"time"`
+	DurationMs  int64     `json:"durationMs"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	Replay      bool      `json:"replay,omitempty"`     // Manual redelivery from the admin API
+	ReplayedBy  string    `json:"replayedBy,omitempty"` // Identity of the caller requesting the replay
+}
+
+// Record is an event and what happened to it.
+type Record struct {
+	Event    events.Event `json:"event"`
+	Status   string       `json:"status"`
+	Attempts []Attempt    `json:"attempts"`
+}
+
+// Filter selects records in List. Empty fields match everything.
+type Filter struct {
+	Source string
+	Type   string // Supports path.Match wildcards
+	Tag    string
+	Status string
+	// CorrelationID selects the events received together
+	CorrelationID string
+	From          time.Time
+	To            time.Time
+	Limit         int
+}
+
+// History is safe for concurrent use.
+type History struct {
+	mu        sync.Mutex
+	ring      []*Record
+	next      int
+	byID      map[string]*Record
+	store     *store.Store
+	retention time.Duration
+}
+
+// New returns a History holding size records in memory. When st is not nil
+// records are also persisted and pruned after retention.
+func New(size int, st *store.Store, retention time.Duration) *History {
+	if size <= 0 {
+		size = 1
+	}
+	return &History{
+		ring:      make([]*Record, size),
+		byID:      make(map[string]*Record, size),
+		store:     st,
+		retention: retention,
+	}
+}
+
+// Add records a received event.
+func (h *History) Add(ev events.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rec := &Record{Event: ev, Status: StatusReceived}
+	if old := h.ring[h.next]; old != nil {
+		delete(h.byID, old.Event.ID)
+	}
+	h.ring[h.next] = rec
+	h.next = (h.next + 1) % len(h.ring)
+	h.byID[ev.ID] = rec
+	h.persist(rec)
+}
+
+// Routed updates the event after routing, which may have added tags. No
+// destinations means the event was not routed anywhere.
+func (h *History) Routed(ev events.Event, destinations int) {
+	h.update(ev.ID, func(rec *Record) {
+		rec.Event = ev
+		if destinations == 0 {
+			rec.Status = StatusUnrouted
+		}
+	})
+}
+
+// Quarantine marks the event as held back because its tenant is unknown.
+func (h *History) Quarantine(id string) {
+	h.update(id, func(rec *Record) {
+		rec.Status = StatusQuarantined
+	})
+}
+
+// Held marks the event as merged into a burst or an aggregate, without
+// deliveries of its own.
+func (h *History) Held(id string) {
+	h.update(id, func(rec *Record) {
+		rec.Status = StatusHeld
+	})
+}
+
+// AddAttempt records a delivery attempt for the event.
+func (h *History) AddAttempt(id string, attempt Attempt) {
+	h.update(id, func(rec *Record) {
+		rec.Attempts = append(rec.Attempts, attempt)
+		rec.Status = status(rec.Attempts)
+	})
+}
+
+func (h *History) update(id string, fn func(rec *Record)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rec, ok := h.byID[id]
+	if !ok {
+		rec = h.load(id)
+		if rec == nil {
+			return
+		}
+	}
+	fn(rec)
+	h.persist(rec)
+}
+
+// Get returns a copy of the record of the event.
+func (h *History) Get(id string) (Record, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if rec, ok := h.byID[id]; ok {
+		return rec.copy(), true
+	}
+	if rec := h.load(id); rec != nil {
+		return *rec, true
+	}
+	return Record{}, false
+}
+
+// List returns the records matching the filter, newest first.
+func (h *History) List(f Filter) []Record {
+	var result []Record
+	seen := map[string]bool{}
+	h.mu.Lock()
+	for _, rec := range h.ring {
+		if rec == nil {
+			continue
+		}
+		// The store may hold an older state of the records in memory
+		seen[rec.Event.ID] = true
+		if f.matches(rec) {
+			result = append(result, rec.copy())
+		}
+	}
+	h.mu.Unlock()
+
+	// The store is scanned without the lock, so events are recorded meanwhile
+	if h.store != nil {
+		h.store.Each(bucket, func(key string, data []byte) error {
+			var rec Record
+			if seen[key] || json.Unmarshal(data, &rec) != nil || !f.matches(&rec) {
+				return nil
+			}
+			result = append(result, rec)
+			return nil
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Event.Time.After(result[j].Event.Time)
+	})
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result
+}
+
+// Prune deletes persisted records older than the retention every interval
+// until ctx is done.
+func (h *History) Prune(ctx context.Context, interval time.Duration) {
+	if h.store == nil || h.retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.pruneOnce(time.Now().Add(-h.retention))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *History) pruneOnce(before time.Time) {
+	var expired []string
+	h.store.Each(bucket, func(key string, data []byte) error {
+		var rec Record
+		if json.Unmarshal(data, &rec) == nil && rec.Event.Time.Before(before) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	for _, key := range expired {
+		h.store.Delete(bucket, key)
+	}
+}
+
+func (h *History) persist(rec *Record) {
+	if h.store != nil {
+		h.store.Put(bucket, rec.Event.ID, rec)
+	}
+}
+
+func (h *History) load(id string) *Record {
+	if h.store == nil {
+		return nil
+	}
+	var rec Record
+	if ok, err := h.store.Get(bucket, id, &rec); !ok || err != nil {
+		return nil
+	}
+	return &rec
+}
+
+func (r *Record) copy() Record {
+	c := *r
+	c.Attempts = append([]Attempt(nil), r.Attempts...)
+	return c
+}
+
+// status derives the record status from the latest attempt per destination.
+func status(attempts []Attempt) string {
+	latest := map[string]bool{}
+	for _, a := range attempts {
+		latest[a.Destination] = a.Success
+	}
+	ok, failed := 0, 0
+	for _, success := range latest {
+		if success {
+			ok++
+		} else {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return StatusDelivered
+	case ok == 0:
+		return StatusFailed
+	default:
+		return StatusPartial
+	}
+}
+
+func (f Filter) matches(rec *Record) bool {
+	ev := rec.Event
+	if f.Source != "" && ev.Source != f.Source {
+		return false
+	}
+	if f.Type != "" {
+		if ok, _ := path.Match(f.Type, ev.Type); !ok {
+			return false
+		}
+	}
+	if f.Tag != "" && !contains(ev.Tags, f.Tag) {
+		return false
+	}
+	if f.Status != "" && rec.Status != f.Status {
+		return false
+	}
+	if f.CorrelationID != "" && ev.CorrelationID != f.CorrelationID {
+		return false
+	}
+	if !f.From.IsZero() && ev.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !ev.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+func TestHistory_Status(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts []Attempt
+		want     string
+	}{
+		{
+			name:     "All delivered",
+			attempts: []Attempt{{Destination: "a", Success: true}, {Destination: "b", Success: true}},
+			want:     StatusDelivered,
+		},
+		{
+			name:     "One failed",
+			attempts: []Attempt{{Destination: "a", Success: true}, {Destination: "b"}},
+			want:     StatusPartial,
+		},
+		{
+			name:     "Failed then retried",
+			attempts: []Attempt{{Destination: "a"}, {Destination: "a", Success: true}},
+			want:     StatusDelivered,
+		},
+		{
+			name:     "All failed",
+			attempts: []Attempt{{Destination: "a"}, {Destination: "b"}},
+			want:     StatusFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(10, nil, 0)
+			ev := events.New("github", "push", []byte(`{}`))
+			h.Add(ev)
+			for _, a := range tt.attempts {
+				h.AddAttempt(ev.ID, a)
+			}
+			rec, _ := h.Get(ev.ID)
+			if rec.Status != tt.want {
+				t.Errorf("Status = %s, want %s", rec.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistory_PersistedBeyondRing(t *testing.T) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(2, st, time.Hour)
+
+	first := events.New("github", "push", []byte(`{"n":1}`))
+	first.Time = time.Now().Add(-2 * time.Hour)
+	h.Add(first)
+	for i := 0; i < 3; i++ {
+		h.Add(events.New("microsoftgraph", "notification", []byte(`{}`)))
+	}
+
+	if _, ok := h.Get(first.ID); !ok {
+		t.Fatalf("Get() did not find the evicted event on disk")
+	}
+	if got := len(h.List(Filter{})); got != 4 {
+		t.Errorf("List() returned %d records, want 4", got)
+	}
+	if got := len(h.List(Filter{Source: "github"})); got != 1 {
+		t.Errorf("List(source) returned %d records, want 1", got)
+	}
+
+	h.pruneOnce(time.Now().Add(-h.retention))
+	if _, ok := h.Get(first.ID); ok {
+		t.Errorf("pruneOnce() kept an event older than the retention")
+	}
+}
@@ -0,0 +1,237 @@
+// Package hold keeps items held back until they are due.
+//
+// A Queue keeps its items in a State, either a store for a single replica or
+// a NATS key-value bucket shared by the replicas. Every write is a
+// compare-and-set on the revision of the item, so replicas adding to the same
+// item do not lose each other's changes. A due item is leased by the replica
+// flushing it for RetryDelay; when the flush fails or the replica stops, the
+// item is flushed again once the lease has expired.
+package hold
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetryDelay is the wait before an item whose flush failed is flushed again.
+const RetryDelay = 30 * time.Second
+
+// maxAttempts bounds the compare-and-set attempts of a write.
+const maxAttempts = 10
+
+// ErrDropped is returned by a Flusher for an item it dropped instead of
+// flushing. The item is removed, but not counted as flushed.
+var ErrDropped = errors.New("held item dropped")
+
+// Item is a value held back until Due.
+type Item[T any] struct {
+	Key   string    `json:"-"`
+	Value T         `json:"value"`
+	Due   time.Time `json:"due"`
+	Lease time.Time `json:"lease"` // Until when a replica flushes the item
+
+	revision uint64
+}
+
+// Next returns when the item is flushed next: when it is due, or after a
+// failed flush when the lease expires.
+func (it Item[T]) Next() time.Time {
+	if it.Lease.After(it.Due) {
+		return it.Lease
+	}
+	return it.Due
+}
+
+// Flusher flushes a due item.
+type Flusher[T any] func(ctx context.Context, it Item[T]) error
+
+// Remainder returns what is left of an item changed while it was flushed,
+// given the value flushed and the current one. It reports false when nothing
+// is left.
+type Remainder[T any] func(flushed, current T) (T, bool)
+
+// Queue is safe for concurrent use, also by replicas sharing the State.
+type Queue[T any] struct {
+	state     State
+	remainder Remainder[T]
+}
+
+// New returns a Queue keeping its items in state. remainder may be nil for
+// items which do not change once added.
+func New[T any](state State, remainder Remainder[T]) *Queue[T] {
+	return &Queue[T]{state: state, remainder: remainder}
+}
+
+func (q *Queue[T]) decode(entry Entry) (Item[T], error) {
+	var it Item[T]
+	if err := json.Unmarshal(entry.Data, &it); err != nil {
+		return it, fmt.Errorf("invalid held item %s: %w", entry.Key, err)
+	}
+	it.Key = entry.Key
+	it.revision = entry.Revision
+	return it, nil
+}
+
+// Get returns the item with the key. It reports false when there is none.
+func (q *Queue[T]) Get(key string) (Item[T], bool, error) {
+	entry, ok, err := q.state.Get(key)
+	if err != nil || !ok {
+		return Item[T]{}, false, err
+	}
+	it, err := q.decode(entry)
+	return it, err == nil, err
+}
+
+// write saves the item, if it was not changed since it was read.
+func (q *Queue[T]) write(it *Item[T]) error {
+	data, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	if it.revision == 0 {
+		it.revision, err = q.state.Create(it.Key, data)
+	} else {
+		it.revision, err = q.state.Update(it.Key, data, it.revision)
+	}
+	return err
+}
+
+// Update calls fn with the item of the key, or a new one, and saves it when
+// fn reports true. fn is called again when the item was changed meanwhile,
+// e.g. by another replica.
+func (q *Queue[T]) Update(key string, fn func(it *Item[T], exists bool) (bool, error)) (Item[T], error) {
+	for attempt := 0; ; attempt++ {
+		it, exists, err := q.Get(key)
+		if err != nil {
+			return it, err
+		}
+		it.Key = key
+		save, err := fn(&it, exists)
+		if err != nil || !save {
+			return it, err
+		}
+		err = q.write(&it)
+		if !errors.Is(err, ErrConflict) || attempt == maxAttempts {
+			return it, err
+		}
+	}
+}
+
+// Remove deletes the item with the key and returns it. It reports false when
+// there is none.
+func (q *Queue[T]) Remove(key string) (Item[T], bool, error) {
+	for attempt := 0; ; attempt++ {
+		it, ok, err := q.Get(key)
+		if err != nil || !ok {
+			return it, false, err
+		}
+		err = q.state.Delete(key, it.revision)
+		if !errors.Is(err, ErrConflict) || attempt == maxAttempts {
+			return it, err == nil, err
+		}
+	}
+}
+
+// List returns the items, the next due first.
+func (q *Queue[T]) List() ([]Item[T], error) {
+	entries, err := q.state.List()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item[T], 0, len(entries))
+	for _, entry := range entries {
+		it, err := q.decode(entry)
+		if err != nil {
+			continue
+		}
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Next().Before(items[j].Next()) })
+	return items, nil
+}
+
+// Flush flushes the items due at now which are not leased. Each item is
+// leased first, so only one replica flushes it. A flushed item is removed,
+// keeping the remainder of changes made meanwhile; a failed one is flushed
+// again when its lease expires. The number of flushed items is returned.
+func (q *Queue[T]) Flush(ctx context.Context, now time.Time, flush Flusher[T]) (int, error) {
+	items, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+	flushed := 0
+	var firstErr error
+	for _, it := range items {
+		if it.Due.After(now) || it.Lease.After(now) {
+			continue
+		}
+		it.Lease = now.Add(RetryDelay)
+		if err := q.write(&it); errors.Is(err, ErrConflict) {
+			// Changed or leased by another replica
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		err := flush(ctx, it)
+		if err == nil {
+			flushed++
+		}
+		if err == nil || errors.Is(err, ErrDropped) {
+			err = q.settle(it)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return flushed, firstErr
+}
+
+// settle removes a flushed item, or keeps the remainder when it was changed
+// while it was flushed.
+func (q *Queue[T]) settle(flushed Item[T]) error {
+	for attempt := 0; ; attempt++ {
+		current, ok, err := q.Get(flushed.Key)
+		if err != nil || !ok {
+			return err
+		}
+		rest, keep := current.Value, false
+		if current.revision != flushed.revision && q.remainder != nil {
+			rest, keep = q.remainder(flushed.Value, current.Value)
+		}
+		if keep {
+			current.Value = rest
+			current.Lease = time.Time{}
+			err = q.write(&current)
+		} else {
+			err = q.state.Delete(current.Key, current.revision)
+		}
+		if !errors.Is(err, ErrConflict) || attempt == maxAttempts {
+			return err
+		}
+	}
+}
+
+// Run calls flush every interval until ctx is done. Errors are passed to
+// onError.
+func Run(ctx context.Context, interval time.Duration, flush func(ctx context.Context) (int, error), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := flush(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package hold
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+type counter struct {
+	Count int `json:"count"`
+}
+
+func remainder(flushed, current counter) (counter, bool) {
+	current.Count -= flushed.Count
+	return current, current.Count > 0
+}
+
+// openState returns a state in a temporary directory and a function opening
+// it again, as after a restart.
+func openState(t *testing.T) (State, func() State) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() State {
+		state, err := NewStoreState(st, "held")
+		if err != nil {
+			t.Fatalf("NewStoreState() error = %v", err)
+		}
+		return state
+	}
+	return open(), open
+}
+
+func increment(q *Queue[counter], due time.Time) error {
+	_, err := q.Update("k", func(it *Item[counter], exists bool) (bool, error) {
+		it.Value.Count++
+		it.Due = due
+		return true, nil
+	})
+	return err
+}
+
+func TestQueue_Flush(t *testing.T) {
+	state, reopen := openState(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	// Two replicas sharing the state
+	replicas := []*Queue[counter]{New(state, remainder), New(state, remainder)}
+	var flushed []counter
+	var failing error
+	flush := func(ctx context.Context, it Item[counter]) error {
+		if failing != nil {
+			return failing
+		}
+		flushed = append(flushed, it.Value)
+		return nil
+	}
+
+	for _, q := range replicas {
+		if err := increment(q, now.Add(time.Minute)); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+	if n, err := replicas[0].Flush(ctx, now, flush); n != 0 || err != nil {
+		t.Fatalf("Flush() = %d, %v before the item was due", n, err)
+	}
+	now = now.Add(time.Minute)
+	for _, q := range replicas {
+		if _, err := q.Flush(ctx, now, flush); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+	}
+	if len(flushed) != 1 || flushed[0].Count != 2 {
+		t.Fatalf("Flush() flushed %+v, want one item counting 2", flushed)
+	}
+
+	// A failed flush is retried once the lease expired, also after a restart
+	flushed = nil
+	failing = errors.New("unavailable")
+	increment(replicas[0], now)
+	if _, err := replicas[0].Flush(ctx, now, flush); err == nil {
+		t.Fatalf("Flush() error = nil")
+	}
+	failing = nil
+	restarted := New(reopen(), remainder)
+	items, err := restarted.List()
+	if err != nil || len(items) != 1 || !items[0].Next().Equal(now.Add(RetryDelay)) {
+		t.Fatalf("List() = %+v, %v, want the item leased for the retry", items, err)
+	}
+	if n, _ := restarted.Flush(ctx, now.Add(RetryDelay/2), flush); n != 0 {
+		t.Fatalf("Flush() retried during the lease")
+	}
+	now = now.Add(RetryDelay)
+	if n, err := restarted.Flush(ctx, now, flush); n != 1 || err != nil {
+		t.Fatalf("Flush() = %d, %v, want the retry", n, err)
+	}
+}
+
+func TestQueue_FlushChanged(t *testing.T) {
+	state, _ := openState(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	q := New(state, remainder)
+	increment(q, now)
+	increment(q, now)
+
+	// Added while flushing, the remainder is kept
+	var flushed []counter
+	flush := func(ctx context.Context, it Item[counter]) error {
+		flushed = append(flushed, it.Value)
+		if len(flushed) == 1 {
+			return increment(q, now)
+		}
+		return nil
+	}
+	if n, err := q.Flush(ctx, now, flush); n != 1 || err != nil {
+		t.Fatalf("Flush() = %d, %v", n, err)
+	}
+	if n, err := q.Flush(ctx, now, flush); n != 1 || err != nil {
+		t.Fatalf("Flush() of the remainder = %d, %v", n, err)
+	}
+	if len(flushed) != 2 || flushed[0].Count != 2 || flushed[1].Count != 1 {
+		t.Errorf("Flush() flushed %+v, want 2 and then 1", flushed)
+	}
+	if items, _ := q.List(); len(items) != 0 {
+		t.Errorf("List() = %+v after the flushes", items)
+	}
+
+	// Dropped items are removed without counting
+	increment(q, now)
+	drop := func(ctx context.Context, it Item[counter]) error { return ErrDropped }
+	if n, err := q.Flush(ctx, now, drop); n != 0 || err != nil {
+		t.Fatalf("Flush() = %d, %v, want the item dropped", n, err)
+	}
+	if _, ok, _ := q.Get("k"); ok {
+		t.Errorf("Get() found the dropped item")
+	}
+}
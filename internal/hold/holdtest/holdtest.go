@@ -0,0 +1,72 @@
+// Package holdtest has the scaffolding shared by the tests of the queues
+// built on package hold.
+package holdtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/hold"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+// Start is the time the clocks of the tests start at.
+var Start = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// State returns a state in a temporary directory and a function opening it
+// again, as after a restart.
+func State(t *testing.T) (hold.State, func() hold.State) {
+	t.Helper()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() hold.State {
+		t.Helper()
+		state, err := hold.NewStoreState(st, "held")
+		if err != nil {
+			t.Fatalf("NewStoreState() error = %v", err)
+		}
+		return state
+	}
+	return open(), open
+}
+
+// Clock is a time set by the test.
+type Clock struct {
+	T time.Time
+}
+
+// NewClock returns a Clock at Start.
+func NewClock() *Clock {
+	return &Clock{T: Start}
+}
+
+func (c *Clock) Now() time.Time {
+	return c.T
+}
+
+func (c *Clock) Add(d time.Duration) {
+	c.T = c.T.Add(d)
+}
+
+// Recorder records the values flushed, and fails with Err while it is set.
+type Recorder[T any] struct {
+	Values []T
+	Err    error
+}
+
+// Flush records v unless Err is set.
+func (r *Recorder[T]) Flush(ctx context.Context, v T) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	r.Values = append(r.Values, v)
+	return nil
+}
+
+// Reset forgets the values recorded so far.
+func (r *Recorder[T]) Reset() {
+	r.Values = nil
+}
@@ -0,0 +1,198 @@
+package hold
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+// ErrConflict is returned by a State when the item was changed since it was
+// read.
+var ErrConflict = errors.New("held item changed meanwhile")
+
+// Entry is an item as kept in a State.
+type Entry struct {
+	Key      string
+	Data     []byte
+	Revision uint64
+}
+
+// State keeps the items of a queue. Create, Update and Delete return
+// ErrConflict when the item was created, changed or deleted meanwhile.
+type State interface {
+	Get(key string) (Entry, bool, error)
+	Create(key string, data []byte) (uint64, error)
+	Update(key string, data []byte, revision uint64) (uint64, error)
+	Delete(key string, revision uint64) error
+	List() ([]Entry, error)
+}
+
+// StoreState keeps the items in a bucket of a store, with the revisions in
+// memory. It only coordinates the queues of one process, for a single
+// replica.
+type StoreState struct {
+	store  *store.Store
+	bucket string
+
+	mu       sync.Mutex
+	entries  map[string]Entry
+	revision uint64
+}
+
+// NewStoreState returns a StoreState keeping the items in the bucket of st,
+// loading those left by a previous run.
+func NewStoreState(st *store.Store, bucket string) (*StoreState, error) {
+	s := &StoreState{store: st, bucket: bucket, entries: map[string]Entry{}}
+	err := st.Each(bucket, func(key string, data []byte) error {
+		s.revision++
+		s.entries[key] = Entry{Key: key, Data: data, Revision: s.revision}
+		return nil
+	})
+	return s, err
+}
+
+func (s *StoreState) Get(key string) (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	return entry, ok, nil
+}
+
+func (s *StoreState) Create(key string, data []byte) (uint64, error) {
+	return s.Update(key, data, 0)
+}
+
+func (s *StoreState) Update(key string, data []byte, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[key].Revision != revision {
+		return 0, ErrConflict
+	}
+	if err := s.store.Put(s.bucket, key, json.RawMessage(data)); err != nil {
+		return 0, err
+	}
+	s.revision++
+	s.entries[key] = Entry{Key: key, Data: data, Revision: s.revision}
+	return s.revision, nil
+}
+
+func (s *StoreState) Delete(key string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; !ok || entry.Revision != revision {
+		return ErrConflict
+	}
+	if err := s.store.Delete(s.bucket, key); err != nil {
+		return err
+	}
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *StoreState) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// KVState keeps the items in a NATS key-value bucket shared by the
+// replicas, under a prefix so that several queues can share the bucket.
+// The revisions of the bucket make the compare-and-set.
+type KVState struct {
+	kv     nats.KeyValue
+	prefix string
+}
+
+// NewKVState creates or binds the key-value bucket.
+func NewKVState(js nats.JetStreamContext, bucket, prefix string) (*KVState, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "Events held back by koksmat-emit",
+			History:     1,
+			Storage:     nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &KVState{kv: kv, prefix: prefix + "."}, nil
+}
+
+// kvKey encodes the key, which may contain characters not allowed in keys.
+func (s *KVState) kvKey(key string) string {
+	return s.prefix + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// kvErr maps a lost compare-and-set to ErrConflict.
+func kvErr(err error) error {
+	var apiErr *nats.APIError
+	if errors.Is(err, nats.ErrKeyExists) || errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *KVState) Get(key string) (Entry, bool, error) {
+	entry, err := s.kv.Get(s.kvKey(key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return Entry{Key: key, Data: entry.Value(), Revision: entry.Revision()}, true, nil
+}
+
+func (s *KVState) Create(key string, data []byte) (uint64, error) {
+	revision, err := s.kv.Create(s.kvKey(key), data)
+	return revision, kvErr(err)
+}
+
+func (s *KVState) Update(key string, data []byte, revision uint64) (uint64, error) {
+	revision, err := s.kv.Update(s.kvKey(key), data, revision)
+	return revision, kvErr(err)
+}
+
+func (s *KVState) Delete(key string, revision uint64) error {
+	return kvErr(s.kv.Delete(s.kvKey(key), nats.LastRevision(revision)))
+}
+
+// List reads the items one by one; it suits the few items held at a time.
+func (s *KVState) List() ([]Entry, error) {
+	keys, err := s.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, k := range keys {
+		if !strings.HasPrefix(k, s.prefix) {
+			continue
+		}
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(k, s.prefix))
+		if err != nil {
+			continue
+		}
+		entry, ok, err := s.Get(string(key))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,200 @@
+// Package hooks turns requests of webhook sources declared in the routing
+// configuration into events.
+//
+// A source names how requests are verified and where the event type,
+// subject, tenant and idempotency key are found, either in a header or in the
+// JSON payload. Secrets are never part of the configuration; it names the
+// settings holding them.
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/spf13/viper"
+)
+
+// Config declares a webhook source, received on /api/v1/hooks/<name>.
+type Config struct {
+	Name   string       `mapstructure:"name" json:"name"`
+	Verify VerifyConfig `mapstructure:"verify" json:"verify"`
+
+	// The event type is the header value and the value at the JSON path
+	// joined by a dot, or Type when neither is set or found.
+	Type       string `mapstructure:"type" json:"type,omitempty"`
+	TypeHeader string `mapstructure:"type_header" json:"typeHeader,omitempty"`
+	TypePath   string `mapstructure:"type_path" json:"typePath,omitempty"`
+
+	SubjectPath string `mapstructure:"subject_path" json:"subjectPath,omitempty"`
+	TenantPath  string `mapstructure:"tenant_path" json:"tenantPath,omitempty"`
+
+	// Without a key the payload hash identifies retries.
+	KeyHeader string `mapstructure:"key_header" json:"keyHeader,omitempty"`
+	KeyPath   string `mapstructure:"key_path" json:"keyPath,omitempty"`
+}
+
+// VerifyConfig selects the verification scheme of a source.
+//
+//   - hmac: Header holds Prefix followed by the HMAC of the body, encoded
+//     as hex or base64, computed with Algorithm (sha256, sha1 or sha512).
+//   - stripe: Header (default Stripe-Signature) holds t=<unix time> and one
+//     or more v1=<hex HMAC-SHA256 of "<t>.<body>">, which must not be older
+//     than Tolerance.
+//   - bearer: Authorization carries the secret as bearer token.
+//   - basic: Authorization carries Username and the secret as password.
+//   - none: Requests are not verified.
+type VerifyConfig struct {
+	Scheme    string        `mapstructure:"scheme" json:"scheme"`
+	SecretEnv string        `mapstructure:"secret_env" json:"secretEnv,omitempty"` // Setting holding the secret
+	Header    string        `mapstructure:"header" json:"header,omitempty"`
+	Algorithm string        `mapstructure:"algorithm" json:"algorithm,omitempty"`
+	Prefix    string        `mapstructure:"prefix" json:"prefix,omitempty"`
+	Encoding  string        `mapstructure:"encoding" json:"encoding,omitempty"`
+	Username  string        `mapstructure:"username" json:"username,omitempty"`
+	Tolerance time.Duration `mapstructure:"tolerance" json:"tolerance,omitempty"`
+}
+
+// ErrUnauthorized is returned when a request fails verification.
+var ErrUnauthorized = errors.New("request could not be verified")
+
+// Source is a compiled Config.
+type Source struct {
+	Config   Config
+	verifier verifier
+	now      func() time.Time
+}
+
+// New validates the configuration.
+func New(cfg Config) (*Source, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("source has no name")
+	}
+	if strings.ContainsAny(cfg.Name, "/ ") {
+		return nil, fmt.Errorf("source name %q must not contain slashes or spaces", cfg.Name)
+	}
+	v, err := newVerifier(cfg.Verify)
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %w", cfg.Name, err)
+	}
+	for _, path := range []string{cfg.TypePath, cfg.SubjectPath, cfg.TenantPath, cfg.KeyPath} {
+		if strings.Contains(path, "..") {
+			return nil, fmt.Errorf("source %q: invalid JSON path %q", cfg.Name, path)
+		}
+	}
+	return &Source{Config: cfg, verifier: v, now: time.Now}, nil
+}
+
+// Verify checks the request against the source's scheme. The secret is
+// read on every request, so it can be rotated without a reload.
+func (s *Source) Verify(header http.Header, body []byte) error {
+	var secret string
+	if s.Config.Verify.SecretEnv != "" {
+		secret = viper.GetString(s.Config.Verify.SecretEnv)
+		if secret == "" {
+			return fmt.Errorf("%w: %s is not set", ErrUnauthorized, s.Config.Verify.SecretEnv)
+		}
+	}
+	return s.verifier.verify(header, body, secret, s.now())
+}
+
+// Event builds the event of a verified request. The body must be JSON.
+func (s *Source) Event(header http.Header, body []byte) (events.Event, error) {
+	doc, err := decode(body)
+	if err != nil {
+		return events.Event{}, fmt.Errorf("payload is not valid JSON: %w", err)
+	}
+
+	ev := events.New(s.Config.Name, s.eventType(header, doc), body)
+	ev.Subject = Lookup(doc, s.Config.SubjectPath)
+	ev.Tenant = Lookup(doc, s.Config.TenantPath)
+
+	var key string
+	if s.Config.KeyHeader != "" {
+		key = header.Get(s.Config.KeyHeader)
+	}
+	if key == "" {
+		key = Lookup(doc, s.Config.KeyPath)
+	}
+	if key != "" {
+		ev.IdempotencyKey = s.Config.Name + ":" + key
+	}
+	return ev, nil
+}
+
+func (s *Source) eventType(header http.Header, doc interface{}) string {
+	var parts []string
+	if s.Config.TypeHeader != "" {
+		if v := header.Get(s.Config.TypeHeader); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if v := Lookup(doc, s.Config.TypePath); v != "" {
+		parts = append(parts, v)
+	}
+	if len(parts) == 0 {
+		return s.Config.Type
+	}
+	return strings.Join(parts, ".")
+}
+
+// decode parses JSON keeping numbers exact, so large IDs survive Lookup.
+func decode(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return doc, nil
+}
+
+// Lookup returns the value at a dot separated path like "$.data.object.id"
+// or "commits.0.id" as string. Objects and arrays are returned as JSON. An
+// empty path or a missing value returns "".
+func Lookup(doc interface{}, path string) string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return ""
+	}
+	current := doc
+	for _, part := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			current = node[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			current = node[i]
+		default:
+			return ""
+		}
+	}
+
+	switch v := current.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
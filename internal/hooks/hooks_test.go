@@ -0,0 +1,194 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const body = `{"id":12345678901234567,"type":"invoice.paid","data":{"object":{"customer":"cus_1","tenant":"nexi"}}}`
+
+func sign(h func() hash.Hash, secret, data string) []byte {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func TestSource_Verify(t *testing.T) {
+	viper.Set("HOOK_SECRET", "s3cret")
+	defer viper.Reset()
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		verify  VerifyConfig
+		header  http.Header
+		wantErr bool
+	}{
+		{
+			name:   "HMAC hex with prefix",
+			verify: VerifyConfig{Scheme: "hmac", SecretEnv: "HOOK_SECRET", Header: "X-Signature", Prefix: "sha256="},
+			header: http.Header{"X-Signature": {"sha256=" + hex.EncodeToString(sign(sha256.New, "s3cret", body))}},
+		},
+		{
+			name:   "HMAC base64 sha1",
+			verify: VerifyConfig{Scheme: "hmac", SecretEnv: "HOOK_SECRET", Header: "X-Signature", Algorithm: "sha1", Encoding: "base64"},
+			header: http.Header{"X-Signature": {base64.StdEncoding.EncodeToString(sign(sha1.New, "s3cret", body))}},
+		},
+		{
+			name:    "HMAC with wrong secret",
+			verify:  VerifyConfig{Scheme: "hmac", SecretEnv: "HOOK_SECRET", Header: "X-Signature"},
+			header:  http.Header{"X-Signature": {hex.EncodeToString(sign(sha256.New, "other", body))}},
+			wantErr: true,
+		},
+		{
+			name:   "Stripe",
+			verify: VerifyConfig{Scheme: "stripe", SecretEnv: "HOOK_SECRET"},
+			header: http.Header{"Stripe-Signature": {fmt.Sprintf("t=%d,v1=00,v1=%s", now.Unix(), hex.EncodeToString(sign(sha256.New, "s3cret", fmt.Sprintf("%d.%s", now.Unix(), body))))}},
+		},
+		{
+			name:    "Stripe with an old timestamp",
+			verify:  VerifyConfig{Scheme: "stripe", SecretEnv: "HOOK_SECRET"},
+			header:  http.Header{"Stripe-Signature": {fmt.Sprintf("t=%d,v1=%s", now.Unix()-600, hex.EncodeToString(sign(sha256.New, "s3cret", fmt.Sprintf("%d.%s", now.Unix()-600, body))))}},
+			wantErr: true,
+		},
+		{
+			name:   "Bearer",
+			verify: VerifyConfig{Scheme: "bearer", SecretEnv: "HOOK_SECRET"},
+			header: http.Header{"Authorization": {"Bearer s3cret"}},
+		},
+		{
+			name:    "Bearer missing",
+			verify:  VerifyConfig{Scheme: "bearer", SecretEnv: "HOOK_SECRET"},
+			header:  http.Header{},
+			wantErr: true,
+		},
+		{
+			name:   "Basic",
+			verify: VerifyConfig{Scheme: "basic", SecretEnv: "HOOK_SECRET", Username: "hook"},
+			header: http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hook:s3cret"))}},
+		},
+		{
+			name:    "Basic with wrong user",
+			verify:  VerifyConfig{Scheme: "basic", SecretEnv: "HOOK_SECRET", Username: "hook"},
+			header:  http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("other:s3cret"))}},
+			wantErr: true,
+		},
+		{
+			name:    "Secret not set",
+			verify:  VerifyConfig{Scheme: "bearer", SecretEnv: "MISSING_SECRET"},
+			header:  http.Header{"Authorization": {"Bearer "}},
+			wantErr: true,
+		},
+		{
+			name:   "None",
+			verify: VerifyConfig{Scheme: "none"},
+			header: http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Config{Name: "billing", Verify: tt.verify})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			s.now = func() time.Time { return now }
+			err = s.Verify(tt.header, []byte(body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnauthorized) {
+				t.Errorf("Verify() error = %v, want ErrUnauthorized", err)
+			}
+		})
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"No name", Config{Verify: VerifyConfig{Scheme: "none"}}},
+		{"No scheme", Config{Name: "x"}},
+		{"Unknown scheme", Config{Name: "x", Verify: VerifyConfig{Scheme: "magic"}}},
+		{"HMAC without header", Config{Name: "x", Verify: VerifyConfig{Scheme: "hmac", SecretEnv: "S"}}},
+		{"Bearer without secret", Config{Name: "x", Verify: VerifyConfig{Scheme: "bearer"}}},
+		{"Unknown encoding", Config{Name: "x", Verify: VerifyConfig{Scheme: "hmac", SecretEnv: "S", Header: "H", Encoding: "base32"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); err == nil {
+				t.Errorf("New() error = nil")
+			}
+		})
+	}
+}
+
+func TestSource_Event(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         Config
+		header      http.Header
+		wantType    string
+		wantSubject string
+		wantTenant  string
+		wantKey     string
+	}{
+		{
+			name:        "JSON paths",
+			cfg:         Config{TypePath: "type", SubjectPath: "$.data.object.customer", TenantPath: "data.object.tenant", KeyPath: "id"},
+			wantType:    "invoice.paid",
+			wantSubject: "cus_1",
+			wantTenant:  "nexi",
+			wantKey:     "billing:12345678901234567",
+		},
+		{
+			name:     "Header and path",
+			cfg:      Config{TypeHeader: "X-Event", TypePath: "type", KeyHeader: "X-Delivery", KeyPath: "id"},
+			header:   http.Header{"X-Event": {"billing"}, "X-Delivery": {"d1"}},
+			wantType: "billing.invoice.paid",
+			wantKey:  "billing:d1",
+		},
+		{
+			name:     "Fixed type",
+			cfg:      Config{Type: "notification", TypePath: "missing"},
+			wantType: "notification",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "billing"
+			tt.cfg.Verify = VerifyConfig{Scheme: "none"}
+			s, err := New(tt.cfg)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if tt.header == nil {
+				tt.header = http.Header{}
+			}
+			ev, err := s.Event(tt.header, []byte(body))
+			if err != nil {
+				t.Fatalf("Event() error = %v", err)
+			}
+			if ev.Source != "billing" || ev.Type != tt.wantType || ev.Subject != tt.wantSubject || ev.Tenant != tt.wantTenant || ev.IdempotencyKey != tt.wantKey {
+				t.Errorf("Event() = %s %s %s %s %s", ev.Source, ev.Type, ev.Subject, ev.Tenant, ev.IdempotencyKey)
+			}
+		})
+	}
+
+	s, _ := New(Config{Name: "billing", Verify: VerifyConfig{Scheme: "none"}})
+	if _, err := s.Event(http.Header{}, []byte("not json")); err == nil {
+		t.Errorf("Event() of a non JSON payload error = nil")
+	}
+}
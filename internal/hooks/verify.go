@@ -0,0 +1,190 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verifier checks a request with the secret of the source.
+type verifier interface {
+	verify(header http.Header, body []byte, secret string, now time.Time) error
+}
+
+func newVerifier(cfg VerifyConfig) (verifier, error) {
+	needsSecret := true
+	var v verifier
+	switch cfg.Scheme {
+	case "hmac":
+		if cfg.Header == "" {
+			return nil, errors.New("hmac verification needs a header")
+		}
+		algorithm, err := hashFunc(cfg.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		encoding := cfg.Encoding
+		if encoding == "" {
+			encoding = "hex"
+		}
+		if encoding != "hex" && encoding != "base64" {
+			return nil, fmt.Errorf("encoding must be hex or base64")
+		}
+		v = hmacVerifier{header: cfg.Header, prefix: cfg.Prefix, encoding: encoding, hash: algorithm}
+	case "stripe":
+		header := cfg.Header
+		if header == "" {
+			header = "Stripe-Signature"
+		}
+		tolerance := cfg.Tolerance
+		if tolerance == 0 {
+			tolerance = 5 * time.Minute
+		}
+		v = stripeVerifier{header: header, tolerance: tolerance}
+	case "bearer":
+		v = bearerVerifier{}
+	case "basic":
+		if cfg.Username == "" {
+			return nil, errors.New("basic verification needs a username")
+		}
+		v = basicVerifier{username: cfg.Username}
+	case "none":
+		needsSecret = false
+		v = noVerifier{}
+	case "":
+		return nil, errors.New("verification scheme is required, use none to accept any request")
+	default:
+		return nil, fmt.Errorf("unknown verification scheme %q", cfg.Scheme)
+	}
+	if needsSecret && cfg.SecretEnv == "" {
+		return nil, fmt.Errorf("%s verification needs secret_env", cfg.Scheme)
+	}
+	return v, nil
+}
+
+func hashFunc(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", name)
+	}
+}
+
+type hmacVerifier struct {
+	header   string
+	prefix   string
+	encoding string
+	hash     func() hash.Hash
+}
+
+func (v hmacVerifier) verify(header http.Header, body []byte, secret string, now time.Time) error {
+	signature, ok := strings.CutPrefix(header.Get(v.header), v.prefix)
+	if !ok || signature == "" {
+		return fmt.Errorf("%w: missing %s", ErrUnauthorized, v.header)
+	}
+	var got []byte
+	var err error
+	if v.encoding == "base64" {
+		got, err = base64.StdEncoding.DecodeString(signature)
+	} else {
+		got, err = hex.DecodeString(signature)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrUnauthorized)
+	}
+	mac := hmac.New(v.hash, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("%w: signature mismatch", ErrUnauthorized)
+	}
+	return nil
+}
+
+type stripeVerifier struct {
+	header    string
+	tolerance time.Duration
+}
+
+func (v stripeVerifier) verify(header http.Header, body []byte, secret string, now time.Time) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header.Get(v.header), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("%w: missing or malformed %s", ErrUnauthorized, v.header)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrUnauthorized)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > v.tolerance || age < -v.tolerance {
+		return fmt.Errorf("%w: timestamp outside the tolerance", ErrUnauthorized)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature mismatch", ErrUnauthorized)
+}
+
+type bearerVerifier struct{}
+
+func (bearerVerifier) verify(header http.Header, body []byte, secret string, now time.Time) error {
+	token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("%w: invalid bearer token", ErrUnauthorized)
+	}
+	return nil
+}
+
+type basicVerifier struct {
+	username string
+}
+
+func (v basicVerifier) verify(header http.Header, body []byte, secret string, now time.Time) error {
+	r := http.Request{Header: header}
+	username, password, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(username), []byte(v.username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(secret)) != 1 {
+		return fmt.Errorf("%w: invalid credentials", ErrUnauthorized)
+	}
+	return nil
+}
+
+type noVerifier struct{}
+
+func (noVerifier) verify(header http.Header, body []byte, secret string, now time.Time) error {
+	return nil
+}
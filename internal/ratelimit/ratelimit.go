@@ -0,0 +1,178 @@
+// Package ratelimit provides token buckets and limiters combining them with
+// a cap on concurrent calls.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bucket holds up to burst tokens and is refilled with rate tokens per
+// second. It is safe for concurrent use.
+type Bucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket. A burst below one allows one token.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	b := &Bucket{rate: rate, burst: float64(burst), now: time.Now}
+	b.tokens = b.burst
+	b.last = b.now()
+	return b
+}
+
+// refill adds the tokens accrued since the last call. The caller holds mu.
+func (b *Bucket) refill() time.Time {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	return now
+}
+
+// Allow takes a token if one is available.
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve takes a token and returns how long to wait until it is due. The
+// bucket goes into debt, so concurrent callers queue up behind each other.
+func (b *Bucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Cancel returns a reserved token which is not used.
+func (b *Bucket) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+}
+
+// ErrThrottled is returned by Acquire when the limiter does not allow a
+// call in time.
+var ErrThrottled = errors.New("throttled")
+
+// Limiter limits the rate and the number of concurrent calls, and can be
+// paused when the upstream asks for it. It is safe for concurrent use.
+type Limiter struct {
+	bucket *Bucket       // Nil without rate limit
+	slots  chan struct{} // Nil without concurrency cap
+
+	mu     sync.Mutex
+	paused time.Time
+}
+
+// NewLimiter returns a limiter. A rate or maxInFlight of 0 is unlimited.
+func NewLimiter(rate float64, burst int, maxInFlight int) *Limiter {
+	l := &Limiter{}
+	if rate > 0 {
+		l.bucket = NewBucket(rate, burst)
+	}
+	if maxInFlight > 0 {
+		l.slots = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// Pause holds back calls until the given time.
+func (l *Limiter) Pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.paused) {
+		l.paused = until
+	}
+}
+
+// PausedUntil returns the end of the current pause, zero when not paused.
+func (l *Limiter) PausedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Now().After(l.paused) {
+		return time.Time{}
+	}
+	return l.paused
+}
+
+// Acquire waits until a call is allowed and returns the function releasing
+// its slot, and whether it had to wait. When the call would not be allowed
+// before ctx is done, ErrThrottled is returned right away.
+func (l *Limiter) Acquire(ctx context.Context) (func(), bool, error) {
+	waited := false
+	if until := l.PausedUntil(); !until.IsZero() {
+		if err := sleep(ctx, time.Until(until)); err != nil {
+			return nil, true, fmt.Errorf("%w: paused until %s", ErrThrottled, until.Format(time.RFC3339))
+		}
+		waited = true
+	}
+	if l.bucket != nil {
+		if delay := l.bucket.Reserve(); delay > 0 {
+			if err := sleep(ctx, delay); err != nil {
+				l.bucket.Cancel()
+				return nil, true, fmt.Errorf("%w: rate limit", ErrThrottled)
+			}
+			waited = true
+		}
+	}
+	if l.slots == nil {
+		return func() {}, waited, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, waited, nil
+	default:
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, true, nil
+	case <-ctx.Done():
+		return nil, true, fmt.Errorf("%w: too many deliveries in flight", ErrThrottled)
+	}
+}
+
+// InFlight returns the number of calls holding a slot.
+func (l *Limiter) InFlight() int {
+	return len(l.slots)
+}
+
+// sleep waits for d, failing right away when ctx ends earlier.
+func sleep(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBucket_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBucket(2, 3)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() #%d = false within the burst", i+1)
+		}
+	}
+	if b.Allow() {
+		t.Errorf("Allow() = true with an empty bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !b.Allow() {
+		t.Errorf("Allow() = false after refilling one token")
+	}
+	if b.Allow() {
+		t.Errorf("Allow() = true after using the refilled token")
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.Allow()
+	}
+	if b.Allow() {
+		t.Errorf("Allow() = true beyond the burst after a long pause")
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	short := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 50*time.Millisecond)
+	}
+
+	t.Run("Max in flight", func(t *testing.T) {
+		l := NewLimiter(0, 0, 1)
+		ctx, cancel := short()
+		defer cancel()
+		release, waited, err := l.Acquire(ctx)
+		if err != nil || waited {
+			t.Fatalf("Acquire() waited = %v, error = %v", waited, err)
+		}
+		if _, _, err := l.Acquire(ctx); !errors.Is(err, ErrThrottled) {
+			t.Errorf("Acquire() beyond the cap error = %v, want ErrThrottled", err)
+		}
+		release()
+		if l.InFlight() != 0 {
+			t.Errorf("InFlight() = %d after release", l.InFlight())
+		}
+	})
+
+	t.Run("Rate", func(t *testing.T) {
+		l := NewLimiter(100, 1, 0)
+		ctx, cancel := short()
+		defer cancel()
+		l.Acquire(ctx)
+		_, waited, err := l.Acquire(ctx)
+		if err != nil || !waited {
+			t.Errorf("Acquire() second call waited = %v, error = %v", waited, err)
+		}
+	})
+
+	t.Run("Pause beyond the deadline", func(t *testing.T) {
+		l := NewLimiter(0, 0, 0)
+		l.Pause(time.Now().Add(time.Minute))
+		ctx, cancel := short()
+		defer cancel()
+		start := time.Now()
+		if _, _, err := l.Acquire(ctx); !errors.Is(err, ErrThrottled) {
+			t.Errorf("Acquire() while paused error = %v, want ErrThrottled", err)
+		}
+		if time.Since(start) > 40*time.Millisecond {
+			t.Errorf("Acquire() waited although the pause outlasts the deadline")
+		}
+	})
+}
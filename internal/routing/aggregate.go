@@ -0,0 +1,83 @@
+package routing
+
+import (
+	"fmt"
+	"time"
+
+	// Timezones of the aggregation windows must resolve in minimal images
+	_ "time/tzdata"
+)
+
+// Aggregate is a compiled AggregateConfig.
+type Aggregate struct {
+	Key      *Template
+	Item     *Template // Nil without a list
+	Window   time.Duration
+	Location *time.Location
+	MaxItems int
+}
+
+// Default aggregation settings.
+const (
+	DefaultAggregateKey      = "{subject}"
+	DefaultAggregateWindow   = time.Hour
+	DefaultAggregateMaxItems = 100
+)
+
+const day = 24 * time.Hour
+
+func compileAggregate(cfg *AggregateConfig) (*Aggregate, error) {
+	a := &Aggregate{Window: cfg.Window, MaxItems: cfg.MaxItems}
+	key := cfg.Key
+	if key == "" {
+		key = DefaultAggregateKey
+	}
+	var err error
+	if a.Key, err = CompileTemplate(key); err != nil {
+		return nil, err
+	}
+	if cfg.Item != "" {
+		if a.Item, err = CompileTemplate(cfg.Item); err != nil {
+			return nil, err
+		}
+	}
+	if a.Window == 0 {
+		a.Window = DefaultAggregateWindow
+	}
+	switch {
+	case a.Window < time.Minute:
+		return nil, fmt.Errorf("window %s is shorter than a minute", a.Window)
+	case a.Window < day && day%a.Window != 0:
+		return nil, fmt.Errorf("window %s does not divide a day", a.Window)
+	case a.Window >= day && a.Window%day != 0:
+		return nil, fmt.Errorf("window %s is not a number of days", a.Window)
+	}
+	if a.Location, err = time.LoadLocation(cfg.Timezone); err != nil {
+		return nil, fmt.Errorf("timezone: %w", err)
+	}
+	switch {
+	case a.MaxItems == 0:
+		a.MaxItems = DefaultAggregateMaxItems
+	case a.MaxItems < 0:
+		return nil, fmt.Errorf("max_items must not be negative")
+	}
+	return a, nil
+}
+
+// Bounds returns the start and end of the window containing t. Windows are
+// aligned to midnight in the timezone of the aggregation; windows of several
+// days are counted from 1 January 1970.
+func (a *Aggregate) Bounds(t time.Time) (time.Time, time.Time) {
+	local := t.In(a.Location)
+	y, m, d := local.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, a.Location)
+	if a.Window < day {
+		start := midnight.Add(local.Sub(midnight).Truncate(a.Window))
+		return start, start.Add(a.Window)
+	}
+	days := int(a.Window / day)
+	epochDay := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / int64(day/time.Second))
+	offset := epochDay % days
+	start := time.Date(y, m, d-offset, 0, 0, 0, 0, a.Location)
+	return start, time.Date(y, m, d-offset+days, 0, 0, 0, 0, a.Location)
+}
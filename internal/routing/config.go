@@ -0,0 +1,177 @@
+// Package routing decides which destinations an event is delivered to.
+//
+// The rules and destinations are read from a configuration file (YAML, JSON
+// or TOML, see EMIT_CONFIG) and compiled into an immutable RuleSet. The Router
+// keeps the active RuleSet and swaps it atomically when the file changes, on
+// SIGHUP or when asked to through the admin API.
+package routing
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/hooks"
+	"github.com/spf13/viper"
+)
+
+// Config is the content of the routing configuration file.
+type Config struct {
+	Destinations []DestinationConfig `mapstructure:"destinations" json:"destinations"`
+	Rules        []RuleConfig        `mapstructure:"rules" json:"rules"`
+	Sources      []hooks.Config      `mapstructure:"sources" json:"sources,omitempty"` // Generic webhook sources
+	Tenants      []TenantConfig      `mapstructure:"tenants" json:"tenants,omitempty"`
+	// UnknownTenants is the policy for events of tenants missing in Tenants:
+	// allow (default), reject or quarantine. Only used with tenants.
+	UnknownTenants string `mapstructure:"unknown_tenants" json:"unknownTenants,omitempty"`
+
+	Schedules []ScheduleConfig `mapstructure:"schedules" json:"schedules,omitempty"`
+}
+
+// ScheduleConfig fires an event on a cron expression, see package cron. The
+// event has the source "schedule" and is routed like received events.
+type ScheduleConfig struct {
+	Name     string                 `mapstructure:"name" json:"name"`
+	Cron     string                 `mapstructure:"cron" json:"cron"`
+	Timezone string                 `mapstructure:"timezone" json:"timezone,omitempty"` // Default UTC
+	Type     string                 `mapstructure:"type" json:"type,omitempty"`         // Default the name
+	Subject  string                 `mapstructure:"subject" json:"subject,omitempty"`
+	Tenant   string                 `mapstructure:"tenant" json:"tenant,omitempty"`
+	Data     map[string]interface{} `mapstructure:"data" json:"data,omitempty"` // Added to the payload
+}
+
+// DestinationConfig declares a named destination. Options are specific to
+// the destination type.
+type DestinationConfig struct {
+	Name    string            `mapstructure:"name" json:"name"`
+	Type    string            `mapstructure:"type" json:"type"`
+	Options map[string]string `mapstructure:"options" json:"options,omitempty"`
+	Limits  LimitConfig       `mapstructure:"limits" json:"limits,omitempty"`
+	Breaker BreakerConfig     `mapstructure:"breaker" json:"breaker,omitempty"`
+}
+
+// BreakerConfig tunes the circuit breaker of a destination. Zero values use
+// the defaults of package breaker.
+type BreakerConfig struct {
+	Disabled     bool          `mapstructure:"disabled" json:"disabled,omitempty"`
+	FailureRatio float64       `mapstructure:"failure_ratio" json:"failureRatio,omitempty"` // Default 0.5
+	MinRequests  int           `mapstructure:"min_requests" json:"minRequests,omitempty"`   // Default 5
+	Window       time.Duration `mapstructure:"window" json:"window,omitempty"`              // Default 1m
+	CoolDown     time.Duration `mapstructure:"cool_down" json:"coolDown,omitempty"`         // Default 30s
+	Probes       int           `mapstructure:"probes" json:"probes,omitempty"`              // Default 1
+}
+
+// LimitConfig throttles deliveries. Deliveries wait for their turn up to
+// MaxWait (default 30s) and fail as throttled after that.
+type LimitConfig struct {
+	RateLimit   float64       `mapstructure:"rate_limit" json:"rateLimit,omitempty"` // Deliveries per second, 0 is unlimited
+	Burst       int           `mapstructure:"burst" json:"burst,omitempty"`
+	MaxInFlight int           `mapstructure:"max_in_flight" json:"maxInFlight,omitempty"` // Concurrent deliveries, 0 is unlimited
+	MaxWait     time.Duration `mapstructure:"max_wait" json:"maxWait,omitempty"`
+}
+
+// Limited reports whether any limit is set.
+func (c LimitConfig) Limited() bool {
+	return c.RateLimit > 0 || c.MaxInFlight > 0
+}
+
+// RuleConfig sends events matching all of the given patterns to the listed
+// destinations. Patterns support * and ? wildcards, an empty pattern matches
+// anything. Tags are attached to the events the rule matches, so they can be
+// found again in the event history. Enrich lists the enrichment stages run
+// before matching events are delivered, see EnrichGraph.
+type RuleConfig struct {
+	Name         string   `mapstructure:"name" json:"name"`
+	Source       string   `mapstructure:"source" json:"source,omitempty"`
+	Type         string   `mapstructure:"type" json:"type,omitempty"`
+	Subject      string   `mapstructure:"subject" json:"subject,omitempty"`
+	Destinations []string `mapstructure:"destinations" json:"destinations"`
+	Tags         []string `mapstructure:"tags" json:"tags,omitempty"` // Added to matching events
+	Enrich       []string `mapstructure:"enrich" json:"enrich,omitempty"`
+
+	Coalesce  *CoalesceConfig  `mapstructure:"coalesce" json:"coalesce,omitempty"`
+	Aggregate *AggregateConfig `mapstructure:"aggregate" json:"aggregate,omitempty"`
+	Delay     *DelayConfig     `mapstructure:"delay" json:"delay,omitempty"`
+}
+
+// CoalesceConfig merges bursts of events matching a rule into one event for
+// the rule's destinations. Events with the same key are collected until no
+// further event arrived for Quiet, or at most for MaxWait.
+type CoalesceConfig struct {
+	Key     string        `mapstructure:"key" json:"key,omitempty"`          // Template, default {source}|{type}|{subject}
+	Quiet   time.Duration `mapstructure:"quiet" json:"quiet,omitempty"`      // Default 10s
+	MaxWait time.Duration `mapstructure:"max_wait" json:"maxWait,omitempty"` // Default 2m
+}
+
+// AggregateConfig replaces the events matching a rule with one aggregate
+// event per key and tumbling window, delivered to the rule's destinations
+// when the window closes.
+type AggregateConfig struct {
+	Key    string        `mapstructure:"key" json:"key,omitempty"`       // Template, default {subject}
+	Window time.Duration `mapstructure:"window" json:"window,omitempty"` // Default 1h
+	// Timezone of the windows, default UTC. Windows start at midnight, so
+	// shorter windows must divide a day and longer ones be whole days.
+	Timezone string `mapstructure:"timezone" json:"timezone,omitempty"`
+	Item     string `mapstructure:"item" json:"item,omitempty"`          // Template of the listed entries, no list when empty
+	MaxItems int    `mapstructure:"max_items" json:"maxItems,omitempty"` // Default 100
+}
+
+// DelayConfig delivers the events matching a rule to its destinations
+// later: After the event, or at the time At expands to. A pending delivery is
+// cancelled by a later event matching one of Cancel with the same key.
+type DelayConfig struct {
+	After time.Duration `mapstructure:"after" json:"after,omitempty"`
+	// At is a template of an RFC 3339 time, e.g. {payload.remindAt}. After is
+	// used when it expands to nothing.
+	At     string         `mapstructure:"at" json:"at,omitempty"`
+	Key    string         `mapstructure:"key" json:"key,omitempty"` // Template, default {subject}
+	Cancel []CancelConfig `mapstructure:"cancel" json:"cancel,omitempty"`
+}
+
+// CancelConfig matches the events cancelling the pending deliveries of a
+// delaying rule, with patterns like RuleConfig.
+type CancelConfig struct {
+	Source  string `mapstructure:"source" json:"source,omitempty"`
+	Type    string `mapstructure:"type" json:"type,omitempty"`
+	Subject string `mapstructure:"subject" json:"subject,omitempty"`
+	Key     string `mapstructure:"key" json:"key,omitempty"` // Template, default the key of the delay
+}
+
+// EnrichGraph fetches the resources of Microsoft Graph notifications and adds
+// them to the payload.
+const EnrichGraph = "graph"
+
+// enrichments are the known enrichment stages.
+var enrichments = map[string]bool{EnrichGraph: true}
+
+// DefaultConfig is used when no configuration file exists. It keeps the
+// original behaviour of saving every event in MagicMix.
+func DefaultConfig() *Config {
+	return &Config{
+		Destinations: []DestinationConfig{
+			{Name: "magicmix", Type: "magicmix"},
+		},
+		Rules: []RuleConfig{
+			{Name: "default", Destinations: []string{"magicmix"}},
+		},
+	}
+}
+
+// LoadConfig reads the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+	return &cfg, nil
+}
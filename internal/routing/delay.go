@@ -0,0 +1,125 @@
+package routing
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+)
+
+// Delay is a compiled DelayConfig.
+type Delay struct {
+	After  time.Duration
+	At     *Template // Nil without an absolute time
+	Key    *Template
+	Cancel []*Cancel
+}
+
+// Cancel is a compiled CancelConfig.
+type Cancel struct {
+	Key *Template
+
+	source    *regexp.Regexp
+	eventType *regexp.Regexp
+	subject   *regexp.Regexp
+}
+
+// DefaultDelayKey is the key of delays without one.
+const DefaultDelayKey = "{subject}"
+
+func compileDelay(cfg *DelayConfig) (*Delay, error) {
+	d := &Delay{After: cfg.After}
+	if d.After < 0 {
+		return nil, fmt.Errorf("after must not be negative")
+	}
+	if d.After == 0 && cfg.At == "" {
+		return nil, fmt.Errorf("after or at is required")
+	}
+	key := cfg.Key
+	if key == "" {
+		key = DefaultDelayKey
+	}
+	var err error
+	if d.Key, err = CompileTemplate(key); err != nil {
+		return nil, err
+	}
+	if cfg.At != "" {
+		if d.At, err = CompileTemplate(cfg.At); err != nil {
+			return nil, fmt.Errorf("at: %w", err)
+		}
+	}
+	for i, cc := range cfg.Cancel {
+		c := &Cancel{Key: d.Key}
+		if cc.Key != "" {
+			if c.Key, err = CompileTemplate(cc.Key); err != nil {
+				return nil, fmt.Errorf("cancel #%d key: %w", i+1, err)
+			}
+		}
+		if c.source, err = compilePattern(cc.Source); err != nil {
+			return nil, fmt.Errorf("cancel #%d source: %w", i+1, err)
+		}
+		if c.eventType, err = compilePattern(cc.Type); err != nil {
+			return nil, fmt.Errorf("cancel #%d type: %w", i+1, err)
+		}
+		if c.subject, err = compilePattern(cc.Subject); err != nil {
+			return nil, fmt.Errorf("cancel #%d subject: %w", i+1, err)
+		}
+		d.Cancel = append(d.Cancel, c)
+	}
+	return d, nil
+}
+
+// Due returns when the event is delivered. An absolute time which does not
+// parse is reported with the due time after the delay.
+func (d *Delay) Due(ev events.Event) (time.Time, error) {
+	due := ev.Time.Add(d.After)
+	if d.At == nil {
+		return due, nil
+	}
+	raw := d.At.Expand(ev)
+	if raw == "" {
+		return due, nil
+	}
+	at, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return due, fmt.Errorf("delay at %q: %w", raw, err)
+	}
+	return at, nil
+}
+
+// Matches reports whether the event satisfies all patterns of the cancel.
+func (c *Cancel) Matches(ev events.Event) bool {
+	return matchPattern(c.source, ev.Source) &&
+		matchPattern(c.eventType, ev.Type) &&
+		matchPattern(c.subject, ev.Subject)
+}
+
+// Cancellation names the pending deliveries an event cancels.
+type Cancellation struct {
+	Rule string
+	Key  string
+}
+
+// Cancellations returns the keys of the delaying rules whose pending
+// deliveries the event cancels.
+func (rs *RuleSet) Cancellations(ev events.Event) []Cancellation {
+	var result []Cancellation
+	seen := map[Cancellation]bool{}
+	for _, rule := range rs.rules(ev) {
+		if rule.Delay == nil {
+			continue
+		}
+		for _, c := range rule.Delay.Cancel {
+			if !c.Matches(ev) {
+				continue
+			}
+			cancellation := Cancellation{Rule: rule.Name, Key: c.Key.Expand(ev)}
+			if !seen[cancellation] {
+				seen[cancellation] = true
+				result = append(result, cancellation)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,212 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// watchDebounce groups the burst of file system events editors produce when
+// saving a file into a single reload.
+const watchDebounce = 250 * time.Millisecond
+
+// Router holds the active RuleSet and reloads it from the configuration file.
+type Router struct {
+	path    string
+	factory Factory
+	obs     *observability.Observability
+
+	current  atomic.Pointer[RuleSet]
+	mu       sync.Mutex // Serializes reloads
+	lastHash []byte
+
+	reloads         *prometheus.CounterVec
+	lastReloadError prometheus.Gauge
+	lastReloadTime  prometheus.Gauge
+}
+
+// NewRouter loads the configuration at path and compiles it. When the file
+// does not exist the DefaultConfig is used.
+func NewRouter(obs *observability.Observability, path string, factory Factory) (*Router, error) {
+	r := &Router{
+		path:    path,
+		factory: factory,
+		obs:     obs,
+		reloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "emit_config_reloads_total",
+				Help: "Number of routing configuration reloads by result",
+			},
+			[]string{"result"},
+		),
+		lastReloadError: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "emit_config_last_reload_error",
+			Help: "1 if the last routing configuration reload was rejected, 0 otherwise",
+		}),
+		lastReloadTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "emit_config_last_reload_success_timestamp_seconds",
+			Help: "Time of the last successful routing configuration reload",
+		}),
+	}
+	obs.MetricsRegistry.MustRegister(r.reloads, r.lastReloadError, r.lastReloadTime)
+
+	cfg, err := LoadConfig(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		obs.Info("No routing configuration found, using defaults", zap.String("path", path))
+		cfg, err = DefaultConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs, err := Compile(cfg, factory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing configuration %s: %w", path, err)
+	}
+	r.swap(rs)
+	r.lastHash, _ = fileHash(path)
+	return r, nil
+}
+
+// Path returns the location of the configuration file.
+func (r *Router) Path() string {
+	return r.path
+}
+
+// Current returns the active RuleSet.
+func (r *Router) Current() *RuleSet {
+	return r.current.Load()
+}
+
+// Route routes the event using the active RuleSet.
+func (r *Router) Route(ev events.Event) ([]Destination, []string) {
+	return r.Current().Route(ev)
+}
+
+// Plan plans the delivery of the event using the active RuleSet.
+func (r *Router) Plan(ev events.Event) ([]Destination, []Held, []string) {
+	return r.Current().Plan(ev)
+}
+
+// Enrichments returns the enrichment stages of the event using the active
+// RuleSet.
+func (r *Router) Enrichments(ev events.Event) []string {
+	return r.Current().Enrichments(ev)
+}
+
+// Reload reads and compiles the configuration file. If anything is wrong the
+// active RuleSet is kept and the error is returned.
+func (r *Router) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash, _ := fileHash(r.path)
+	return r.reload(hash)
+}
+
+func (r *Router) reload(hash []byte) error {
+	cfg, err := LoadConfig(r.path)
+	if err == nil {
+		var rs *RuleSet
+		rs, err = Compile(cfg, r.factory)
+		if err == nil {
+			r.swap(rs)
+			r.lastHash = hash
+			r.reloads.WithLabelValues("success").Inc()
+			r.lastReloadError.Set(0)
+			r.lastReloadTime.Set(float64(rs.LoadedAt.Unix()))
+			r.obs.Info("Routing configuration reloaded",
+				zap.String("path", r.path),
+				zap.Int("rules", len(rs.Rules)),
+				zap.Int("destinations", len(rs.Destinations)))
+			return nil
+		}
+	}
+
+	r.reloads.WithLabelValues("failure").Inc()
+	r.lastReloadError.Set(1)
+	r.obs.Error("Routing configuration rejected, keeping the active one",
+		zap.String("path", r.path), zap.Error(err))
+	return err
+}
+
+func (r *Router) swap(rs *RuleSet) {
+	r.current.Store(rs)
+}
+
+// Watch reloads the configuration whenever the file changes until ctx is
+// done. The directory is watched rather than the file, so editors replacing
+// the file and Kubernetes ConfigMap symlink swaps are picked up as well.
+func (r *Router) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		return err
+	}
+
+	var timer *time.Timer
+	fire := make(chan struct{}, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(watchDebounce, func() {
+				select {
+				case fire <- struct{}{}:
+				default:
+				}
+			})
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			r.obs.Warning("Routing configuration watcher error", zap.Error(err))
+		case <-fire:
+			r.reloadIfChanged()
+		}
+	}
+}
+
+func (r *Router) reloadIfChanged() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash, err := fileHash(r.path)
+	if err != nil || bytes.Equal(hash, r.lastHash) {
+		return
+	}
+	r.reload(hash)
+}
+
+func fileHash(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
@@ -0,0 +1,409 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hooks"
+)
+
+// Destination receives the events routed to it.
+type Destination interface {
+	Name() string
+	Deliver(ctx context.Context, ev events.Event) error
+}
+
+// RetryAfterError is returned by destinations when the upstream asks to hold
+// back further calls until a time, e.g. with Retry-After.
+type RetryAfterError struct {
+	Until time.Time
+	Err   error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", e.Err, e.Until.Format(time.RFC3339))
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// Factory builds a destination from its configuration.
+type Factory func(cfg DestinationConfig) (Destination, error)
+
+// Rule is a compiled RuleConfig.
+type Rule struct {
+	Name         string
+	Destinations []Destination
+	Tags         []string
+	Enrich       []string
+	Coalesce     *Coalesce  // Set for coalescing rules
+	Aggregate    *Aggregate // Set for aggregating rules
+	Delay        *Delay     // Set for delaying rules
+
+	source    *regexp.Regexp
+	eventType *regexp.Regexp
+	subject   *regexp.Regexp
+}
+
+// Coalesce is a compiled CoalesceConfig.
+type Coalesce struct {
+	Key     *Template
+	Quiet   time.Duration
+	MaxWait time.Duration
+}
+
+// Default coalescing settings.
+const (
+	DefaultCoalesceKey     = "{source}|{type}|{subject}"
+	DefaultCoalesceQuiet   = 10 * time.Second
+	DefaultCoalesceMaxWait = 2 * time.Minute
+)
+
+func compileCoalesce(cfg *CoalesceConfig) (*Coalesce, error) {
+	c := &Coalesce{Quiet: cfg.Quiet, MaxWait: cfg.MaxWait}
+	key := cfg.Key
+	if key == "" {
+		key = DefaultCoalesceKey
+	}
+	var err error
+	if c.Key, err = CompileTemplate(key); err != nil {
+		return nil, err
+	}
+	if c.Quiet <= 0 {
+		c.Quiet = DefaultCoalesceQuiet
+	}
+	if c.MaxWait <= 0 {
+		c.MaxWait = DefaultCoalesceMaxWait
+	}
+	if c.MaxWait < c.Quiet {
+		return nil, fmt.Errorf("max_wait %s is shorter than quiet %s", c.MaxWait, c.Quiet)
+	}
+	return c, nil
+}
+
+// Matches reports whether the event satisfies all patterns of the rule.
+func (r *Rule) Matches(ev events.Event) bool {
+	return matchPattern(r.source, ev.Source) &&
+		matchPattern(r.eventType, ev.Type) &&
+		matchPattern(r.subject, ev.Subject)
+}
+
+// RuleSet is an immutable, compiled configuration.
+type RuleSet struct {
+	Rules        []*Rule
+	Destinations map[string]Destination
+	Sources      map[string]*hooks.Source // Generic webhook sources by name
+	Tenants      map[string]*Tenant       // Tenants by name
+	Schedules    []*Schedule
+	Config       *Config // The configuration the set was compiled from
+	LoadedAt     time.Time
+
+	tenantIDs map[string]*Tenant // By source and tenant value
+}
+
+// Compile validates the configuration and builds the destinations using
+// factory. Nothing is returned unless the whole configuration is valid.
+func Compile(cfg *Config, factory Factory) (*RuleSet, error) {
+	rs := &RuleSet{
+		Destinations: make(map[string]Destination, len(cfg.Destinations)),
+		Sources:      make(map[string]*hooks.Source, len(cfg.Sources)),
+		Config:       cfg,
+		LoadedAt:     time.Now().UTC(),
+	}
+
+	for i, dc := range cfg.Destinations {
+		if dc.Name == "" {
+			return nil, fmt.Errorf("destination #%d has no name", i+1)
+		}
+		if _, exists := rs.Destinations[dc.Name]; exists {
+			return nil, fmt.Errorf("destination %q is declared more than once", dc.Name)
+		}
+		if dc.Limits.RateLimit < 0 || dc.Limits.MaxInFlight < 0 {
+			return nil, fmt.Errorf("destination %q has negative limits", dc.Name)
+		}
+		if dc.Breaker.FailureRatio < 0 || dc.Breaker.FailureRatio > 1 {
+			return nil, fmt.Errorf("destination %q breaker failure_ratio must be between 0 and 1", dc.Name)
+		}
+		d, err := factory(dc)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q: %w", dc.Name, err)
+		}
+		rs.Destinations[dc.Name] = d
+	}
+
+	var err error
+	if rs.Rules, err = rs.compileRules(cfg.Rules, ""); err != nil {
+		return nil, err
+	}
+
+	for _, sc := range cfg.Sources {
+		if _, exists := rs.Sources[sc.Name]; exists {
+			return nil, fmt.Errorf("source %q is declared more than once", sc.Name)
+		}
+		if events.Reserved(sc.Name) {
+			return nil, fmt.Errorf("source %q is reserved for the events of the emitter", sc.Name)
+		}
+		source, err := hooks.New(sc)
+		if err != nil {
+			return nil, err
+		}
+		rs.Sources[sc.Name] = source
+	}
+
+	if err := rs.compileTenants(cfg); err != nil {
+		return nil, err
+	}
+	if err := rs.compileSchedules(cfg); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// compileRules compiles the rules of the configuration or, with a prefix,
+// of a tenant. Tenant rule names are prefixed with the tenant name.
+func (rs *RuleSet) compileRules(configs []RuleConfig, prefix string) ([]*Rule, error) {
+	var rules []*Rule
+	names := make(map[string]bool, len(configs))
+	for i, rc := range configs {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i+1)
+		}
+		name = prefix + name
+		if names[name] {
+			return nil, fmt.Errorf("rule %q is declared more than once", name)
+		}
+		names[name] = true
+
+		if len(rc.Destinations) == 0 {
+			return nil, fmt.Errorf("rule %q has no destinations", name)
+		}
+		rule := &Rule{Name: name, Tags: rc.Tags, Enrich: rc.Enrich}
+		for _, e := range rc.Enrich {
+			if !enrichments[e] {
+				return nil, fmt.Errorf("rule %q has unknown enrichment %q", name, e)
+			}
+		}
+		var err error
+		modes := 0
+		for _, set := range []bool{rc.Coalesce != nil, rc.Aggregate != nil, rc.Delay != nil} {
+			if set {
+				modes++
+			}
+		}
+		if modes > 1 {
+			return nil, fmt.Errorf("rule %q can use only one of coalesce, aggregate and delay", name)
+		}
+		if rc.Coalesce != nil {
+			if rule.Coalesce, err = compileCoalesce(rc.Coalesce); err != nil {
+				return nil, fmt.Errorf("rule %q coalesce: %w", name, err)
+			}
+		}
+		if rc.Aggregate != nil {
+			if rule.Aggregate, err = compileAggregate(rc.Aggregate); err != nil {
+				return nil, fmt.Errorf("rule %q aggregate: %w", name, err)
+			}
+		}
+		if rc.Delay != nil {
+			if rule.Delay, err = compileDelay(rc.Delay); err != nil {
+				return nil, fmt.Errorf("rule %q delay: %w", name, err)
+			}
+		}
+		if rule.source, err = compilePattern(rc.Source); err != nil {
+			return nil, fmt.Errorf("rule %q source: %w", name, err)
+		}
+		if rule.eventType, err = compilePattern(rc.Type); err != nil {
+			return nil, fmt.Errorf("rule %q type: %w", name, err)
+		}
+		if rule.subject, err = compilePattern(rc.Subject); err != nil {
+			return nil, fmt.Errorf("rule %q subject: %w", name, err)
+		}
+		for _, dn := range rc.Destinations {
+			d, ok := rs.Destinations[dn]
+			if !ok {
+				return nil, fmt.Errorf("rule %q refers to unknown destination %q", name, dn)
+			}
+			rule.Destinations = append(rule.Destinations, d)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// rules returns the global rules followed by those of the event's tenant.
+func (rs *RuleSet) rules(ev events.Event) []*Rule {
+	t, ok := rs.Tenants[ev.Tenant]
+	if !ok || len(t.Rules) == 0 {
+		return rs.Rules
+	}
+	rules := make([]*Rule, 0, len(rs.Rules)+len(t.Rules))
+	rules = append(rules, rs.Rules...)
+	return append(rules, t.Rules...)
+}
+
+// Match returns the destinations of all rules matching the event, including
+// the rules of its tenant. A destination referenced by several matching
+// rules is only returned once.
+func (rs *RuleSet) Match(ev events.Event) []Destination {
+	destinations, _ := rs.Route(ev)
+	return destinations
+}
+
+// Route is Match which also returns the tags of the matching rules. The
+// destinations of aggregating and delaying rules are left out, they only
+// receive aggregates and the delayed copies of the event.
+func (rs *RuleSet) Route(ev events.Event) ([]Destination, []string) {
+	result, held, tags := rs.Plan(ev)
+	seen := make(map[string]bool, len(result))
+	for _, d := range result {
+		seen[d.Name()] = true
+	}
+	for _, h := range held {
+		if h.Rule.Coalesce == nil {
+			continue
+		}
+		for _, d := range h.Destinations {
+			if !seen[d.Name()] {
+				seen[d.Name()] = true
+				result = append(result, d)
+			}
+		}
+	}
+	return result, tags
+}
+
+// Held are the destinations an event reaches through a coalescing,
+// aggregating or delaying rule.
+type Held struct {
+	Rule         *Rule
+	Key          string // The expanded key template
+	Destinations []Destination
+}
+
+// Plan is Route which sets apart the destinations of coalescing, aggregating
+// and delaying rules. These are not part of the returned destinations, they
+// receive the merged event of a burst, the aggregate of a window or a
+// delayed copy of the event later.
+//
+// The merged event stands for the events of the burst, so a coalescing rule
+// only holds the destinations no other matching rule delivers to, and a
+// destination is held by the first such rule. Aggregates and delayed copies
+// are deliveries of their own, so those rules hold all their destinations.
+func (rs *RuleSet) Plan(ev events.Event) ([]Destination, []Held, []string) {
+	var result []Destination
+	var held []Held
+	var tags []string
+	seen := map[string]bool{}
+	var deferred []*Rule
+	for _, rule := range rs.rules(ev) {
+		if !rule.Matches(ev) {
+			continue
+		}
+		for _, tag := range rule.Tags {
+			if !seen["tag:"+tag] {
+				seen["tag:"+tag] = true
+				tags = append(tags, tag)
+			}
+		}
+		if rule.Coalesce != nil || rule.Aggregate != nil || rule.Delay != nil {
+			deferred = append(deferred, rule)
+			continue
+		}
+		for _, d := range rule.Destinations {
+			if seen[d.Name()] {
+				continue
+			}
+			seen[d.Name()] = true
+			result = append(result, d)
+		}
+	}
+	for _, rule := range deferred {
+		h := Held{Rule: rule}
+		switch {
+		case rule.Aggregate != nil:
+			h.Key = rule.Aggregate.Key.Expand(ev)
+			h.Destinations = rule.Destinations
+			held = append(held, h)
+			continue
+		case rule.Delay != nil:
+			h.Key = rule.Delay.Key.Expand(ev)
+			h.Destinations = rule.Destinations
+			held = append(held, h)
+			continue
+		}
+		h.Key = rule.Coalesce.Key.Expand(ev)
+		for _, d := range rule.Destinations {
+			if seen[d.Name()] {
+				continue
+			}
+			seen[d.Name()] = true
+			h.Destinations = append(h.Destinations, d)
+		}
+		if len(h.Destinations) > 0 {
+			held = append(held, h)
+		}
+	}
+	return result, held, tags
+}
+
+// Rule returns the rule with the name among the global rules and those of
+// the event's tenant.
+func (rs *RuleSet) Rule(ev events.Event, name string) (*Rule, bool) {
+	for _, rule := range rs.rules(ev) {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// Enrichments returns the enrichment stages of all rules matching the event.
+// An enrichment applies to the event as a whole, so all its destinations
+// receive the enriched payload.
+func (rs *RuleSet) Enrichments(ev events.Event) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, rule := range rs.rules(ev) {
+		if !rule.Matches(ev) {
+			continue
+		}
+		for _, e := range rule.Enrich {
+			if !seen[e] {
+				seen[e] = true
+				result = append(result, e)
+			}
+		}
+	}
+	return result
+}
+
+// compilePattern turns a wildcard pattern into an anchored regular
+// expression. An empty pattern compiles to nil which matches anything.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" || pattern == "*" {
+		return nil, nil
+	}
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func matchPattern(re *regexp.Regexp, value string) bool {
+	return re == nil || re.MatchString(value)
+}
@@ -0,0 +1,465 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hooks"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+)
+
+type testDestination struct {
+	name string
+}
+
+func (d *testDestination) Name() string {
+	return d.name
+}
+
+func (d *testDestination) Deliver(ctx context.Context, ev events.Event) error {
+	return nil
+}
+
+func testFactory(cfg DestinationConfig) (Destination, error) {
+	if cfg.Type != "test" {
+		return nil, fmt.Errorf("unknown destination type %q", cfg.Type)
+	}
+	return &testDestination{name: cfg.Name}, nil
+}
+
+func TestRuleSet_Match(t *testing.T) {
+	cfg := &Config{
+		Destinations: []DestinationConfig{
+			{Name: "mix", Type: "test"},
+			{Name: "workflow", Type: "test"},
+		},
+		Rules: []RuleConfig{
+			{Name: "all", Destinations: []string{"mix"}},
+			{Name: "closed-prs", Source: "github", Type: "pull_request.closed", Destinations: []string{"workflow", "mix"}},
+			{Name: "drive", Source: "microsoftgraph", Subject: "drives/*", Destinations: []string{"workflow"}},
+		},
+	}
+	rs, err := Compile(cfg, testFactory)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ev   events.Event
+		want []string
+	}{
+		{
+			name: "Only catch-all",
+			ev:   events.Event{Source: "github", Type: "push"},
+			want: []string{"mix"},
+		},
+		{
+			name: "Destination is delivered once",
+			ev:   events.Event{Source: "github", Type: "pull_request.closed"},
+			want: []string{"mix", "workflow"},
+		},
+		{
+			name: "Wildcard crosses slashes",
+			ev:   events.Event{Source: "microsoftgraph", Type: "updated", Subject: "drives/b!abc/root"},
+			want: []string{"mix", "workflow"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rs.Match(tt.ev)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Match() returned %d destinations, want %d", len(got), len(tt.want))
+			}
+			for i, d := range got {
+				if d.Name() != tt.want[i] {
+					t.Errorf("Match()[%d] = %s, want %s", i, d.Name(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{
+			name: "Unknown destination",
+			cfg: Config{
+				Rules: []RuleConfig{{Name: "r", Destinations: []string{"missing"}}},
+			},
+		},
+		{
+			name: "Unknown destination type",
+			cfg: Config{
+				Destinations: []DestinationConfig{{Name: "d", Type: "carrier-pigeon"}},
+			},
+		},
+		{
+			name: "Duplicate destination",
+			cfg: Config{
+				Destinations: []DestinationConfig{{Name: "d", Type: "test"}, {Name: "d", Type: "test"}},
+			},
+		},
+		{
+			name: "Rule without destinations",
+			cfg: Config{
+				Rules: []RuleConfig{{Name: "r"}},
+			},
+		},
+		{
+			name: "Negative limits",
+			cfg: Config{
+				Destinations: []DestinationConfig{{Name: "d", Type: "test", Limits: LimitConfig{RateLimit: -1}}},
+			},
+		},
+		{
+			name: "Breaker failure ratio above 1",
+			cfg: Config{
+				Destinations: []DestinationConfig{{Name: "d", Type: "test", Breaker: BreakerConfig{FailureRatio: 1.5}}},
+			},
+		},
+		{
+			name: "Source of the events of the emitter",
+			cfg: Config{
+				Sources: []hooks.Config{{Name: "schedule", Verify: hooks.VerifyConfig{Scheme: "none"}}},
+			},
+		},
+		{
+			name: "Invalid schedule cron",
+			cfg: Config{
+				Schedules: []ScheduleConfig{{Name: "s", Cron: "0 25 * * *"}},
+			},
+		},
+		{
+			name: "Unknown schedule timezone",
+			cfg: Config{
+				Schedules: []ScheduleConfig{{Name: "s", Cron: "@daily", Timezone: "Mars/Olympus"}},
+			},
+		},
+		{
+			name: "Duplicate schedule",
+			cfg: Config{
+				Schedules: []ScheduleConfig{{Name: "s", Cron: "@daily"}, {Name: "s", Cron: "@hourly"}},
+			},
+		},
+		{
+			name: "Unknown enrichment",
+			cfg: Config{
+				Destinations: []DestinationConfig{{Name: "d", Type: "test"}},
+				Rules:        []RuleConfig{{Name: "r", Destinations: []string{"d"}, Enrich: []string{"crm"}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(&tt.cfg, testFactory); err == nil {
+				t.Errorf("Compile() expected an error")
+			}
+		})
+	}
+}
+
+func TestRouter_ReloadKeepsActiveOnError(t *testing.T) {
+	obs, err := observability.NewObservability()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "emit.yaml")
+	valid := `
+destinations:
+  - name: mix
+    type: test
+rules:
+  - name: all
+    destinations: [mix]
+`
+	if err := os.WriteFile(path, []byte(valid), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(obs, path, testFactory)
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	active := router.Current()
+
+	invalid := `
+rules:
+  - name: all
+    destinations: [missing]
+`
+	if err := os.WriteFile(path, []byte(invalid), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Reload(); err == nil {
+		t.Fatalf("Reload() expected an error")
+	}
+	if router.Current() != active {
+		t.Errorf("Reload() replaced the active rule set with an invalid one")
+	}
+}
+
+func TestRuleSet_Tenant(t *testing.T) {
+	cfg := &Config{
+		Destinations: []DestinationConfig{
+			{Name: "shared", Type: "test"},
+			{Name: "contoso-mix", Type: "test"},
+		},
+		Rules: []RuleConfig{{Name: "all", Destinations: []string{"shared"}}},
+		Tenants: []TenantConfig{
+			{
+				Name:    "contoso",
+				Graph:   []string{"8F1C0D4E-0000-0000-0000-000000000001"},
+				GitHub:  []string{"contoso", "4711"},
+				Sources: map[string][]string{"billing": {"acct_1"}},
+				Rules:   []RuleConfig{{Name: "mix", Destinations: []string{"contoso-mix"}}},
+			},
+			{Name: "fabrikam", GitHub: []string{"fabrikam"}},
+		},
+		UnknownTenants: UnknownTenantsQuarantine,
+	}
+	rs, err := Compile(cfg, testFactory)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ev   events.Event
+		want string
+	}{
+		{name: "Graph tenant ID", ev: events.Event{Source: "microsoftgraph", Tenant: "8f1c0d4e-0000-0000-0000-000000000001"}, want: "contoso"},
+		{name: "SharePoint uses the Graph IDs", ev: events.Event{Source: "sharepoint", Tenant: "8f1c0d4e-0000-0000-0000-000000000001"}, want: "contoso"},
+		{name: "GitHub organization", ev: events.Event{Source: "github", Tenant: "fabrikam"}, want: "fabrikam"},
+		{name: "GitHub installation", ev: events.Event{Source: "github", Tenant: "someone", Payload: []byte(`{"installation":{"id":4711}}`)}, want: "contoso"},
+		{name: "Custom source", ev: events.Event{Source: "billing", Tenant: "acct_1"}, want: "contoso"},
+		{name: "ID of another source", ev: events.Event{Source: "billing", Tenant: "contoso-org"}},
+		{name: "Tenant name", ev: events.Event{Source: "cloudevents", Tenant: "fabrikam"}},
+		{name: "Tenant name of an emitter event", ev: events.Event{Source: "schedule", Tenant: "fabrikam", Internal: true}, want: "fabrikam"},
+		{name: "ID in an emitter event", ev: events.Event{Source: "github", Tenant: "contoso-org", Internal: true}},
+		{name: "Unknown", ev: events.Event{Source: "github", Tenant: "initech"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rs.Tenant(tt.ev)
+			if ok != (tt.want != "") || (ok && got.Name != tt.want) {
+				t.Errorf("Tenant() = %v, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+
+	// Tenant rules only apply to the tenant's events
+	if got := rs.Match(events.Event{Source: "github", Tenant: "contoso"}); len(got) != 2 {
+		t.Errorf("Match() of contoso returned %d destinations, want 2", len(got))
+	}
+	if got := rs.Match(events.Event{Source: "github", Tenant: "fabrikam"}); len(got) != 1 {
+		t.Errorf("Match() of fabrikam returned %d destinations, want 1", len(got))
+	}
+	if rs.UnknownTenantPolicy() != UnknownTenantsQuarantine {
+		t.Errorf("UnknownTenantPolicy() = %s", rs.UnknownTenantPolicy())
+	}
+
+	// An ID can only belong to one tenant
+	cfg.Tenants[1].GitHub = []string{"Contoso"}
+	if _, err := Compile(cfg, testFactory); err == nil {
+		t.Errorf("Compile() with a shared GitHub organization error = nil")
+	}
+}
+
+func TestRuleSet_Plan(t *testing.T) {
+	cfg := &Config{
+		Destinations: []DestinationConfig{
+			{Name: "mix", Type: "test"},
+			{Name: "workflow", Type: "test"},
+		},
+		Rules: []RuleConfig{
+			{Name: "all", Destinations: []string{"mix"}},
+			{
+				Name:         "documents",
+				Source:       "microsoftgraph",
+				Destinations: []string{"mix", "workflow"},
+				Coalesce:     &CoalesceConfig{Key: "{subject}|{payload.changeType}"},
+			},
+		},
+	}
+	rs, err := Compile(cfg, testFactory)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	ev := events.Event{Source: "microsoftgraph", Type: "updated", Subject: "drives/1", Payload: []byte(`{"changeType":"updated"}`)}
+	now, held, _ := rs.Plan(ev)
+	if len(now) != 1 || now[0].Name() != "mix" {
+		t.Errorf("Plan() immediate destinations = %v, want mix", now)
+	}
+	if len(held) != 1 || len(held[0].Destinations) != 1 || held[0].Destinations[0].Name() != "workflow" {
+		t.Fatalf("Plan() held = %+v, want workflow", held)
+	}
+	if held[0].Key != "drives/1|updated" {
+		t.Errorf("Plan() key = %q", held[0].Key)
+	}
+	if got := rs.Match(ev); len(got) != 2 {
+		t.Errorf("Match() returned %d destinations, want 2", len(got))
+	}
+}
+
+func TestCompileTemplate(t *testing.T) {
+	ev := events.Event{Source: "github", Type: "push", Tenant: "contoso", Payload: []byte(`{"repository":{"id":4711}}`)}
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{template: "{source}:{type}", want: "github:push"},
+		{template: "{tenant}/{payload.repository.id}", want: "contoso/4711"},
+		{template: "{payload.missing}", want: ""},
+		{template: "{unknown}", wantErr: true},
+		{template: "{source", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := CompileTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tmpl.Expand(ev) != tt.want {
+				t.Errorf("Expand() = %q, want %q", tmpl.Expand(ev), tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregate_Bounds(t *testing.T) {
+	at := time.Date(2024, 3, 31, 22, 30, 0, 0, time.UTC) // 00:30 on 1 April in Copenhagen
+	tests := []struct {
+		name      string
+		cfg       AggregateConfig
+		at        time.Time // Default at
+		wantStart string
+		wantEnd   string
+	}{
+		{name: "Hourly", cfg: AggregateConfig{}, wantStart: "2024-03-31T22:00:00Z", wantEnd: "2024-03-31T23:00:00Z"},
+		{name: "Daily in a timezone", cfg: AggregateConfig{Window: 24 * time.Hour, Timezone: "Europe/Copenhagen"},
+			wantStart: "2024-04-01T00:00:00+02:00", wantEnd: "2024-04-02T00:00:00+02:00"},
+		{name: "Two days", cfg: AggregateConfig{Window: 48 * time.Hour, Timezone: "Europe/Copenhagen"},
+			wantStart: "2024-04-01T00:00:00+02:00", wantEnd: "2024-04-03T00:00:00+02:00"},
+		{name: "Day with daylight saving change", cfg: AggregateConfig{Window: 24 * time.Hour, Timezone: "Europe/Copenhagen"},
+			at: time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC), wantStart: "2024-03-31T00:00:00+01:00", wantEnd: "2024-04-01T00:00:00+02:00"},
+		{name: "Six hours", cfg: AggregateConfig{Window: 6 * time.Hour}, wantStart: "2024-03-31T18:00:00Z", wantEnd: "2024-04-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg, err := compileAggregate(&tt.cfg)
+			if err != nil {
+				t.Fatalf("compileAggregate() error = %v", err)
+			}
+			when := at
+			if !tt.at.IsZero() {
+				when = tt.at
+			}
+			start, end := agg.Bounds(when)
+			if start.Format(time.RFC3339) != tt.wantStart || end.Format(time.RFC3339) != tt.wantEnd {
+				t.Errorf("Bounds() = %s, %s, want %s, %s",
+					start.Format(time.RFC3339), end.Format(time.RFC3339), tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+
+	for _, cfg := range []AggregateConfig{{Window: 7 * time.Hour}, {Window: 36 * time.Hour}, {Timezone: "Mars/Olympus"}} {
+		if _, err := compileAggregate(&cfg); err == nil {
+			t.Errorf("compileAggregate(%+v) error = nil", cfg)
+		}
+	}
+}
+
+func TestRuleSet_PlanAggregate(t *testing.T) {
+	cfg := &Config{
+		Destinations: []DestinationConfig{{Name: "mix", Type: "test"}},
+		Rules: []RuleConfig{
+			{Name: "all", Destinations: []string{"mix"}},
+			{Name: "merged-daily", Source: "github", Destinations: []string{"mix"}, Aggregate: &AggregateConfig{Window: 24 * time.Hour}},
+		},
+	}
+	rs, err := Compile(cfg, testFactory)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	ev := events.Event{Source: "github", Type: "pull_request.closed", Subject: "org/repo"}
+	now, held, _ := rs.Plan(ev)
+	if len(now) != 1 {
+		t.Errorf("Plan() immediate destinations = %d, want 1", len(now))
+	}
+	// The aggregate is an event of its own, so it also goes to mix
+	if len(held) != 1 || held[0].Key != "org/repo" || len(held[0].Destinations) != 1 {
+		t.Fatalf("Plan() held = %+v", held)
+	}
+	if got := rs.Match(ev); len(got) != 1 {
+		t.Errorf("Match() returned %d destinations, want 1", len(got))
+	}
+}
+
+func TestRuleSet_PlanDelay(t *testing.T) {
+	cfg := &Config{
+		Destinations: []DestinationConfig{{Name: "mix", Type: "test"}, {Name: "cleanup", Type: "test"}},
+		Rules: []RuleConfig{
+			{Name: "all", Destinations: []string{"mix"}},
+			{
+				Name: "cleanup", Source: "github", Type: "pull_request.closed", Destinations: []string{"cleanup"},
+				Delay: &DelayConfig{
+					After:  30 * time.Minute,
+					At:     "{payload.cleanupAt}",
+					Key:    "{subject}#{payload.number}",
+					Cancel: []CancelConfig{{Source: "github", Type: "pull_request.reopened"}},
+				},
+			},
+		},
+	}
+	rs, err := Compile(cfg, testFactory)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	closed := events.Event{Source: "github", Type: "pull_request.closed", Subject: "org/repo",
+		Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Payload: []byte(`{"number": 7}`)}
+	now, held, _ := rs.Plan(closed)
+	if len(now) != 1 || now[0].Name() != "mix" {
+		t.Errorf("Plan() immediate destinations = %v, want mix", now)
+	}
+	if len(held) != 1 || held[0].Key != "org/repo#7" || held[0].Destinations[0].Name() != "cleanup" {
+		t.Fatalf("Plan() held = %+v", held)
+	}
+	if got := rs.Match(closed); len(got) != 1 {
+		t.Errorf("Match() returned %d destinations, want 1", len(got))
+	}
+
+	due, err := held[0].Rule.Delay.Due(closed)
+	if err != nil || !due.Equal(closed.Time.Add(30*time.Minute)) {
+		t.Errorf("Due() = %s, %v, want 30 minutes after the event", due, err)
+	}
+	closed.Payload = []byte(`{"number": 7, "cleanupAt": "2024-05-02T08:00:00+02:00"}`)
+	if due, err := held[0].Rule.Delay.Due(closed); err != nil || due.Format(time.RFC3339) != "2024-05-02T08:00:00+02:00" {
+		t.Errorf("Due() = %s, %v, want the time of the payload", due, err)
+	}
+
+	reopened := closed
+	reopened.Type = "pull_request.reopened"
+	got := rs.Cancellations(reopened)
+	if len(got) != 1 || got[0] != (Cancellation{Rule: "cleanup", Key: "org/repo#7"}) {
+		t.Errorf("Cancellations() = %+v", got)
+	}
+	if got := rs.Cancellations(closed); len(got) != 0 {
+		t.Errorf("Cancellations() = %+v, want none for the delayed event", got)
+	}
+
+	for _, dc := range []DelayConfig{{}, {After: -time.Minute}, {After: time.Minute, Cancel: []CancelConfig{{Key: "{payload"}}}} {
+		if _, err := compileDelay(&dc); err == nil {
+			t.Errorf("compileDelay(%+v) error = nil", dc)
+		}
+	}
+}
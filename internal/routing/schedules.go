@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/cron"
+)
+
+// Schedule is a compiled ScheduleConfig.
+type Schedule struct {
+	Name     string
+	Config   ScheduleConfig
+	Cron     *cron.Schedule
+	Location *time.Location
+}
+
+// Next returns the first run of the schedule after t.
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.Cron.Next(t.In(s.Location))
+}
+
+func (rs *RuleSet) compileSchedules(cfg *Config) error {
+	names := make(map[string]bool, len(cfg.Schedules))
+	for i, sc := range cfg.Schedules {
+		if sc.Name == "" {
+			return fmt.Errorf("schedule #%d has no name", i+1)
+		}
+		if names[sc.Name] {
+			return fmt.Errorf("schedule %q is declared more than once", sc.Name)
+		}
+		names[sc.Name] = true
+
+		s := &Schedule{Name: sc.Name, Config: sc}
+		var err error
+		if s.Cron, err = cron.Parse(sc.Cron); err != nil {
+			return fmt.Errorf("schedule %q: %w", sc.Name, err)
+		}
+		if s.Location, err = time.LoadLocation(sc.Timezone); err != nil {
+			return fmt.Errorf("schedule %q timezone: %w", sc.Name, err)
+		}
+		if _, err := json.Marshal(sc.Data); err != nil {
+			return fmt.Errorf("schedule %q data: %w", sc.Name, err)
+		}
+		rs.Schedules = append(rs.Schedules, s)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hooks"
+)
+
+// Template builds a string from the fields of an event, e.g. the key
+// "{subject}|{payload.changeType}". The placeholders are {source}, {type},
+// {subject}, {tenant}, {correlation} and {payload.<path>} with a path as
+// understood by hooks.Lookup.
+type Template struct {
+	raw   string
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string
+	field   string // Empty for literals
+}
+
+var templateFields = map[string]bool{"source": true, "type": true, "subject": true, "tenant": true, "correlation": true}
+
+// CompileTemplate parses a template and checks its placeholders.
+func CompileTemplate(raw string) (*Template, error) {
+	t := &Template{raw: raw}
+	rest := raw
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("template %q has an unclosed placeholder", raw)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		field := rest[open+1 : open+end]
+		if !templateFields[field] && !strings.HasPrefix(field, "payload.") {
+			return nil, fmt.Errorf("template %q has unknown placeholder {%s}", raw, field)
+		}
+		t.parts = append(t.parts, templatePart{field: field})
+		rest = rest[open+end+1:]
+	}
+	return t, nil
+}
+
+// String returns the template as written.
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Expand fills the placeholders with the fields of the event. Missing
+// payload values expand to "".
+func (t *Template) Expand(ev events.Event) string {
+	var b strings.Builder
+	var doc interface{}
+	decoded := false
+	for _, p := range t.parts {
+		switch {
+		case p.field == "":
+			b.WriteString(p.literal)
+		case strings.HasPrefix(p.field, "payload."):
+			if !decoded {
+				d := json.NewDecoder(bytes.NewReader(ev.Payload))
+				d.UseNumber()
+				d.Decode(&doc)
+				decoded = true
+			}
+			b.WriteString(hooks.Lookup(doc, strings.TrimPrefix(p.field, "payload.")))
+		default:
+			b.WriteString(eventField(ev, p.field))
+		}
+	}
+	return b.String()
+}
+
+func eventField(ev events.Event, field string) string {
+	switch field {
+	case "source":
+		return ev.Source
+	case "type":
+		return ev.Type
+	case "subject":
+		return ev.Subject
+	case "tenant":
+		return ev.Tenant
+	case "correlation":
+		return ev.CorrelationID
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/hooks"
+	"github.com/nexi-intra/koksmat-emit/internal/ratelimit"
+)
+
+// Policies for events of unknown tenants.
+const (
+	UnknownTenantsAllow      = "allow"      // Keep the tenant as sent
+	UnknownTenantsReject     = "reject"     // Refuse the event
+	UnknownTenantsQuarantine = "quarantine" // Keep the event in the history without routing it
+)
+
+// TenantConfig maps the identities of a customer at the sources to a Koksmat
+// tenant, and holds the settings of the tenant.
+type TenantConfig struct {
+	Name    string              `mapstructure:"name" json:"name"`
+	Graph   []string            `mapstructure:"graph" json:"graph,omitempty"`     // Entra ID tenant IDs, for microsoftgraph and sharepoint events
+	GitHub  []string            `mapstructure:"github" json:"github,omitempty"`   // Organization logins or app installation IDs
+	Sources map[string][]string `mapstructure:"sources" json:"sources,omitempty"` // Tenant values of other sources, by source
+	// Secrets names the settings holding the tenant's secrets by source:
+	// github verifies X-Hub-Signature-256, microsoftgraph the client state.
+	Secrets         map[string]string `mapstructure:"secrets" json:"secrets,omitempty"`
+	RateLimit       float64           `mapstructure:"rate_limit" json:"rateLimit,omitempty"` // Accepted events per second, 0 is unlimited
+	Burst           int               `mapstructure:"burst" json:"burst,omitempty"`
+	MagicMixSubject string            `mapstructure:"magicmix_subject" json:"magicmixSubject,omitempty"`
+	Delivery        LimitConfig       `mapstructure:"delivery" json:"delivery,omitempty"` // Limits the deliveries of the tenant's events
+	Rules           []RuleConfig      `mapstructure:"rules" json:"rules,omitempty"`       // Only applied to the tenant's events
+}
+
+// Tenant is a compiled TenantConfig.
+type Tenant struct {
+	Name   string
+	Config TenantConfig
+	Rules  []*Rule
+
+	limiter *ratelimit.Bucket
+}
+
+// Allow reports whether an event of the tenant is within its rate limit.
+func (t *Tenant) Allow() bool {
+	return t.limiter == nil || t.limiter.Allow()
+}
+
+// tenantSources are the sources identified by the Graph tenant IDs.
+var tenantSources = map[string]string{
+	"microsoftgraph": "graph",
+	"sharepoint":     "graph",
+	"github":         "github",
+}
+
+func tenantKey(source, id string) string {
+	return source + "|" + strings.ToLower(id)
+}
+
+func (rs *RuleSet) compileTenants(cfg *Config) error {
+	rs.Tenants = make(map[string]*Tenant, len(cfg.Tenants))
+	rs.tenantIDs = map[string]*Tenant{}
+	switch cfg.UnknownTenants {
+	case "", UnknownTenantsAllow, UnknownTenantsReject, UnknownTenantsQuarantine:
+	default:
+		return fmt.Errorf("unknown_tenants must be allow, reject or quarantine, not %q", cfg.UnknownTenants)
+	}
+
+	for i, tc := range cfg.Tenants {
+		if tc.Name == "" {
+			return fmt.Errorf("tenant #%d has no name", i+1)
+		}
+		if _, exists := rs.Tenants[tc.Name]; exists {
+			return fmt.Errorf("tenant %q is declared more than once", tc.Name)
+		}
+		t := &Tenant{Name: tc.Name, Config: tc}
+		if tc.RateLimit < 0 {
+			return fmt.Errorf("tenant %q has a negative rate limit", tc.Name)
+		}
+		if tc.RateLimit > 0 {
+			t.limiter = ratelimit.NewBucket(tc.RateLimit, tc.Burst)
+		}
+		var err error
+		if t.Rules, err = rs.compileRules(tc.Rules, tc.Name+"/"); err != nil {
+			return err
+		}
+
+		ids := map[string][]string{}
+		for source, kind := range tenantSources {
+			switch kind {
+			case "graph":
+				ids[source] = tc.Graph
+			case "github":
+				ids[source] = tc.GitHub
+			}
+		}
+		for source, values := range tc.Sources {
+			ids[source] = append(ids[source], values...)
+		}
+		for source, values := range ids {
+			for _, id := range values {
+				key := tenantKey(source, id)
+				if other, exists := rs.tenantIDs[key]; exists {
+					return fmt.Errorf("%s tenant %q is mapped to %q and %q", source, id, other.Name, tc.Name)
+				}
+				rs.tenantIDs[key] = t
+			}
+		}
+		rs.Tenants[tc.Name] = t
+	}
+	return nil
+}
+
+// Tenant returns the tenant of the event, found by the tenant value the
+// receiver set or, for GitHub, the app installation. Only events the emitter
+// created itself are looked up by tenant name, a sender cannot pick a tenant
+// by naming it.
+func (rs *RuleSet) Tenant(ev events.Event) (*Tenant, bool) {
+	if ev.Internal {
+		t, ok := rs.Tenants[ev.Tenant]
+		return t, ok
+	}
+	candidates := []string{ev.Tenant}
+	if ev.Source == "github" {
+		var doc interface{}
+		if json.Unmarshal(ev.Payload, &doc) == nil {
+			candidates = append(candidates, hooks.Lookup(doc, "installation.id"))
+		}
+	}
+	for _, id := range candidates {
+		if t, ok := rs.tenantIDs[tenantKey(ev.Source, id)]; id != "" && ok {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// UnknownTenantPolicy returns the policy for events of unknown tenants.
+func (rs *RuleSet) UnknownTenantPolicy() string {
+	if rs.Config == nil || rs.Config.UnknownTenants == "" {
+		return UnknownTenantsAllow
+	}
+	return rs.Config.UnknownTenants
+}
@@ -0,0 +1,234 @@
+// Package scheduler fires events on the schedules of the routing
+// configuration.
+//
+// Every run is claimed in a State shared by the replicas before it fires,
+// so only one replica fires it. Runs missed while no replica was running
+// are not caught up.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"go.uber.org/zap"
+)
+
+// Source is the source of the scheduled events.
+const Source = events.SourceSchedule
+
+// ErrUnknownSchedule is returned for schedules missing in the configuration.
+var ErrUnknownSchedule = errors.New("unknown schedule")
+
+// Run is a firing of a schedule.
+type Run struct {
+	Schedule    string    `json:"schedule"`
+	ScheduledAt time.Time `json:"scheduledAt"`
+	FiredAt     time.Time `json:"firedAt"`
+	EventID     string    `json:"eventId,omitempty"`
+	Replica     string    `json:"replica"`
+	Manual      bool      `json:"manual,omitempty"` // Triggered through the admin API
+	Error       string    `json:"error,omitempty"`
+}
+
+// State is shared by the replicas.
+type State interface {
+	// Claim reports whether the run at the time was claimed by the caller.
+	// A run is only claimed once.
+	Claim(schedule string, at time.Time) (bool, error)
+	// Record saves the last run of a schedule.
+	Record(run Run) error
+	// Last returns the last run of a schedule.
+	Last(schedule string) (Run, bool, error)
+}
+
+// Emitter accepts the scheduled events.
+type Emitter func(ctx context.Context, ev events.Event) error
+
+// Status describes a schedule.
+type Status struct {
+	Name     string    `json:"name"`
+	Cron     string    `json:"cron"`
+	Timezone string    `json:"timezone"`
+	Next     time.Time `json:"next"`
+	Last     *Run      `json:"last,omitempty"`
+}
+
+// Scheduler fires the schedules of the active routing configuration.
+type Scheduler struct {
+	obs     *observability.Observability
+	state   State
+	emit    Emitter
+	router  *routing.Router
+	replica string
+	now     func() time.Time
+
+	mu   sync.Mutex
+	next map[string]planned
+}
+
+type planned struct {
+	schedule *routing.Schedule // Replaced on reload
+	at       time.Time
+}
+
+// New returns a Scheduler. The host name identifies the replica in the runs.
+func New(obs *observability.Observability, router *routing.Router, state State, emit Emitter) *Scheduler {
+	replica, _ := os.Hostname()
+	return &Scheduler{
+		obs:     obs,
+		state:   state,
+		emit:    emit,
+		router:  router,
+		replica: replica,
+		now:     time.Now,
+		next:    map[string]planned{},
+	}
+}
+
+// plan plans the next runs of new or changed schedules. With take, the due
+// schedules are returned and their following run is planned.
+func (s *Scheduler) plan(now time.Time, take bool) []planned {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := s.router.Current().Schedules
+	active := make(map[string]bool, len(schedules))
+	var due []planned
+	for _, sch := range schedules {
+		active[sch.Name] = true
+		p, ok := s.next[sch.Name]
+		if !ok || p.schedule.Config.Cron != sch.Config.Cron || p.schedule.Config.Timezone != sch.Config.Timezone {
+			s.next[sch.Name] = planned{schedule: sch, at: sch.Next(now)}
+			continue
+		}
+		p.schedule = sch
+		if take && !p.at.IsZero() && !p.at.After(now) {
+			due = append(due, p)
+			p.at = sch.Next(now)
+		}
+		s.next[sch.Name] = p
+	}
+	for name := range s.next {
+		if !active[name] {
+			delete(s.next, name)
+		}
+	}
+	return due
+}
+
+// Tick fires the due schedules.
+func (s *Scheduler) Tick(ctx context.Context) {
+	for _, p := range s.plan(s.now(), true) {
+		claimed, err := s.state.Claim(p.schedule.Name, p.at)
+		if err != nil {
+			s.obs.Error("Failed to claim scheduled run", zap.String("schedule", p.schedule.Name), zap.Error(err))
+			continue
+		}
+		if !claimed {
+			s.obs.Verbose("Scheduled run fired by another replica",
+				zap.String("schedule", p.schedule.Name), zap.Time("at", p.at))
+			continue
+		}
+		s.fire(ctx, p.schedule, p.at, false)
+	}
+}
+
+// Trigger fires a schedule right away, without claiming the run.
+func (s *Scheduler) Trigger(ctx context.Context, name string) (Run, error) {
+	for _, sch := range s.router.Current().Schedules {
+		if sch.Name == name {
+			return s.fire(ctx, sch, s.now().UTC().Truncate(time.Second), true), nil
+		}
+	}
+	return Run{}, fmt.Errorf("%w %q", ErrUnknownSchedule, name)
+}
+
+func (s *Scheduler) fire(ctx context.Context, sch *routing.Schedule, at time.Time, manual bool) Run {
+	run := Run{Schedule: sch.Name, ScheduledAt: at.UTC(), FiredAt: s.now().UTC(), Replica: s.replica, Manual: manual}
+	ev, err := Event(sch, at, manual)
+	if err == nil {
+		run.EventID = ev.ID
+		err = s.emit(ctx, ev)
+	}
+	if err != nil {
+		run.Error = err.Error()
+		s.obs.Error("Scheduled event failed", zap.String("schedule", sch.Name), zap.Time("at", at), zap.Error(err))
+	} else {
+		s.obs.Info("Scheduled event fired", zap.String("schedule", sch.Name), zap.Time("at", at), zap.String("id", ev.ID))
+	}
+	if err := s.state.Record(run); err != nil {
+		s.obs.Warning("Failed to record scheduled run", zap.String("schedule", sch.Name), zap.Error(err))
+	}
+	return run
+}
+
+// Event builds the event of a run. The payload has the schedule name, the
+// scheduled time and the data of the schedule.
+func Event(sch *routing.Schedule, at time.Time, manual bool) (events.Event, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"schedule":    sch.Name,
+		"scheduledAt": at.UTC(),
+		"manual":      manual,
+		"data":        sch.Config.Data,
+	})
+	if err != nil {
+		return events.Event{}, err
+	}
+	eventType := sch.Config.Type
+	if eventType == "" {
+		eventType = sch.Name
+	}
+	ev := events.New(Source, eventType, payload)
+	ev.Subject = sch.Config.Subject
+	ev.Tenant = sch.Config.Tenant
+	ev.Internal = true
+	ev.IdempotencyKey = "schedule:" + sch.Name + "|" + at.UTC().Format(time.RFC3339)
+	if manual {
+		ev.IdempotencyKey += "|manual"
+	}
+	return ev, nil
+}
+
+// Statuses returns the schedules with their next and last run, by name.
+func (s *Scheduler) Statuses() []Status {
+	s.plan(s.now(), false)
+	s.mu.Lock()
+	statuses := make([]Status, 0, len(s.next))
+	for _, p := range s.next {
+		tz := p.schedule.Location.String()
+		statuses = append(statuses, Status{
+			Name: p.schedule.Name, Cron: p.schedule.Config.Cron, Timezone: tz, Next: p.at,
+		})
+	}
+	s.mu.Unlock()
+
+	for i := range statuses {
+		if run, ok, err := s.state.Last(statuses[i].Name); err == nil && ok {
+			statuses[i].Last = &run
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Run fires the schedules until ctx is done, checking every interval.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Tick(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/routing"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+func newRouter(t *testing.T, config string) (*observability.Observability, *routing.Router, State) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "emit.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	obs, err := observability.NewObservability()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := routing.NewRouter(obs, path, nil)
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obs, router, NewStoreState(st)
+}
+
+func TestScheduler_Tick(t *testing.T) {
+	obs, router, state := newRouter(t, `
+schedules:
+  - name: weekday-report
+    cron: "30 9 * * mon-fri"
+    timezone: Europe/Copenhagen
+    type: report.due
+    data:
+      report: open-pull-requests
+`)
+
+	var fired []events.Event
+	emit := func(ctx context.Context, ev events.Event) error {
+		fired = append(fired, ev)
+		return nil
+	}
+	// Friday 2024-05-03 09:29 in Copenhagen, two replicas sharing the state
+	now := time.Date(2024, 5, 3, 7, 29, 0, 0, time.UTC)
+	replicas := []*Scheduler{New(obs, router, state, emit), New(obs, router, state, emit)}
+	ctx := context.Background()
+	for _, s := range replicas {
+		s.now = func() time.Time { return now }
+		s.Tick(ctx)
+	}
+	if len(fired) != 0 {
+		t.Fatalf("Tick() fired %d events before the schedule was due", len(fired))
+	}
+
+	now = now.Add(90 * time.Second)
+	for _, s := range replicas {
+		s.Tick(ctx)
+	}
+	if len(fired) != 1 {
+		t.Fatalf("Tick() fired %d events, want 1", len(fired))
+	}
+	ev := fired[0]
+	if ev.Source != Source || ev.Type != "report.due" {
+		t.Errorf("Tick() fired %s/%s, want %s/report.due", ev.Source, ev.Type, Source)
+	}
+	var payload struct {
+		ScheduledAt time.Time         `json:"scheduledAt"`
+		Data        map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 5, 3, 7, 30, 0, 0, time.UTC)
+	if !payload.ScheduledAt.Equal(want) || payload.Data["report"] != "open-pull-requests" {
+		t.Errorf("Tick() payload = %s", ev.Payload)
+	}
+
+	statuses := replicas[1].Statuses()
+	if len(statuses) != 1 || statuses[0].Last == nil || statuses[0].Last.EventID != ev.ID {
+		t.Fatalf("Statuses() = %+v, want the last run", statuses)
+	}
+	// The weekend is skipped
+	if next := time.Date(2024, 5, 6, 7, 30, 0, 0, time.UTC); !statuses[0].Next.Equal(next) {
+		t.Errorf("Statuses() next = %s, want %s", statuses[0].Next, next)
+	}
+
+	if _, err := replicas[0].Trigger(ctx, "weekday-report"); err != nil {
+		t.Fatalf("Trigger() error = %v", err)
+	}
+	if len(fired) != 2 || fired[1].IdempotencyKey == ev.IdempotencyKey {
+		t.Errorf("Trigger() did not fire a manual run")
+	}
+	if _, err := replicas[0].Trigger(ctx, "missing"); err == nil {
+		t.Errorf("Trigger() expected an error for an unknown schedule")
+	}
+}
+
+func TestScheduler_TickEvery(t *testing.T) {
+	obs, router, state := newRouter(t, `
+schedules:
+  - name: heartbeat
+    cron: "@every 1m"
+`)
+	var fired []time.Time
+	emit := func(ctx context.Context, ev events.Event) error {
+		var payload struct {
+			ScheduledAt time.Time `json:"scheduledAt"`
+		}
+		if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+			return err
+		}
+		fired = append(fired, payload.ScheduledAt)
+		return nil
+	}
+	// Two replicas sharing the state, started 30 seconds apart
+	start := time.Date(2024, 5, 3, 7, 29, 10, 0, time.UTC)
+	clocks := []time.Time{start, start.Add(30 * time.Second)}
+	replicas := []*Scheduler{New(obs, router, state, emit), New(obs, router, state, emit)}
+	ctx := context.Background()
+	for i, s := range replicas {
+		i := i
+		s.now = func() time.Time { return clocks[i] }
+		s.Tick(ctx)
+	}
+
+	for minute := 1; minute <= 3; minute++ {
+		for i := range clocks {
+			clocks[i] = time.Date(2024, 5, 3, 7, 29+minute, 5, 0, time.UTC)
+		}
+		for _, s := range replicas {
+			s.Tick(ctx)
+		}
+		if len(fired) != minute {
+			t.Fatalf("Tick() fired %d events after %d minutes, want %d", len(fired), minute, minute)
+		}
+		if want := time.Date(2024, 5, 3, 7, 29+minute, 0, 0, time.UTC); !fired[minute-1].Equal(want) {
+			t.Errorf("Tick() fired the run at %s, want %s", fired[minute-1], want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+const (
+	claimsBucket = "schedule-claims"
+	runsBucket   = "schedule-runs"
+)
+
+// StoreState keeps the state in a store. It only coordinates the schedulers
+// of one process, for a single replica.
+type StoreState struct {
+	store *store.Store
+	mu    sync.Mutex
+}
+
+// NewStoreState returns a StoreState keeping the state in st.
+func NewStoreState(st *store.Store) *StoreState {
+	return &StoreState{store: st}
+}
+
+func (s *StoreState) Claim(schedule string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed time.Time
+	if _, err := s.store.Get(claimsBucket, schedule, &claimed); err != nil {
+		return false, err
+	}
+	if !at.After(claimed) {
+		return false, nil
+	}
+	return true, s.store.Put(claimsBucket, schedule, at)
+}
+
+func (s *StoreState) Record(run Run) error {
+	return s.store.Put(runsBucket, run.Schedule, run)
+}
+
+func (s *StoreState) Last(schedule string) (Run, bool, error) {
+	var run Run
+	ok, err := s.store.Get(runsBucket, schedule, &run)
+	return run, ok, err
+}
+
+// KVState keeps the state in a NATS key-value bucket shared by the
+// replicas. A run is claimed by moving the claimed time of the schedule
+// forward with a compare-and-set, which only one replica wins.
+type KVState struct {
+	kv nats.KeyValue
+}
+
+// NewKVState creates or binds the key-value bucket.
+func NewKVState(js nats.JetStreamContext, bucket string) (*KVState, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "Claims and last runs of the koksmat-emit schedules",
+			History:     1,
+			Storage:     nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &KVState{kv: kv}, nil
+}
+
+// kvKey encodes the schedule name, which may contain characters not
+// allowed in keys.
+func kvKey(prefix, schedule string) string {
+	return prefix + "." + base64.RawURLEncoding.EncodeToString([]byte(schedule))
+}
+
+func (s *KVState) Claim(schedule string, at time.Time) (bool, error) {
+	key := kvKey("claim", schedule)
+	value := []byte(at.UTC().Format(time.RFC3339Nano))
+	entry, err := s.kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		_, err = s.kv.Create(key, value)
+		return claimResult(err)
+	}
+	if err != nil {
+		return false, err
+	}
+	claimed, err := time.Parse(time.RFC3339Nano, string(entry.Value()))
+	if err == nil && !at.After(claimed) {
+		return false, nil
+	}
+	_, err = s.kv.Update(key, value, entry.Revision())
+	return claimResult(err)
+}
+
+// claimResult treats a lost compare-and-set as claimed by another replica.
+func claimResult(err error) (bool, error) {
+	var apiErr *nats.APIError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, nats.ErrKeyExists), errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *KVState) Record(run Run) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	_, err = s.kv.Put(kvKey("run", run.Schedule), data)
+	return err
+}
+
+func (s *KVState) Last(schedule string) (Run, bool, error) {
+	entry, err := s.kv.Get(kvKey("run", schedule))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return Run{}, false, nil
+	}
+	if err != nil {
+		return Run{}, false, err
+	}
+	var run Run
+	return run, true, json.Unmarshal(entry.Value(), &run)
+}
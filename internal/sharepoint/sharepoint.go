@@ -0,0 +1,300 @@
+// Package sharepoint turns SharePoint list webhook notifications into
+// events.
+//
+// A notification only tells that a list changed. The Fetcher then asks the
+// list for its changes since the last change token with GetChanges, emits
+// one event per changed item and stores the new token per list, so every
+// change is emitted once even across restarts.
+package sharepoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/azuread"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+	"go.uber.org/zap"
+)
+
+// Source of the emitted events.
+const Source = "sharepoint"
+
+const tokenBucket = "sharepoint-change-tokens"
+
+// Notification is one entry of a webhook notification.
+type Notification struct {
+	SubscriptionID     string `json:"subscriptionId"`
+	ClientState        string `json:"clientState"`
+	ExpirationDateTime string `json:"expirationDateTime"`
+	Resource           string `json:"resource"` // List ID
+	TenantID           string `json:"tenantId"`
+	SiteURL            string `json:"siteUrl"` // Server relative, e.g. /sites/intranet
+	WebID              string `json:"webId"`
+}
+
+// Notifications is the body of a webhook request.
+type Notifications struct {
+	Value []Notification `json:"value"`
+}
+
+// Change is an entry of the list change log.
+type Change struct {
+	ChangeToken struct {
+		StringValue string `json:"StringValue"`
+	} `json:"ChangeToken"`
+	ChangeType int       `json:"ChangeType"`
+	ItemID     int       `json:"ItemId"`
+	UniqueID   string    `json:"UniqueId"`
+	Time       time.Time `json:"Time"`
+
+	raw json.RawMessage
+}
+
+// changeTypes names the SP.ChangeType values.
+var changeTypes = map[int]string{
+	1:  "added",
+	2:  "updated",
+	3:  "deleted",
+	4:  "renamed",
+	5:  "moved_away",
+	6:  "moved_into",
+	7:  "restored",
+	8:  "role_added",
+	9:  "role_deleted",
+	12: "system_updated",
+}
+
+// EventType returns the event type of the change, e.g. "item.updated".
+func (c Change) EventType() string {
+	if name, ok := changeTypes[c.ChangeType]; ok {
+		return "item." + name
+	}
+	return fmt.Sprintf("item.change_%d", c.ChangeType)
+}
+
+// Client calls the SharePoint REST API.
+type Client struct {
+	BaseURL    string // e.g. https://contoso.sharepoint.com
+	Tokens     azuread.TokenSource
+	HTTPClient *http.Client
+}
+
+// GetChanges returns the item changes of a list after token. An empty token
+// returns the whole change log.
+func (c *Client) GetChanges(ctx context.Context, siteURL, listID, token string) ([]Change, error) {
+	query := map[string]interface{}{
+		"Item":         true,
+		"Add":          true,
+		"Update":       true,
+		"DeleteObject": true,
+		"Rename":       true,
+		"Move":         true,
+		"Restore":      true,
+	}
+	if token != "" {
+		query["ChangeTokenStart"] = map[string]string{"StringValue": token}
+	}
+	body, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.Trim(siteURL, "/") +
+		"/_api/web/lists(guid'" + url.PathEscape(listID) + "')/GetChanges"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	bearer, err := c.Tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.Header.Set("Accept", "application/json;odata=nometadata")
+	req.Header.Set("Content-Type", "application/json;odata=nometadata")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GetChanges: %s %s", resp.Status, bytes.TrimSpace(detail))
+	}
+
+	var result struct {
+		Value []json.RawMessage `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("GetChanges: %w", err)
+	}
+	changes := make([]Change, 0, len(result.Value))
+	for _, raw := range result.Value {
+		var change Change
+		if err := json.Unmarshal(raw, &change); err != nil {
+			return nil, fmt.Errorf("GetChanges: %w", err)
+		}
+		change.raw = raw
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Emitter accepts the events of the changes.
+type Emitter func(ctx context.Context, ev events.Event) error
+
+// Fetcher fetches and emits the changes of notified lists.
+type Fetcher struct {
+	client *Client
+	store  *store.Store
+	emit   Emitter
+	obs    *observability.Observability
+
+	// InitialWindow limits the first fetch of a list without a stored token
+	// to recent changes, instead of emitting the whole change log.
+	InitialWindow time.Duration
+	// MaxPages bounds the GetChanges calls of one fetch.
+	MaxPages int
+	// MaxFetches bounds the lists fetched at the same time by Notify.
+	MaxFetches int
+	// Timeout bounds a fetch started by Notify.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	fetching map[string]bool // Lists fetched by Notify, true when notified again meanwhile
+}
+
+// NewFetcher returns a Fetcher keeping the change tokens in st.
+func NewFetcher(obs *observability.Observability, client *Client, st *store.Store, emit Emitter) *Fetcher {
+	return &Fetcher{
+		client:        client,
+		store:         st,
+		emit:          emit,
+		obs:           obs,
+		InitialWindow: 10 * time.Minute,
+		MaxPages:      20,
+		MaxFetches:    8,
+		Timeout:       2 * time.Minute,
+		fetching:      map[string]bool{},
+	}
+}
+
+func listKey(n Notification) string {
+	return n.SiteURL + "|" + n.Resource
+}
+
+// Notify fetches the changes of the notified list in the background. A list
+// notified while it is fetched is fetched once more afterwards, so a token
+// is only used by one fetch at a time. It reports false when MaxFetches
+// lists are fetched already; the changes are then fetched on the next
+// notification of the list.
+func (f *Fetcher) Notify(n Notification) bool {
+	key := listKey(n)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.fetching[key]; ok {
+		f.fetching[key] = true
+		return true
+	}
+	if len(f.fetching) >= f.MaxFetches {
+		return false
+	}
+	f.fetching[key] = false
+	go f.fetchAll(key, n)
+	return true
+}
+
+// fetchAll fetches the list until it was not notified during a fetch.
+func (f *Fetcher) fetchAll(key string, n Notification) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), f.Timeout)
+		if err := f.Fetch(ctx, n); err != nil {
+			f.obs.Error("Fetching SharePoint changes failed",
+				zap.String("site", n.SiteURL), zap.String("list", n.Resource), zap.Error(err))
+		}
+		cancel()
+
+		f.mu.Lock()
+		again := f.fetching[key]
+		if again {
+			f.fetching[key] = false
+		} else {
+			delete(f.fetching, key)
+		}
+		f.mu.Unlock()
+		if !again {
+			return
+		}
+	}
+}
+
+// Fetch emits the changes of the notified list since the stored token and
+// stores the token of the last emitted change. When emitting fails the
+// remaining changes are left for the next notification. Fetches of the same
+// list must not overlap; Notify takes care of that.
+func (f *Fetcher) Fetch(ctx context.Context, n Notification) error {
+	key := listKey(n)
+	var token string
+	if _, err := f.store.Get(tokenBucket, key, &token); err != nil {
+		return err
+	}
+	initial := token == ""
+
+	for page := 0; page < f.MaxPages; page++ {
+		changes, err := f.client.GetChanges(ctx, n.SiteURL, n.Resource, token)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		for _, change := range changes {
+			if !initial || time.Since(change.Time) <= f.InitialWindow {
+				if err := f.emit(ctx, changeEvent(n, change)); err != nil {
+					return err
+				}
+			}
+			token = change.ChangeToken.StringValue
+			if err := f.store.Put(tokenBucket, key, token); err != nil {
+				return err
+			}
+		}
+	}
+	f.obs.Warning("More SharePoint changes than fetched, continuing with the next notification",
+		zap.String("site", n.SiteURL), zap.String("list", n.Resource))
+	return nil
+}
+
+// changeEvent builds the event of a changed item. The payload holds the
+// site, the list and the change as returned by SharePoint.
+func changeEvent(n Notification, change Change) events.Event {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"siteUrl": n.SiteURL,
+		"webId":   n.WebID,
+		"listId":  n.Resource,
+		"change":  change.raw,
+	})
+	ev := events.New(Source, change.EventType(), payload)
+	ev.Subject = strings.TrimSuffix(n.SiteURL, "/") + "/lists/" + n.Resource + "/items/" + fmt.Sprint(change.ItemID)
+	ev.Tenant = n.TenantID
+	if !change.Time.IsZero() {
+		ev.Time = change.Time.UTC()
+	}
+	ev.IdempotencyKey = Source + ":" + change.ChangeToken.StringValue
+	return ev
+}
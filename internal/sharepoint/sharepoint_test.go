@@ -0,0 +1,167 @@
+package sharepoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nexi-intra/koksmat-emit/internal/azuread"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	"github.com/nexi-intra/koksmat-emit/internal/observability"
+	"github.com/nexi-intra/koksmat-emit/internal/store"
+)
+
+// changeLog serves GetChanges from a list of changes, returning those after
+// the requested token.
+func changeLog(t *testing.T, changes []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sites/intranet/_api/web/lists(guid'list-1')/GetChanges" {
+			t.Errorf("GetChanges path = %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("GetChanges without token")
+		}
+		var body struct {
+			Query struct {
+				ChangeTokenStart *struct{ StringValue string }
+			} `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		start := 0
+		if body.Query.ChangeTokenStart != nil {
+			fmt.Sscanf(body.Query.ChangeTokenStart.StringValue, "t%d", &start)
+		}
+		value := []json.RawMessage{}
+		for _, c := range changes[min(start, len(changes)):] {
+			value = append(value, json.RawMessage(c))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+	}))
+}
+
+func change(n, changeType, item int, at time.Time) string {
+	return fmt.Sprintf(`{"ChangeToken":{"StringValue":"t%d"},"ChangeType":%d,"ItemId":%d,"Time":%q}`, n, changeType, item, at.Format(time.RFC3339))
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	now := time.Now().UTC()
+	changes := []string{
+		change(1, 1, 7, now.Add(-time.Hour)), // Older than the initial window
+		change(2, 2, 7, now.Add(-time.Minute)),
+		change(3, 3, 8, now),
+	}
+	server := changeLog(t, changes)
+	defer server.Close()
+
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, _ := observability.NewObservability()
+	var emitted []events.Event
+	fail := false
+	emit := func(ctx context.Context, ev events.Event) error {
+		if fail {
+			return errors.New("unavailable")
+		}
+		emitted = append(emitted, ev)
+		return nil
+	}
+	f := NewFetcher(obs, &Client{BaseURL: server.URL, Tokens: azuread.StaticToken("token")}, st, emit)
+	n := Notification{Resource: "list-1", SiteURL: "/sites/intranet", TenantID: "tenant-1"}
+
+	if err := f.Fetch(context.Background(), n); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if len(emitted) != 2 {
+		t.Fatalf("Fetch() emitted %d events, want 2", len(emitted))
+	}
+	ev := emitted[0]
+	if ev.Source != Source || ev.Type != "item.updated" || ev.Subject != "/sites/intranet/lists/list-1/items/7" || ev.Tenant != "tenant-1" || ev.IdempotencyKey != "sharepoint:t2" {
+		t.Errorf("Fetch() event = %+v", ev)
+	}
+	if emitted[1].Type != "item.deleted" {
+		t.Errorf("Fetch() second event type = %s", emitted[1].Type)
+	}
+
+	// The stored token continues after the last change
+	emitted = nil
+	if err := f.Fetch(context.Background(), n); err != nil || len(emitted) != 0 {
+		t.Errorf("Fetch() again emitted %d events, error = %v", len(emitted), err)
+	}
+
+	// A failed emit keeps the change for the next fetch
+	var token string
+	st.Put(tokenBucket, "/sites/intranet|list-1", "t1")
+	fail = true
+	if err := f.Fetch(context.Background(), n); err == nil {
+		t.Errorf("Fetch() with failing emit error = nil")
+	}
+	st.Get(tokenBucket, "/sites/intranet|list-1", &token)
+	if token != "t1" {
+		t.Errorf("Fetch() stored token %s after failure, want t1", token)
+	}
+}
+
+func TestFetcher_Notify(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		<-release
+		w.Write([]byte(`{"value":[]}`))
+	}))
+	defer server.Close()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, _ := observability.NewObservability()
+	f := NewFetcher(obs, &Client{BaseURL: server.URL, Tokens: azuread.StaticToken("token")}, st,
+		func(ctx context.Context, ev events.Event) error { return nil })
+	f.MaxFetches = 2
+
+	list := func(id string) Notification { return Notification{Resource: id, SiteURL: "/sites/intranet"} }
+	if !f.Notify(list("list-1")) || !f.Notify(list("list-2")) {
+		t.Fatalf("Notify() rejected a list below MaxFetches")
+	}
+	if f.Notify(list("list-3")) {
+		t.Errorf("Notify() accepted more than MaxFetches lists")
+	}
+	// Notified during its fetch, the list is fetched once more
+	if !f.Notify(list("list-1")) {
+		t.Errorf("Notify() rejected a list being fetched")
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		n := len(f.fetching)
+		f.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Notify() fetches did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := calls["/sites/intranet/_api/web/lists(guid'list-1')/GetChanges"]; got != 2 {
+		t.Errorf("Notify() fetched list-1 %d times, want 2", got)
+	}
+	if got := calls["/sites/intranet/_api/web/lists(guid'list-3')/GetChanges"]; got != 0 {
+		t.Errorf("Notify() fetched list-3 %d times, want 0", got)
+	}
+}
@@ -0,0 +1,204 @@
+// Package signing issues the JWTs the emitter presents to MagicMix.
+//
+// Keys, issuer, audience and lifetime come from configuration. Several keys
+// can be configured, each identified by a key ID (kid) that is written to the
+// token header, so MagicMix can accept both the old and the new key while a
+// key is being rotated.
+package signing
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/viper"
+)
+
+// Key is a private key or shared secret together with its algorithm.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	Key    interface{}
+}
+
+// Config holds the settings of a Signer.
+type Config struct {
+	Keys          []Key
+	ActiveKeyID   string        // Key used for signing, defaults to the first key
+	Issuer        string        // iss claim, omitted when empty
+	Audience      string        // aud claim, omitted when empty
+	Lifetime      time.Duration // Validity of issued tokens
+	RefreshBefore time.Duration // Tokens closer than this to expiry are replaced
+}
+
+// Signer creates tokens and caches them until they are about to expire.
+type Signer struct {
+	cfg    Config
+	active *Key
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedToken
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewSigner validates the configuration and returns a Signer.
+func NewSigner(cfg Config) (*Signer, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("no signing key configured")
+	}
+	if cfg.Lifetime <= 0 {
+		return nil, errors.New("token lifetime must be positive")
+	}
+	if cfg.RefreshBefore < 0 || cfg.RefreshBefore >= cfg.Lifetime {
+		return nil, errors.New("refresh margin must be shorter than the token lifetime")
+	}
+
+	s := &Signer{cfg: cfg, now: time.Now, cache: map[string]cachedToken{}}
+	if cfg.ActiveKeyID == "" {
+		s.active = &cfg.Keys[0]
+	}
+	for i := range cfg.Keys {
+		if cfg.Keys[i].ID == cfg.ActiveKeyID {
+			s.active = &cfg.Keys[i]
+		}
+	}
+	if s.active == nil {
+		return nil, fmt.Errorf("active key %q is not configured", cfg.ActiveKeyID)
+	}
+	return s, nil
+}
+
+// NewSignerFromConfig builds a Signer from the MAGICMIX_JWT_* settings.
+//
+//   - MAGICMIX_JWT_KEYS: comma separated keys written as kid:ALG:reference,
+//     where reference is file:<path> (PEM key or secret) or env:<setting>
+//   - MAGICMIX_JWT_SECRET: a single HS256 secret, used when no keys are listed
+//   - MAGICMIX_JWT_KID: the key used for signing
+//   - MAGICMIX_JWT_ISSUER, MAGICMIX_JWT_AUDIENCE
+//   - MAGICMIX_JWT_LIFETIME (default 1h), MAGICMIX_JWT_REFRESH_BEFORE (default 5m)
+func NewSignerFromConfig() (*Signer, error) {
+	viper.SetDefault("MAGICMIX_JWT_LIFETIME", "1h")
+	viper.SetDefault("MAGICMIX_JWT_REFRESH_BEFORE", "5m")
+
+	cfg := Config{
+		ActiveKeyID:   viper.GetString("MAGICMIX_JWT_KID"),
+		Issuer:        viper.GetString("MAGICMIX_JWT_ISSUER"),
+		Audience:      viper.GetString("MAGICMIX_JWT_AUDIENCE"),
+		Lifetime:      viper.GetDuration("MAGICMIX_JWT_LIFETIME"),
+		RefreshBefore: viper.GetDuration("MAGICMIX_JWT_REFRESH_BEFORE"),
+	}
+
+	if keys := viper.GetString("MAGICMIX_JWT_KEYS"); keys != "" {
+		for _, spec := range strings.Split(keys, ",") {
+			key, err := ParseKeySpec(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, err
+			}
+			cfg.Keys = append(cfg.Keys, key)
+		}
+	} else if secret := viper.GetString("MAGICMIX_JWT_SECRET"); secret != "" {
+		cfg.Keys = []Key{{ID: cfg.ActiveKeyID, Method: jwt.SigningMethodHS256, Key: []byte(secret)}}
+	} else {
+		return nil, errors.New("no MagicMix signing key configured, set MAGICMIX_JWT_SECRET or MAGICMIX_JWT_KEYS")
+	}
+
+	return NewSigner(cfg)
+}
+
+// ParseKeySpec parses a kid:ALG:reference key declaration.
+func ParseKeySpec(spec string) (Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return Key{}, fmt.Errorf("invalid key %q, expected kid:ALG:reference", spec)
+	}
+	kid, alg, ref := parts[0], strings.ToUpper(parts[1]), parts[2]
+
+	var material []byte
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return Key{}, fmt.Errorf("key %s: %w", kid, err)
+		}
+		material = data
+	case strings.HasPrefix(ref, "env:"):
+		material = []byte(viper.GetString(strings.TrimPrefix(ref, "env:")))
+	default:
+		return Key{}, fmt.Errorf("key %s: reference must start with file: or env:", kid)
+	}
+	if len(material) == 0 {
+		return Key{}, fmt.Errorf("key %s is empty", kid)
+	}
+
+	return ParseKey(kid, alg, material)
+}
+
+// ParseKey turns key material into a Key for the given algorithm. HS256 uses
+// the material as secret, RS256 and ES256 expect a PEM encoded private key.
+func ParseKey(kid string, alg string, material []byte) (Key, error) {
+	key := Key{ID: kid}
+	var err error
+	switch alg {
+	case "HS256":
+		key.Method = jwt.SigningMethodHS256
+		key.Key = []byte(strings.TrimSpace(string(material)))
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		key.Key, err = jwt.ParseRSAPrivateKeyFromPEM(material)
+	case "ES256":
+		key.Method = jwt.SigningMethodES256
+		key.Key, err = jwt.ParseECPrivateKeyFromPEM(material)
+	default:
+		return Key{}, fmt.Errorf("key %s: unsupported algorithm %s", kid, alg)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("key %s: %w", kid, err)
+	}
+	return key, nil
+}
+
+// Token returns a token for appDisplayName, reusing the cached one until it
+// is within the refresh margin of its expiry.
+func (s *Signer) Token(appDisplayName string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if cached, ok := s.cache[appDisplayName]; ok && now.Add(s.cfg.RefreshBefore).Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	expires := now.Add(s.cfg.Lifetime)
+	claims := jwt.MapClaims{
+		"app_displayname": appDisplayName,
+		"exp":             expires.Unix(),
+		"iat":             now.Unix(),
+	}
+	if s.cfg.Issuer != "" {
+		claims["iss"] = s.cfg.Issuer
+	}
+	if s.cfg.Audience != "" {
+		claims["aud"] = s.cfg.Audience
+	}
+
+	token := jwt.NewWithClaims(s.active.Method, claims)
+	if s.active.ID != "" {
+		token.Header["kid"] = s.active.ID
+	}
+	signed, err := token.SignedString(s.active.Key)
+	if err != nil {
+		return "", err
+	}
+
+	s.cache[appDisplayName] = cachedToken{token: signed, expires: expires}
+	return signed, nil
+}
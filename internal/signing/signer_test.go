@@ -0,0 +1,115 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestSigner_Token(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es256, err := ParseKey("ec-1", "ES256", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParseKey() error = %v", err)
+	}
+	hs256, err := ParseKey("hs-1", "HS256", []byte("secret\n"))
+	if err != nil {
+		t.Fatalf("ParseKey() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		active    string
+		verifyKey interface{}
+	}{
+		{name: "HS256", active: "hs-1", verifyKey: []byte("secret")},
+		{name: "ES256", active: "ec-1", verifyKey: &ecKey.PublicKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewSigner(Config{
+				Keys:          []Key{hs256, es256},
+				ActiveKeyID:   tt.active,
+				Issuer:        "koksmat-emit",
+				Audience:      "magic-mix",
+				Lifetime:      time.Hour,
+				RefreshBefore: 5 * time.Minute,
+			})
+			if err != nil {
+				t.Fatalf("NewSigner() error = %v", err)
+			}
+
+			token, err := signer.Token("koksmat-emit")
+			if err != nil {
+				t.Fatalf("Token() error = %v", err)
+			}
+			parsed, err := jwt.Parse(token, func(tok *jwt.Token) (interface{}, error) {
+				return tt.verifyKey, nil
+			})
+			if err != nil {
+				t.Fatalf("jwt.Parse() error = %v", err)
+			}
+			if parsed.Header["kid"] != tt.active {
+				t.Errorf("kid = %v, want %s", parsed.Header["kid"], tt.active)
+			}
+			claims := parsed.Claims.(jwt.MapClaims)
+			if !claims.VerifyIssuer("koksmat-emit", true) || !claims.VerifyAudience("magic-mix", true) {
+				t.Errorf("unexpected claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestSigner_TokenIsCachedUntilRefresh(t *testing.T) {
+	key, _ := ParseKey("k", "HS256", []byte("secret"))
+	signer, err := NewSigner(Config{Keys: []Key{key}, Lifetime: time.Hour, RefreshBefore: 5 * time.Minute})
+	if err != nil {
+		t.Fatalf("NewSigner() error = %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	signer.now = func() time.Time { return now }
+
+	first, _ := signer.Token("koksmat-emit")
+
+	now = now.Add(30 * time.Minute)
+	if second, _ := signer.Token("koksmat-emit"); second != first {
+		t.Errorf("Token() was not reused within its lifetime")
+	}
+
+	now = now.Add(26 * time.Minute)
+	if third, _ := signer.Token("koksmat-emit"); third == first {
+		t.Errorf("Token() was not refreshed before expiry")
+	}
+}
+
+func TestNewSigner_Invalid(t *testing.T) {
+	key, _ := ParseKey("k", "HS256", []byte("secret"))
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "No keys", cfg: Config{Lifetime: time.Hour}},
+		{name: "Unknown active key", cfg: Config{Keys: []Key{key}, ActiveKeyID: "other", Lifetime: time.Hour}},
+		{name: "Refresh longer than lifetime", cfg: Config{Keys: []Key{key}, Lifetime: time.Minute, RefreshBefore: time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSigner(tt.cfg); err == nil {
+				t.Errorf("NewSigner() expected an error")
+			}
+		})
+	}
+}
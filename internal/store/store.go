@@ -0,0 +1,198 @@
+// Package store persists small JSON documents on disk.
+//
+// Documents are grouped in buckets, each bucket is a directory and each key a
+// file named by the hash of the key, so keys of any length fit. The file
+// holds the key next to the document. Writes go to a temporary file which is
+// renamed into place, so readers never see a partially written document.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store is a directory of buckets.
+type Store struct {
+	dir string
+}
+
+// record is the content of a file.
+type record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Open creates the directory if needed and returns a Store rooted there.
+// Files of earlier versions, named by the encoded key, are converted.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("unable to open store %s: %w", dir, err)
+	}
+	s := &Store{dir: dir}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("unable to convert store %s: %w", dir, err)
+	}
+	return s, nil
+}
+
+// Dir returns the root directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Put stores v as JSON under bucket/key.
+func (s *Store) Put(bucket string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(bucket, key, value)
+}
+
+func (s *Store) write(bucket string, key string, value json.RawMessage) error {
+	data, err := json.Marshal(record{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.dir, bucket)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(bucket, key))
+}
+
+// Get decodes the document at bucket/key into v. It reports false when the
+// document does not exist.
+func (s *Store) Get(bucket string, key string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(s.path(bucket, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var e record
+	if err := json.Unmarshal(data, &e); err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(e.Value, v)
+}
+
+// Delete removes bucket/key. Deleting a missing document is not an error.
+func (s *Store) Delete(bucket string, key string) error {
+	err := os.Remove(s.path(bucket, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Each calls fn with every document of the bucket until fn returns an error.
+func (s *Store) Each(bucket string, fn func(key string, data []byte) error) error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, bucket))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, bucket, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted while iterating
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var e record
+		if json.Unmarshal(data, &e) != nil || fileName(e.Key) != name {
+			continue
+		}
+		if err := fn(e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path hashes the key so any string, including slashes and keys longer than
+// a file name may be, is a valid file name.
+func (s *Store) path(bucket string, key string) string {
+	return filepath.Join(s.dir, bucket, fileName(key))
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// migrate converts the files named by the base64 encoded key, which held
+// the document alone.
+func (s *Store) migrate() error {
+	buckets, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		if !b.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.dir, b.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			path := filepath.Join(s.dir, b.Name(), name)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var e record
+			if json.Unmarshal(data, &e) == nil && fileName(e.Key) == name {
+				continue
+			}
+			key, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(name, ".json"))
+			if err != nil || !json.Valid(data) {
+				continue
+			}
+			if err := s.write(b.Name(), string(key), data); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
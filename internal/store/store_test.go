@@ -0,0 +1,55 @@
+package store
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore_LongKeys(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "microsoftgraph:" + strings.Repeat("users/0000/messages/AAMkAG|", 20)
+	if err := s.Put("dedup", key, 42); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	var got int
+	if ok, err := s.Get("dedup", key, &got); !ok || err != nil || got != 42 {
+		t.Errorf("Get() = %d, %v, %v, want 42", got, ok, err)
+	}
+	var keys []string
+	s.Each("dedup", func(k string, data []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Each() keys = %q", keys)
+	}
+}
+
+func TestOpen_ConvertsEncodedNames(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "dedup"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	old := base64.RawURLEncoding.EncodeToString([]byte("github:1")) + ".json"
+	if err := os.WriteFile(filepath.Join(dir, "dedup", old), []byte(`"2024-05-01T00:00:00Z"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	var got string
+	if ok, err := s.Get("dedup", "github:1", &got); !ok || err != nil || got != "2024-05-01T00:00:00Z" {
+		t.Errorf("Get() = %q, %v, %v after the conversion", got, ok, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dedup", old)); !os.IsNotExist(err) {
+		t.Errorf("Open() kept the file of the earlier version")
+	}
+}
@@ -0,0 +1,199 @@
+// Package worker consumes events from NATS subjects and runs them through
+// the same routing and delivery pipeline as the webhooks.
+//
+// A message either carries a JSON encoded events.Event, without the fields
+// the emitter sets itself, or a raw payload described by the Emit-Source,
+// Emit-Type and Emit-Subject headers. Messages sent as requests are answered
+// with the outcome.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nexi-intra/koksmat-emit/internal/emitter"
+	"github.com/nexi-intra/koksmat-emit/internal/events"
+	natsutil "github.com/nexi-intra/koksmat-emit/services/nats"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Headers describing a raw payload. They match the headers of the nats
+// destination, so its messages can be fed to a worker.
+const (
+	HeaderSource  = emitter.HeaderEventSource
+	HeaderType    = emitter.HeaderEventType
+	HeaderSubject = emitter.HeaderEventSubject
+)
+
+// Config holds the subscriptions of the worker.
+type Config struct {
+	Subjects    []string      // Subjects to subscribe to, wildcards allowed
+	Queue       string        // Queue group shared by all replicas
+	Concurrency int           // Subscriptions per subject in this process
+	Timeout     time.Duration // Time allowed to process one message
+}
+
+// ConfigFromViper reads the WORKER_* settings.
+func ConfigFromViper() Config {
+	viper.SetDefault("WORKER_SUBJECTS", "koksmat.emit.ingest.>")
+	viper.SetDefault("WORKER_QUEUE", "koksmat-emit")
+	viper.SetDefault("WORKER_CONCURRENCY", 4)
+	viper.SetDefault("WORKER_TIMEOUT", "30s")
+
+	var subjects []string
+	for _, s := range strings.Split(viper.GetString("WORKER_SUBJECTS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			subjects = append(subjects, s)
+		}
+	}
+	return Config{
+		Subjects:    subjects,
+		Queue:       viper.GetString("WORKER_QUEUE"),
+		Concurrency: viper.GetInt("WORKER_CONCURRENCY"),
+		Timeout:     viper.GetDuration("WORKER_TIMEOUT"),
+	}
+}
+
+// Reply is sent back to requests.
+type Reply struct {
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"` // "accepted", "failed" or "rejected"
+	Error  string `json:"error,omitempty"`
+}
+
+// Worker owns the subscriptions.
+type Worker struct {
+	app    *emitter.App
+	client *natsutil.NATSClient
+	cfg    Config
+	subs   []*nats.Subscription
+}
+
+// New returns a Worker feeding app from the client's subscriptions.
+func New(app *emitter.App, client *natsutil.NATSClient, cfg Config) *Worker {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	return &Worker{app: app, client: client, cfg: cfg}
+}
+
+// Start subscribes to all subjects.
+func (w *Worker) Start() error {
+	if len(w.cfg.Subjects) == 0 {
+		return errors.New("no subjects configured")
+	}
+	for _, subject := range w.cfg.Subjects {
+		for i := 0; i < w.cfg.Concurrency; i++ {
+			sub, err := w.client.QueueSubscribe(subject, w.cfg.Queue, w.handle)
+			if err != nil {
+				w.Stop()
+				return fmt.Errorf("subscribing to %s: %w", subject, err)
+			}
+			w.subs = append(w.subs, sub)
+		}
+		w.app.Obs.Info("Worker subscribed",
+			zap.String("subject", subject), zap.String("queue", w.cfg.Queue), zap.Int("concurrency", w.cfg.Concurrency))
+	}
+	return nil
+}
+
+// Stop drains the subscriptions, letting messages in progress complete.
+func (w *Worker) Stop() {
+	for _, sub := range w.subs {
+		sub.Drain()
+	}
+	w.subs = nil
+}
+
+func (w *Worker) handle(msg *nats.Msg) {
+	ev, err := Decode(msg)
+	if err != nil {
+		w.app.Obs.Warning("Rejected message", zap.String("subject", msg.Subject), zap.Error(err))
+		w.reply(msg, Reply{Status: "rejected", Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.Timeout)
+	defer cancel()
+	if err := w.app.Emit(ctx, ev); err != nil {
+		w.reply(msg, Reply{ID: ev.ID, Status: "failed", Error: err.Error()})
+		return
+	}
+	w.reply(msg, Reply{ID: ev.ID, Status: "accepted"})
+}
+
+func (w *Worker) reply(msg *nats.Msg, reply Reply) {
+	if msg.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		w.app.Obs.Warning("Failed to reply", zap.String("subject", msg.Subject), zap.Error(err))
+	}
+}
+
+// inbound is the part of an events.Event a message may set. The fields the
+// emitter sets itself, like the tags and the details of coalesced or delayed
+// events, are not decoded.
+type inbound struct {
+	ID             string            `json:"id"`
+	Source         string            `json:"source"`
+	Type           string            `json:"type"`
+	Subject        string            `json:"subject"`
+	Tenant         string            `json:"tenant"` // Resolved through the tenant registry like a receiver's
+	Time           time.Time         `json:"time"`
+	Headers        map[string]string `json:"headers"`
+	Payload        json.RawMessage   `json:"payload"`
+	CorrelationID  string            `json:"correlationId"`
+	IdempotencyKey string            `json:"idempotencyKey"`
+}
+
+// Decode turns a message into an event. The Nats-Msg-Id header, when
+// present, becomes the idempotency key. The sources of aggregates and
+// schedules are refused.
+func Decode(msg *nats.Msg) (events.Event, error) {
+	var ev events.Event
+	if source := msg.Header.Get(HeaderSource); source != "" {
+		if !json.Valid(msg.Data) {
+			return ev, errors.New("payload is not valid JSON")
+		}
+		ev = events.New(source, msg.Header.Get(HeaderType), msg.Data)
+		ev.Subject = msg.Header.Get(HeaderSubject)
+	} else {
+		var in inbound
+		if err := json.Unmarshal(msg.Data, &in); err != nil {
+			return ev, fmt.Errorf("invalid event: %w", err)
+		}
+		ev = events.Event{
+			ID: in.ID, Source: in.Source, Type: in.Type, Subject: in.Subject, Tenant: in.Tenant,
+			Time: in.Time, Headers: in.Headers, Payload: in.Payload,
+			CorrelationID: in.CorrelationID, IdempotencyKey: in.IdempotencyKey,
+		}
+		if ev.Source == "" {
+			return ev, errors.New("event has no source")
+		}
+		if ev.ID == "" {
+			ev.ID = events.NewID()
+		}
+		if ev.Time.IsZero() {
+			ev.Time = time.Now().UTC()
+		}
+	}
+
+	if events.Reserved(ev.Source) {
+		return ev, fmt.Errorf("source %s is reserved for the events of the emitter", ev.Source)
+	}
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" && ev.IdempotencyKey == "" {
+		ev.IdempotencyKey = ev.Source + ":" + id
+	}
+	return ev, nil
+}
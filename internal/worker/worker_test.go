@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        *nats.Msg
+		wantSource string
+		wantType   string
+		wantKey    string
+		wantErr    bool
+	}{
+		{
+			name:       "Event",
+			msg:        &nats.Msg{Data: []byte(`{"source":"sharepoint","type":"item.updated","payload":{"id":1}}`)},
+			wantSource: "sharepoint",
+			wantType:   "item.updated",
+		},
+		{
+			name: "Raw payload described by headers",
+			msg: &nats.Msg{
+				Header: nats.Header{HeaderSource: {"erp"}, HeaderType: {"order.created"}, nats.MsgIdHdr: {"42"}},
+				Data:   []byte(`{"order":42}`),
+			},
+			wantSource: "erp",
+			wantType:   "order.created",
+			wantKey:    "erp:42",
+		},
+		{
+			name: "Event setting fields of the emitter",
+			msg: &nats.Msg{Data: []byte(`{"source":"github","type":"pull_request.closed","tags":["audit"],` +
+				`"coalesced":{"rule":"documents","count":2},"delayed":{"rule":"cleanup"},"payload":{}}`)},
+			wantSource: "github",
+			wantType:   "pull_request.closed",
+		},
+		{
+			name:    "Event without source",
+			msg:     &nats.Msg{Data: []byte(`{"type":"x"}`)},
+			wantErr: true,
+		},
+		{
+			name:    "Event with the source of schedules",
+			msg:     &nats.Msg{Data: []byte(`{"source":"schedule","type":"nightly"}`)},
+			wantErr: true,
+		},
+		{
+			name:    "Raw payload with the source of aggregates",
+			msg:     &nats.Msg{Header: nats.Header{HeaderSource: {"aggregate"}}, Data: []byte(`{}`)},
+			wantErr: true,
+		},
+		{
+			name:    "Raw payload which is not JSON",
+			msg:     &nats.Msg{Header: nats.Header{HeaderSource: {"erp"}}, Data: []byte(`hello`)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := Decode(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ev.Source != tt.wantSource || ev.Type != tt.wantType || ev.IdempotencyKey != tt.wantKey {
+				t.Errorf("Decode() = %s/%s key %q", ev.Source, ev.Type, ev.IdempotencyKey)
+			}
+			if len(ev.Tags) > 0 || ev.Coalesced != nil || ev.Delayed != nil {
+				t.Errorf("Decode() kept fields set by the emitter")
+			}
+			if ev.ID == "" || ev.Time.IsZero() {
+				t.Errorf("Decode() did not assign an ID and time")
+			}
+		})
+	}
+}
@@ -9,11 +9,10 @@ import (
 	"golang.org/x/oauth2"
 )
 
-func triggerGitHubWorkflow(owner, repo, workflowID, ref string, inputs map[string]interface{}, token string) error {
-	// Your GitHub Personal Access Token (ensure it's kept secure)
-
+// TriggerGitHubWorkflow dispatches a workflow_dispatch event for the workflow
+// file workflowID in owner/repo.
+func TriggerGitHubWorkflow(ctx context.Context, owner, repo, workflowID, ref string, inputs map[string]interface{}, token string) error {
 	// Create an OAuth2 authenticated client
-	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	)
@@ -30,7 +29,7 @@ func triggerGitHubWorkflow(owner, repo, workflowID, ref string, inputs map[strin
 	// Trigger the workflow
 	_, err := client.Actions.CreateWorkflowDispatchEventByFileName(ctx, owner, repo, workflowID, event)
 	if err != nil {
-		return fmt.Errorf("failed to trigger workflow: %v", err)
+		return fmt.Errorf("failed to trigger workflow: %w", err)
 	}
 
 	return nil
@@ -51,7 +50,7 @@ func sampleGithub() {
 	// Your GitHub Personal Access Token (ensure it's kept secure)
 	token := viper.GetString("GITHUB_PAT") // It's recommended to set this as an environment variable
 
-	err := triggerGitHubWorkflow(owner, repo, workflowID, ref, inputs, token)
+	err := TriggerGitHubWorkflow(context.Background(), owner, repo, workflowID, ref, inputs, token)
 	if err != nil {
 		fmt.Printf("Error triggering workflow: %v\n", err)
 	} else {
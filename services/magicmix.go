@@ -33,6 +33,11 @@ func NewMicroserviceConnection() (*MicroService, error) {
 	return &MicroService{client: client}, nil
 }
 
+// NATS returns the underlying NATS client
+func (c *MicroService) NATS() *natsutil.NATSClient {
+	return c.client
+}
+
 // Close closes the NATS connection
 func (c *MicroService) Close() {
 	c.client.Close()
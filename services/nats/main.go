@@ -62,11 +62,22 @@ func (c *NATSClient) Publish(subject string, data []byte) error {
 	return c.conn.Publish(subject, data)
 }
 
+// PublishMsg publishes a message with headers
+func (c *NATSClient) PublishMsg(msg *nats.Msg) error {
+	return c.conn.PublishMsg(msg)
+}
+
 // Subscribe subscribes to a subject with a message handler
 func (c *NATSClient) Subscribe(subject string, handler func(m *nats.Msg)) (*nats.Subscription, error) {
 	return c.conn.Subscribe(subject, handler)
 }
 
+// QueueSubscribe subscribes to a subject as member of a queue group, each
+// message is handled by one member of the group only
+func (c *NATSClient) QueueSubscribe(subject string, queue string, handler func(m *nats.Msg)) (*nats.Subscription, error) {
+	return c.conn.QueueSubscribe(subject, queue, handler)
+}
+
 // Request sends a request and waits for a reply
 func (c *NATSClient) Request(subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
 	return c.conn.Request(subject, data, timeout)